@@ -1,15 +1,17 @@
 import { writable, get } from "svelte/store";
-import { humanReadableSymbol, symbolsIndex } from "../util/constants.js";
+import { contracts } from "./contracts.js";
 
 const fetchData = async () => {
   try {
     const response = await fetch("/bar-ranges");
     if (!response.ok) throw new Error("Network response was not ok.");
     const data = await response.json();
+    await contracts.load();
+    const names = get(contracts);
     return data
       .sort((a, b) => {
-        const nameA = humanReadableSymbol[symbolsIndex[a.SymbolID]];
-        const nameB = humanReadableSymbol[symbolsIndex[b.SymbolID]];
+        const nameA = names[a.SymbolID]?.name ?? "";
+        const nameB = names[b.SymbolID]?.name ?? "";
         return nameA.localeCompare(nameB);
       })
       .map(({ SymbolID, FirstDate, LastDate }) => ({
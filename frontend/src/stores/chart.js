@@ -1,5 +1,6 @@
-import { writable, readable } from "svelte/store";
-import { durations, indexSymbols } from "../util/constants.js";
+import { writable, readable, get } from "svelte/store";
+import { durations } from "../util/constants.js";
+import { contracts, symbolIDs } from "./contracts.js";
 import { appendBar } from "../util/bars.js";
 
 export const lastPrices = writable({});
@@ -22,13 +23,18 @@ function createChartDataStore() {
 
   let abortController = null;
 
-  const fetchFn = (meta) => {
+  const fetchFn = async (meta) => {
     if (abortController) {
       abortController.abort();
     }
-    abortController = new AbortController();
+    const controller = new AbortController();
+    abortController = controller;
 
-    const symbolID = indexSymbols[meta.index];
+    await contracts.load();
+    if (controller.signal.aborted) {
+      return;
+    }
+    const symbolID = get(symbolIDs)[meta.index];
     chartIsLoading.set(true);
 
     fetch("/bars", {
@@ -43,7 +49,7 @@ function createChartDataStore() {
         EndDate: meta.enddate,
         Rth: meta.rth,
       }),
-      signal: abortController.signal,
+      signal: controller.signal,
     })
       .then((response) => response.json())
       .then((data) => {
@@ -73,7 +79,7 @@ function createChartDataStore() {
     set({ bars: currentBars, meta });
 
     lastPrices.update((prices) => {
-      return { ...prices, [indexSymbols[meta.index]]: bar.Close };
+      return { ...prices, [get(symbolIDs)[meta.index]]: bar.Close };
     });
   };
 
@@ -0,0 +1,48 @@
+import { writable, derived, get } from "svelte/store";
+
+const fetchData = async () => {
+  try {
+    const response = await fetch("/contracts");
+    if (!response.ok) throw new Error("Network response was not ok.");
+    const data = await response.json();
+    return Object.fromEntries(
+      data.contracts.map((contract) => [contract.id, contract]),
+    );
+  } catch (error) {
+    console.error("An error occurred while fetching the contracts:", error);
+    return {};
+  }
+};
+
+const contractsStore = writable({});
+
+let loading = null;
+
+// Contract specifications keyed by symbol ID, served from the registry on the server
+export const contracts = {
+  subscribe: contractsStore.subscribe,
+  load: async () => {
+    if (Object.keys(get(contractsStore)).length === 0) {
+      // Everything loading at once shares the one request
+      if (loading == null) {
+        loading = fetchData().then((data) => {
+          contractsStore.set(data);
+          loading = null;
+        });
+      }
+      await loading;
+    }
+  },
+};
+
+// Every contract in symbol ID order, for picking a chart
+export const contractList = derived(contractsStore, ($contracts) =>
+  Object.values($contracts).sort((a, b) => a.id - b.id),
+);
+
+// Symbol IDs keyed by root symbol, which charts are picked by
+export const symbolIDs = derived(contractsStore, ($contracts) =>
+  Object.fromEntries(
+    Object.values($contracts).map((contract) => [contract.root, contract.id]),
+  ),
+);
@@ -12,12 +12,15 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tradingcage/tradingcage-go/pkg/analytics"
 	"github.com/tradingcage/tradingcage-go/pkg/auth"
 	"github.com/tradingcage/tradingcage-go/pkg/bars"
 	"github.com/tradingcage/tradingcage-go/pkg/billing"
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
 	"github.com/tradingcage/tradingcage-go/pkg/database"
 	"github.com/tradingcage/tradingcage-go/pkg/email"
 	"github.com/tradingcage/tradingcage-go/pkg/replay"
@@ -40,13 +43,21 @@ var timescaleURL = os.Getenv("TIMESCALE_URL")
 
 var wsupgrader = &websocket.Upgrader{}
 
+var replaySessions = replay.NewSessions(replay.SessionGracePeriod)
+
+var replayRooms = replay.NewRooms(replay.RoomIdlePeriod)
+
+var runningSimulations = newAccountSimulations()
+
 // This is the struct that gets sent back from the websocket
 type replayData struct {
-	Bars            map[uint][]bars.Bar `json:"bars"`
-	Account         *database.Account   `json:"account"`
-	ActiveOrders    []database.Order    `json:"activeOrders"`
-	FulfilledOrders []database.Order    `json:"fulfilledOrders"`
-	Positions       []database.Position `json:"positions"`
+	Bars            map[uint][]bars.Bar            `json:"bars"`
+	Frames          map[uint]map[string][]bars.Bar `json:"frames"` // Each chart frame's updated bars, by symbol and timeframe
+	Account         *database.Account              `json:"account"`
+	ActiveOrders    []database.Order               `json:"activeOrders"`
+	FulfilledOrders []database.Order               `json:"fulfilledOrders"`
+	Positions       []database.Position            `json:"positions"`
+	Equity          *simulate.AccountEquity        `json:"equity"`
 }
 
 type bodyLogWriter struct {
@@ -59,18 +70,6 @@ func (w bodyLogWriter) Write(b []byte) (int, error) {
 	return w.ResponseWriter.Write(b)
 }
 
-func (r replayData) Send(c *websocket.Conn) {
-	stateJSON, err := json.Marshal(r)
-	if err != nil {
-		log.Print("error marshaling response: ", err)
-		return
-	}
-	err = c.WriteMessage(websocket.TextMessage, stateJSON)
-	if err != nil {
-		log.Print("error writing message: ", err)
-	}
-}
-
 func checkJSONError(c *gin.Context, err error) bool {
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -79,8 +78,214 @@ func checkJSONError(c *gin.Context, err error) bool {
 	return false
 }
 
+// Closes every position on the account with market orders at its simulated
+// date, and cancels the bracket legs protecting them. The orders fill at the
+// next bar's open, or straight away at the last price when immediate is set.
+func flattenAccount(db *gorm.DB, userID, accountID uint, immediate bool) (replayData, error) {
+	var ret replayData
+	err := database.Transaction(db, func(db *gorm.DB) error {
+		account, err := database.GetAccountByID(db, accountID)
+		if err != nil {
+			return err
+		}
+		if account.UserID != userID {
+			return auth.ErrNotAuthorized
+		}
+		positions, err := database.GetPositionsForAccount(db, accountID)
+		if err != nil {
+			return err
+		}
+		workingOrders, err := database.GetReadyOrders(db, accountID)
+		if err != nil {
+			return err
+		}
+
+		orders := simulate.FlattenOrders(positions, account.Date)
+		symbolIDs := make([]uint, 0, len(orders))
+		flattened := make(map[uint]struct{})
+		for i := range orders {
+			symbolIDs = append(symbolIDs, orders[i].SymbolID)
+			flattened[orders[i].SymbolID] = struct{}{}
+			if err = orders[i].Create(db); err != nil {
+				return err
+			}
+			event := database.NewOrderEvent("created", orders[i], account.Date)
+			if err = event.Create(db); err != nil {
+				return err
+			}
+			if err = database.RecordOrder(db, "order-placed", orders[i], account.Date); err != nil {
+				return err
+			}
+		}
+		for _, order := range workingOrders {
+			if _, ok := flattened[order.SymbolID]; !ok || order.EntryOrderID == nil || order.ActivatedAt == nil {
+				continue
+			}
+			order.CancelledAt = &account.Date
+			if err = order.Update(db); err != nil {
+				return err
+			}
+			event := database.NewOrderEvent("cancelled", order, account.Date)
+			if err = event.Create(db); err != nil {
+				return err
+			}
+			if err = database.RecordOrder(db, "order-cancelled", order, account.Date); err != nil {
+				return err
+			}
+		}
+
+		if immediate {
+			lastPrices, err := simulate.LastPrices(barsData, account.Date, symbolIDs)
+			if err != nil {
+				return err
+			}
+			cfg, err := simulate.LoadConfig(db, account, barsData)
+			if err != nil {
+				return err
+			}
+			var cash float64
+			orders, positions, cash = simulate.FillAtLastPrices(orders, positions, lastPrices, cfg, account.Date)
+			if err = database.UpdateMultipleOrders(db, orders); err != nil {
+				return err
+			}
+			if err = database.ReplacePositionsForAccount(db, accountID, positions); err != nil {
+				return err
+			}
+			account.AddFillCash(cash)
+			if err = account.Update(db); err != nil {
+				return err
+			}
+		}
+
+		ret.Account = &account
+		ret.Positions = positions
+		ret.ActiveOrders, err = database.GetReadyOrders(db, accountID)
+		if err != nil {
+			return err
+		}
+		ret.FulfilledOrders, err = database.GetFulfilledOrders(db, accountID)
+		return err
+	})
+	return ret, err
+}
+
+// Cancels every working order on the account at its simulated date,
+// including bracket legs still waiting on their entry.
+func cancelAllOrders(db *gorm.DB, userID, accountID uint) (replayData, error) {
+	var ret replayData
+	err := database.Transaction(db, func(db *gorm.DB) error {
+		account, err := database.GetAccountByID(db, accountID)
+		if err != nil {
+			return err
+		}
+		if account.UserID != userID {
+			return auth.ErrNotAuthorized
+		}
+		orders, err := database.GetReadyOrders(db, accountID)
+		if err != nil {
+			return err
+		}
+		for _, order := range orders {
+			order.CancelledAt = &account.Date
+			if err = order.Update(db); err != nil {
+				return err
+			}
+			event := database.NewOrderEvent("cancelled", order, account.Date)
+			if err = event.Create(db); err != nil {
+				return err
+			}
+			if err = database.RecordOrder(db, "order-cancelled", order, account.Date); err != nil {
+				return err
+			}
+		}
+
+		ret.Account = &account
+		ret.ActiveOrders = []database.Order{}
+		ret.Positions, err = database.GetPositionsForAccount(db, accountID)
+		if err != nil {
+			return err
+		}
+		ret.FulfilledOrders, err = database.GetFulfilledOrders(db, accountID)
+		return err
+	})
+	return ret, err
+}
+
+// Moves the account forward to the date a replay seeked to, simulating its
+// orders over the bars it skipped.
+func seekAccount(db *gorm.DB, authInfo *auth.AuthContext, accountID uint, date time.Time) (replayData, error) {
+	account, _, _, _, equity, err := simulate.AdvanceTo(db, authInfo, barsData, accountID, date)
+	if err != nil {
+		return replayData{}, err
+	}
+	// Orders and positions only come back when something filled, and the
+	// session needs them either way
+	ret := replayData{Account: &account, Equity: &equity}
+	ret.ActiveOrders, err = database.GetReadyOrders(db, accountID)
+	if err != nil {
+		return replayData{}, err
+	}
+	ret.FulfilledOrders, err = database.GetFulfilledOrders(db, accountID)
+	if err != nil {
+		return replayData{}, err
+	}
+	ret.Positions, err = database.GetPositionsForAccount(db, accountID)
+	return ret, err
+}
+
+// Rebuilds the account's cash, orders and positions from its ledger and
+// reports where they differ from what's stored. With apply set, the stored
+// state is replaced by the rebuilt one.
+func rebuildAccount(db *gorm.DB, userID, accountID uint, apply bool) ([]simulate.LedgerDiscrepancy, error) {
+	var discrepancies []simulate.LedgerDiscrepancy
+	err := database.Transaction(db, func(db *gorm.DB) error {
+		account, err := database.GetAccountByID(db, accountID)
+		if err != nil {
+			return err
+		}
+		if account.UserID != userID {
+			return auth.ErrNotAuthorized
+		}
+		events, err := database.GetLedgerForAccount(db, accountID)
+		if err != nil {
+			return err
+		}
+		projection, err := simulate.ProjectLedger(events, account.LotMatching)
+		if err != nil {
+			return err
+		}
+		workingOrders, err := database.GetReadyOrders(db, accountID)
+		if err != nil {
+			return err
+		}
+		positions, err := database.GetPositionsForAccount(db, accountID)
+		if err != nil {
+			return err
+		}
+		discrepancies = simulate.VerifyProjection(projection, account.RealizedPnL, workingOrders, positions)
+		if !apply || len(discrepancies) == 0 {
+			return nil
+		}
+
+		for _, order := range projection.Orders {
+			if err = order.Update(db); err != nil {
+				return err
+			}
+		}
+		if err = database.ReplacePositionsForAccount(db, accountID, projection.Positions); err != nil {
+			return err
+		}
+		account.RealizedPnL = projection.Cash
+		return account.Update(db)
+	})
+	return discrepancies, err
+}
+
 func simulateFn(c *gin.Context) {
 	authInfo := auth.GetAuthInfoFromContext(c)
+	if !checkProtocolVersion(c) {
+		return
+	}
 
 	idStr := c.Query("accountID")
 	if idStr == "" {
@@ -104,6 +309,12 @@ func simulateFn(c *gin.Context) {
 		}
 		symbolID = uint(symbolID64)
 	}
+	// The rest of the watchlist, which can change once the replay is running
+	watchlist, err := parseSymbolIDs(c.Query("symbolIDs"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	account, err := database.GetAccountByID(db, accountID)
 	if err != nil {
@@ -114,109 +325,599 @@ func simulateFn(c *gin.Context) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
 		return
 	}
+	// A client whose websocket dropped picks its session back up
+	if sessionID := c.Query("sessionID"); sessionID != "" {
+		resumeSession(c, authInfo.UserID, accountID, sessionID)
+		return
+	}
 	startMillis := account.Date.UnixMilli()
 
-	uad, err := database.NewUpdatedAccountData(db, accountID)
+	sim, err := newAccountSimulation(authInfo, account)
 	if err != nil {
-		log.Print("failed to get uad: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Determine which symbols we need by looking at the orders
-	symbolIDsMap := make(map[uint]struct{})
-	for _, order := range uad.GetOrders() {
-		symbolIDsMap[order.SymbolID] = struct{}{}
-	}
+	symbolIDsMap := sim.neededSymbols()
 	symbolIDsMap[symbolID] = struct{}{}
+	for _, symbolID := range watchlist {
+		symbolIDsMap[symbolID] = struct{}{}
+	}
 	symbolIDs := make([]uint, 0, len(symbolIDsMap))
 	for symbolID := range symbolIDsMap {
 		symbolIDs = append(symbolIDs, symbolID)
 	}
 	// Start replaying and simulating and send updates through websocket
-	barCh := make(chan map[uint][]bars.Bar)
-	defer close(barCh)
-	replayer := replay.NewReplayer(symbolIDs, startMillis, barsData, barCh)
-	defer replayer.Close()
+	replayer := replay.NewReplayer(symbolIDs, startMillis, barsData, replay.ReplayerConfig{})
 
 	conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
+		replayer.Close()
 		return
 	}
 	defer conn.Close()
 
-	ctx, cancel := context.WithCancel(c)
-	defer cancel()
+	// Account commands are handled between batches of bars
+	actionCh := make(chan replay.Command)
+
+	// The session outlives this websocket, running the commands of whichever
+	// one is attached
+	var session *replay.Session
+	handle := func(command replay.Command) error {
+		switch payload := command.GetPayload().(type) {
+		case *replay.FlattenCommand, *replay.CancelAllCommand:
+			select {
+			case actionCh <- command:
+			case <-session.Done():
+			}
+		case *replay.SeekCommand:
+			// Stop the bars first so the skipped interval is simulated
+			// before any bars after it
+			replayer.Pause()
+			replayer.DropUpdates()
+			sim.stale.Store(true)
+			if err := payload.Resolve(replayer.CurrentDate(), symbolID); err != nil {
+				return err
+			}
+			select {
+			case actionCh <- command:
+			case <-session.Done():
+				return nil
+			}
+			replayer.SendCommand(command)
+		case *replay.SubscribeCommand:
+			replayer.Subscribe(tradeableSymbols(payload.SymbolIDs)...)
+		case *replay.UnsubscribeCommand:
+			// Symbols with working orders or positions need bars to simulate
+			needed := sim.neededSymbols()
+			var symbolIDs []uint
+			for _, symbolID := range payload.SymbolIDs {
+				if _, ok := needed[symbolID]; !ok {
+					symbolIDs = append(symbolIDs, symbolID)
+				}
+			}
+			replayer.Unsubscribe(symbolIDs...)
+		case *replay.PlayCommand, *replay.StepCommand:
+			// The account may have been changed over HTTP while the
+			// replay was paused
+			sim.stale.Store(true)
+			replayer.SendCommand(command)
+		default:
+			replayer.SendCommand(command)
+		}
+		return nil
+	}
+	commands := append(append([]string{}, replay.ReplayCommands...), replay.AccountCommands...)
+	session, err = replaySessions.Create(authInfo.UserID, accountID, replayer, commands, handle)
+	if err != nil {
+		log.Print("error creating replay session: ", err)
+		replayer.Close()
+		return
+	}
+	if err := session.Attach(conn, 0); err != nil {
+		log.Print("error attaching to replay session: ", err)
+		session.Close()
+		return
+	}
+
+	go sim.run(session, actionCh, replayer.Updates(), session.Done(), nil)
+
+	session.SendHello(false)
+	readSessionCommands(conn, session)
+}
+
+// An account being simulated against the bars of a replay, with what's
+// kept of it between batches of bars.
+type accountSimulation struct {
+	authInfo *auth.AuthContext
+	account  database.Account
+	uad      *database.UpdatedAccountData
+	cfg      simulate.Config
+	marks    map[uint]float64 // Last prices to value positions at, kept up to date with each batch of bars
+	stale    atomic.Bool      // The account may have changed outside the replay since it was loaded
+}
+
+func newAccountSimulation(authInfo *auth.AuthContext, account database.Account) (*accountSimulation, error) {
+	uad, err := database.NewUpdatedAccountData(db, account.ID)
+	if err != nil {
+		return nil, fmt.Errorf("database.NewUpdatedAccountData: %w", err)
+	}
+	cfg, err := simulate.LoadConfig(db, account, barsData)
+	if err != nil {
+		return nil, err
+	}
+	sim := &accountSimulation{
+		authInfo: authInfo,
+		account:  account,
+		uad:      uad,
+		cfg:      cfg,
+		marks:    make(map[uint]float64),
+	}
+	if err := simulate.FillMissingMarks(sim.marks, barsData, account.Date, uad.GetPositions()); err != nil {
+		log.Print("error getting last prices: ", err)
+	}
+	return sim, nil
+}
+
+// Loads the account, its orders and positions, and its settings again if
+// they may have changed outside the replay, as over HTTP while it was paused.
+func (sim *accountSimulation) refresh() error {
+	if !sim.stale.Swap(false) {
+		return nil
+	}
+	if err := sim.uad.ReloadFromDatabase(sim.account.ID); err != nil {
+		return fmt.Errorf("uad.ReloadFromDatabase: %w", err)
+	}
+	sim.account = sim.uad.GetAccount()
+	cfg, err := simulate.LoadConfig(db, sim.account, barsData)
+	if err != nil {
+		return err
+	}
+	sim.cfg = cfg
+	return simulate.FillMissingMarks(sim.marks, barsData, sim.account.Date, sim.uad.GetPositions())
+}
+
+// The simulations running in replays, by account, so changes made to an
+// account outside its replay reach it.
+type accountSimulations struct {
+	sync.Mutex
+	sims     map[uint]*accountSimulation
+	sessions map[uint]*replay.Session
+}
+
+func newAccountSimulations() *accountSimulations {
+	return &accountSimulations{
+		sims:     make(map[uint]*accountSimulation),
+		sessions: make(map[uint]*replay.Session),
+	}
+}
+
+func (a *accountSimulations) add(sim *accountSimulation, session *replay.Session) {
+	a.Lock()
+	defer a.Unlock()
+	a.sims[sim.account.ID] = sim
+	a.sessions[sim.account.ID] = session
+}
+
+func (a *accountSimulations) remove(sim *accountSimulation) {
+	a.Lock()
+	defer a.Unlock()
+	if a.sims[sim.account.ID] == sim {
+		delete(a.sims, sim.account.ID)
+		delete(a.sessions, sim.account.ID)
+	}
+}
+
+// Changed has the account's replay reload it before simulating any more
+// bars, after its orders, positions or settings were changed.
+func (a *accountSimulations) Changed(accountID uint) {
+	a.Lock()
+	defer a.Unlock()
+	if sim, ok := a.sims[accountID]; ok {
+		sim.stale.Store(true)
+	}
+}
+
+// CloseAccount closes the account's replays, as after its date was changed
+// and their bars are no longer where the account is.
+func (a *accountSimulations) CloseAccount(accountID uint) {
+	replaySessions.CloseAccount(accountID)
+	a.Lock()
+	session, ok := a.sessions[accountID]
+	a.Unlock()
+	if ok {
+		session.Close()
+	}
+}
+
+// The symbols the account has working orders or positions in, which it needs
+// bars of to simulate.
+func (sim *accountSimulation) neededSymbols() map[uint]struct{} {
+	needed := make(map[uint]struct{})
+	for _, order := range sim.uad.GetOrders() {
+		needed[order.SymbolID] = struct{}{}
+	}
+	for _, position := range sim.uad.GetPositions() {
+		needed[position.SymbolID] = struct{}{}
+	}
+	return needed
+}
+
+// The account valued at the last prices, without saving anything.
+func (sim *accountSimulation) equity() simulate.AccountEquity {
+	account := sim.account
+	positions := append([]database.Position{}, sim.uad.GetPositions()...)
+	equity, _ := simulate.MarkToMarket(&account, positions, sim.marks)
+	return equity
+}
+
+// Simulates the account until done is closed or the updates run out,
+// carrying out the actions between batches of bars and sending each result
+// to the session. onResult, if given, also sees every result.
+func (sim *accountSimulation) run(session *replay.Session, actions <-chan replay.Command, updates <-chan replay.Update, done <-chan struct{}, onResult func(replayData)) {
+	runningSimulations.add(sim, session)
+	defer runningSimulations.remove(sim)
+	for {
+		var ret replayData
+		var err error
+		select {
+		case <-done:
+			return
+		case command := <-actions:
+			if err = sim.refresh(); err == nil {
+				ret, err = sim.runAction(command)
+			}
+			if err != nil {
+				log.Printf("error running %s: %s", command.Cmd, err.Error())
+				session.SendError(command.Cmd, replay.ErrorFailed, err)
+				continue
+			}
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			if err = sim.refresh(); err == nil {
+				ret, err = sim.runBars(update)
+			}
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+		}
+		if onResult != nil {
+			onResult(ret)
+		}
+		session.Send(replay.MessageData, ret)
+	}
+}
+
+func (sim *accountSimulation) runAction(command replay.Command) (replayData, error) {
+	userID, accountID := sim.authInfo.UserID, sim.account.ID
+	var ret replayData
+	var err error
+	switch payload := command.GetPayload().(type) {
+	case *replay.FlattenCommand:
+		ret, err = flattenAccount(db, userID, accountID, false)
+	case *replay.CancelAllCommand:
+		ret, err = cancelAllOrders(db, userID, accountID)
+	case *replay.SeekCommand:
+		ret, err = seekAccount(db, sim.authInfo, accountID, time.UnixMilli(payload.Date))
+		if err == nil {
+			// Value positions at the prices they were left at
+			sim.marks = make(map[uint]float64)
+			err = simulate.FillMissingMarks(sim.marks, barsData, ret.Account.Date, ret.Positions)
+		}
+	default:
+		err = fmt.Errorf("%s isn't an account action", command.Cmd)
+	}
+	if err != nil {
+		return replayData{}, err
+	}
+	sim.account = *ret.Account
+	sim.uad.SetAccount(sim.account)
+	sim.uad.SetOrders(ret.ActiveOrders)
+	sim.uad.SetPositions(ret.Positions)
+	return ret, nil
+}
 
+// The bars after the date, which are in order.
+func barsAfter(symbolBars []bars.Bar, date time.Time) []bars.Bar {
+	for i, bar := range symbolBars {
+		if bar.Date > date.UnixMilli() {
+			return symbolBars[i:]
+		}
+	}
+	return nil
+}
+
+func (sim *accountSimulation) runBars(update replay.Update) (replayData, error) {
+	accountID := sim.account.ID
+	var ret replayData
+	// Bars from before a seek can still be on their way, and have been
+	// simulated already
+	barMap := make(map[uint][]bars.Bar, len(update.Bars))
+	for symbolID, symbolBars := range update.Bars {
+		barMap[symbolID] = barsAfter(symbolBars, sim.account.Date)
+	}
+	ret.Bars = barMap
+	ret.Frames = update.Frames
+	// Simulate orders, checking margin against the latest balance
+	sim.cfg.Margin = &simulate.MarginAccount{Cash: sim.account.RealizedPnL}
+	didExecute, ord, pos, pnl, err := simulate.SimulateBars(barMap, sim.uad.GetOrders(), sim.uad.GetPositions(), sim.cfg)
+	if err != nil {
+		return replayData{}, fmt.Errorf("error simulating bars: %w", err)
+	}
+	simulate.UpdateMarks(sim.marks, barMap)
+	if !didExecute {
+		// Move up to the earliest new bar of any symbol
+		var next int64
+		for _, symbolBars := range barMap {
+			if len(symbolBars) > 0 && symbolBars[0].Date > sim.account.Date.UnixMilli() &&
+				(next == 0 || symbolBars[0].Date < next) {
+				next = symbolBars[0].Date
+			}
+		}
+		if next > 0 {
+			sim.account.Date = time.UnixMilli(next)
+		}
+		positions := append([]database.Position{}, sim.uad.GetPositions()...)
+		equity, newDay := simulate.MarkToMarket(&sim.account, positions, sim.marks)
+		if newDay {
+			if err = database.ReplacePositionsForAccount(db, accountID, positions); err != nil {
+				log.Printf("database.ReplacePositionsForAccount error: %s", err.Error())
+			}
+			sim.uad.SetPositions(positions)
+		}
+		if err = sim.account.UpdateSimulated(db); err != nil {
+			log.Printf("account.UpdateSimulated error: %s", err.Error())
+		}
+		ret.Equity = &equity
+		return ret, nil
+	}
+	// Update orders and positions
+	account := sim.account
+	var activeOrders []database.Order
+	var fulfilledOrders []database.Order
+	var equity simulate.AccountEquity
+	err = database.Transaction(db, func(db *gorm.DB) error {
+		if err := database.UpdateMultipleOrders(db, ord); err != nil {
+			return fmt.Errorf("database.UpdateMultipleOrders: %w", err)
+		}
+		account, err = database.GetAccountByID(db, accountID)
+		if err != nil {
+			return fmt.Errorf("database.GetAccountByID: %w", err)
+		}
+		account.AddFillCash(pnl)
+		if err = simulate.FillMissingMarks(sim.marks, barsData, account.Date, pos); err != nil {
+			return err
+		}
+		equity, _ = simulate.MarkToMarket(&account, pos, sim.marks)
+		if err = database.ReplacePositionsForAccount(db, accountID, pos); err != nil {
+			return fmt.Errorf("database.ReplacePositionsForAccount: %w", err)
+		}
+		if err = account.UpdateSimulated(db); err != nil {
+			return fmt.Errorf("account.UpdateSimulated: %w", err)
+		}
+		activeOrders, err = database.GetReadyOrders(db, accountID)
+		if err != nil {
+			return err
+		}
+		fulfilledOrders, err = database.GetFulfilledOrders(db, accountID)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return replayData{}, fmt.Errorf("error updating orders and positions after execution: %w", err)
+	}
+	sim.account = account
+
+	sim.uad.SetAccount(account)
+	sim.uad.SetOrders(activeOrders)
+	sim.uad.SetPositions(pos)
+
+	// Send updated orders and positions back to the client
+	ret.Account = &account
+	ret.ActiveOrders = activeOrders
+	ret.FulfilledOrders = fulfilledOrders
+	ret.Positions = pos
+	ret.Equity = &equity
+	return ret, nil
+}
+
+// Joins a replay room with one of the user's accounts, which is simulated
+// against the room's bars. Only the room's host controls the replay.
+func joinRoomFn(c *gin.Context) {
+	authInfo := auth.GetAuthInfoFromContext(c)
+	if !checkProtocolVersion(c) {
+		return
+	}
+	room, ok := replayRooms.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "replay room not found"})
+		return
+	}
+
+	accountIDInt, err := strconv.Atoi(c.Query("accountID"))
+	if err != nil || accountIDInt <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid accountID parameter"})
+		return
+	}
+	accountID := uint(accountIDInt)
+	account, err := database.GetAccountByID(db, accountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+		return
+	}
+	if authInfo.UserID != account.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+		return
+	}
+	if room.HasMember(accountID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "account is already in the room"})
+		return
+	}
+
+	// Everyone trades from the room's date, so accounts behind it are caught
+	// up and ones past it need rewinding first
+	date := room.Replayer.CurrentDate()
+	if account.Date.After(date) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "account is past the room's replay, rewind it first"})
+		return
+	}
+	if account.Date.Before(date) {
+		account, _, _, _, _, err = simulate.AdvanceTo(db, authInfo, barsData, accountID, date)
+		if checkJSONError(c, err) {
+			return
+		}
+	}
+	// Usernames are email addresses, so the leaderboard shows a name of the
+	// member's choosing instead
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" {
+		name = account.Name
+	}
+	if runes := []rune(name); len(runes) > 40 {
+		name = string(runes[:40])
+	}
+
+	// The account can't be simulated by a session of its own at the same time
+	replaySessions.CloseAccount(accountID)
+	sim, err := newAccountSimulation(authInfo, account)
+	if checkJSONError(c, err) {
+		return
+	}
+
+	conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	defer conn.Close()
+
+	var member *replay.Member
+	handle := func(command replay.Command) error {
+		switch payload := command.GetPayload().(type) {
+		case *replay.FlattenCommand, *replay.CancelAllCommand:
+			member.Act(command)
+		case *replay.SeekCommand:
+			// Every member's account is moved up to the target before any
+			// bars after it
+			room.Replayer.Pause()
+			room.DropUpdates()
+			if err := payload.Resolve(room.Replayer.CurrentDate(), room.SymbolID); err != nil {
+				return err
+			}
+			room.Act(command)
+			room.Replayer.SendCommand(command)
+		case *replay.SubscribeCommand:
+			room.Replayer.Subscribe(tradeableSymbols(payload.SymbolIDs)...)
+		default:
+			room.Replayer.SendCommand(command)
+		}
+		return nil
+	}
+	commands := replay.MemberCommands
+	if authInfo.UserID == room.HostID {
+		commands = append(append([]string{}, replay.ReplayCommands...), replay.MemberCommands...)
+	}
+	session, err := replay.NewSession(authInfo.UserID, accountID, nil, commands, handle)
+	if err != nil {
+		log.Print("error creating replay session: ", err)
+		return
+	}
+	defer session.Close()
+	if err := session.Attach(conn, 0); err != nil {
+		log.Print("error attaching to replay session: ", err)
+		return
+	}
+	member, err = room.Join(session, name, sim.equity().NetLiquidationValue)
+	if err != nil {
+		log.Printf("error joining room %s: %s", room.ID, err.Error())
+		return
+	}
+	defer room.Leave(member)
+
+	// The room's replay needs bars of whatever the account is trading
+	var symbolIDs []uint
+	for symbolID := range sim.neededSymbols() {
+		symbolIDs = append(symbolIDs, symbolID)
+	}
+	room.Replayer.Subscribe(symbolIDs...)
+
+	go sim.run(session, member.Actions(), member.Updates(), member.Left(), func(ret replayData) {
+		if ret.Equity != nil {
+			room.SetValue(accountID, ret.Equity.NetLiquidationValue)
+		}
+	})
+
+	session.SendHello(false)
+	readSessionCommands(conn, session)
+}
+
+// Attaches a new websocket to a replay session that lost its old one. The
+// client gives the sequence number of the last message it saw, and is sent
+// the ones after it before anything new.
+func resumeSession(c *gin.Context, userID, accountID uint, sessionID string) {
+	session, ok := replaySessions.Get(sessionID)
+	if !ok || session.UserID != userID || session.AccountID != accountID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "replay session not found"})
+		return
+	}
+	lastSeq, err := strconv.ParseUint(c.Query("lastSeq"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid lastSeq parameter"})
+		return
+	}
+	if err := session.Resumable(lastSeq); err != nil {
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	}
+
+	conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := session.Attach(conn, lastSeq); err != nil {
+		log.Printf("error resuming session %s: %s", sessionID, err.Error())
+		return
+	}
+	session.SendHello(true)
+	readSessionCommands(conn, session)
+}
+
+// Passes the commands read from a websocket to its session until it drops,
+// pinging it to notice if it goes quiet.
+func readSessionCommands(conn *websocket.Conn, session *replay.Session) {
+	defer session.Detach(conn)
+
+	extendDeadline := func() error {
+		return conn.SetReadDeadline(time.Now().Add(2 * replay.HeartbeatInterval))
+	}
+	extendDeadline()
+	conn.SetPongHandler(func(string) error {
+		return extendDeadline()
+	})
+	stop := make(chan struct{})
+	defer close(stop)
 	go func() {
+		ticker := time.NewTicker(replay.HeartbeatInterval)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-ctx.Done():
+			case <-stop:
 				return
-			case barMap := <-barCh:
-				var ret replayData
-				ret.Bars = barMap
-				// Simulate orders
-				didExecute, ord, pos, pnl, err := simulate.SimulateBars(barMap, uad.GetOrders(), uad.GetPositions())
-				if err != nil {
-					log.Print("error simulating bars: ", err)
-					continue
-				}
-				if !didExecute {
-					ret.Send(conn)
-					if symbolBars, ok := barMap[symbolID]; ok && len(symbolBars) > 0 {
-						firstBar := symbolBars[0]
-						if firstBar.Date > account.Date.UnixMilli() {
-							account.Date = time.UnixMilli(firstBar.Date)
-							if err = account.Update(db); err != nil {
-								log.Printf("account.Update error: %s", err.Error())
-							}
-						}
-					}
-					continue
-				}
-				// Update orders and positions
-				var activeOrders []database.Order
-				var fulfilledOrders []database.Order
-				err = database.Transaction(db, func(db *gorm.DB) error {
-					if err := database.UpdateMultipleOrders(db, ord); err != nil {
-						return fmt.Errorf("database.UpdateMultipleOrders: %w", err)
-					}
-					if err = database.ReplacePositionsForAccount(db, accountID, pos); err != nil {
-						return fmt.Errorf("database.ReplacePositionsForAccount: %w", err)
-					}
-					account, err = database.GetAccountByID(db, accountID)
-					if err != nil {
-						return fmt.Errorf("database.GetAccountByID: %w", err)
-					}
-					account.RealizedPnL += pnl
-					if err = account.Update(db); err != nil {
-						return fmt.Errorf("account.Update: %w", err)
-					}
-					activeOrders, err = database.GetReadyOrders(db, accountID)
-					if err != nil {
-						return err
-					}
-					fulfilledOrders, err = database.GetFulfilledOrders(db, accountID)
-					if err != nil {
-						return err
-					}
-					return nil
-				})
-				if err != nil {
-					log.Printf("error updating orders and positions after execution: %s", err.Error())
-					continue
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(replay.HeartbeatInterval)); err != nil {
+					log.Println("ping:", err)
+					return
 				}
-
-				uad.SetAccount(account)
-				uad.SetOrders(activeOrders)
-				uad.SetPositions(pos)
-
-				// Send updated orders and positions back to the client
-				ret.Account = &account
-				ret.ActiveOrders = activeOrders
-				ret.FulfilledOrders = fulfilledOrders
-				ret.Positions = pos
-				ret.Send(conn)
 			}
 		}
 	}()
@@ -227,18 +928,63 @@ func simulateFn(c *gin.Context) {
 			log.Println("read:", err)
 			return
 		}
+		extendDeadline()
 
 		command, err := replay.ParseCommand(msg)
 		if err != nil {
-			log.Println("error parsing command: ", err)
+			session.SendError("", replay.ErrorParse, err)
 			continue
 		}
+		session.Handle(command)
+	}
+}
 
-		replayer.SendCommand(command)
+// Clients can give the protocol version they were written for, and are
+// turned away if it isn't the one spoken here.
+func checkProtocolVersion(c *gin.Context) bool {
+	v := c.Query("v")
+	if v == "" || v == strconv.Itoa(replay.ProtocolVersion) {
+		return true
 	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported protocol version %s, expected %d", v, replay.ProtocolVersion)})
+	return false
+}
+
+// Parses a comma separated list of tradeable symbol IDs.
+func parseSymbolIDs(s string) ([]uint, error) {
+	var symbolIDs []uint
+	if s == "" {
+		return symbolIDs, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		symbolID, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid symbolIDs parameter %q", part)
+		}
+		if !contracts.IsTradeable(uint(symbolID)) {
+			return nil, fmt.Errorf("symbol %d is not tradeable", symbolID)
+		}
+		symbolIDs = append(symbolIDs, uint(symbolID))
+	}
+	return symbolIDs, nil
+}
+
+// Keeps the symbols that can be traded.
+func tradeableSymbols(symbolIDs []uint) []uint {
+	var tradeable []uint
+	for _, symbolID := range symbolIDs {
+		if contracts.IsTradeable(symbolID) {
+			tradeable = append(tradeable, symbolID)
+		}
+	}
+	return tradeable
 }
 
 func replayFn(c *gin.Context) {
+	authInfo := auth.GetAuthInfoFromContext(c)
+	if !checkProtocolVersion(c) {
+		return
+	}
 	var startMillis int64
 	var err error
 	startStr := c.Query("startingDateMillis")
@@ -261,46 +1007,63 @@ func replayFn(c *gin.Context) {
 		symbolID = uint(symbolID64)
 	}
 
-	barCh := make(chan map[uint][]bars.Bar)
-	defer close(barCh)
-	replayer := replay.NewReplayer([]uint{symbolID}, startMillis, barsData, barCh)
-	defer replayer.Close()
+	replayer := replay.NewReplayer([]uint{symbolID}, startMillis, barsData, replay.ReplayerConfig{})
 
 	conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
+		replayer.Close()
 		return
 	}
 	defer conn.Close()
 
+	// Charts replay without an account, so their sessions aren't kept for
+	// resuming
+	session, err := replay.NewSession(authInfo.UserID, 0, replayer, replay.ReplayCommands, func(command replay.Command) error {
+		if seek, ok := command.GetPayload().(*replay.SeekCommand); ok {
+			if err := seek.Resolve(replayer.CurrentDate(), symbolID); err != nil {
+				return err
+			}
+		}
+		replayer.SendCommand(command)
+		return nil
+	})
+	if err != nil {
+		log.Print("error creating replay session: ", err)
+		replayer.Close()
+		return
+	}
+	defer session.Close()
+	if err := session.Attach(conn, 0); err != nil {
+		log.Print("error attaching to replay session: ", err)
+		return
+	}
+
 	go func() {
-		for recvBarsM := range barCh {
-			for _, recvBars := range recvBarsM {
-				ret := replayData{
-					Bars: map[uint][]bars.Bar{
-						symbolID: recvBars,
-					},
+		for {
+			select {
+			case <-session.Done():
+				return
+			case update, ok := <-replayer.Updates():
+				if !ok {
+					return
+				}
+				for replayedID, recvBars := range update.Bars {
+					session.Send(replay.MessageData, replayData{
+						Bars: map[uint][]bars.Bar{
+							symbolID: recvBars,
+						},
+						Frames: map[uint]map[string][]bars.Bar{
+							symbolID: update.Frames[replayedID],
+						},
+					})
 				}
-				ret.Send(conn)
 			}
 		}
 	}()
 
-	for {
-		_, msg, err := conn.ReadMessage()
-		if err != nil {
-			log.Println("read:", err)
-			break
-		}
-
-		command, err := replay.ParseCommand(msg)
-		if err != nil {
-			log.Printf("error parsing command: %v", err)
-			continue
-		}
-
-		replayer.SendCommand(command)
-	}
+	session.SendHello(false)
+	readSessionCommands(conn, session)
 }
 
 func GetCurrentGitCommitHash() (string, error) {
@@ -386,6 +1149,12 @@ func main() {
 
 	db = database.Init()
 
+	if contractsFile := os.Getenv("CONTRACTS_FILE"); contractsFile != "" {
+		if err := contracts.LoadFile(contractsFile); err != nil {
+			log.Fatalf("contracts.LoadFile: %s\n", err)
+		}
+	}
+
 	barsData, err = bars.NewTimescaleData(timescaleURL)
 	if err != nil {
 		log.Fatalf("NewTimescaleData: %s\n", err)
@@ -407,6 +1176,9 @@ func main() {
 	sendGridAPIKey := os.Getenv("SENDGRID_API_KEY")
 	emailService := email.NewSendGridEmailService(sendGridAPIKey)
 
+	go replaySessions.RunReaper(time.Minute)
+	go replayRooms.RunReaper(time.Minute)
+
 	r := gin.Default()
 
 	r.Use(auth.AuthInfoMiddleware)
@@ -501,9 +1273,59 @@ func main() {
 			c.JSON(http.StatusOK, dateRanges)
 		})
 
+		r.GET("/contracts", func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{
+				"contracts": contracts.All(),
+				"sessions":  contracts.Sessions(),
+			})
+		})
+
 		r.GET("/simulate", simulateFn)
 		r.GET("/replay", replayFn)
 
+		r.GET("/rooms", func(c *gin.Context) {
+			c.JSON(http.StatusOK, replayRooms.List())
+		})
+		r.POST("/rooms", func(c *gin.Context) {
+			var req struct {
+				Name     string    `json:"name" binding:"required"`
+				SymbolID uint      `json:"symbolID" binding:"required"`
+				Date     time.Time `json:"date" binding:"required"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if !contracts.IsTradeable(req.SymbolID) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("symbol %d is not tradeable", req.SymbolID)})
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			replayer := replay.NewReplayer([]uint{req.SymbolID}, req.Date.UnixMilli(), barsData, replay.ReplayerConfig{})
+			room, err := replayRooms.Create(strings.TrimSpace(req.Name), authInfo.UserID, req.SymbolID, replayer, nil)
+			if err != nil {
+				replayer.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, room.Info())
+		})
+		r.DELETE("/rooms/:id", func(c *gin.Context) {
+			room, ok := replayRooms.Get(c.Param("id"))
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "replay room not found"})
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			if room.HostID != authInfo.UserID {
+				c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				return
+			}
+			room.Close()
+			c.Status(http.StatusOK)
+		})
+		r.GET("/rooms/:id/join", joinRoomFn)
+
 		r.GET("/dashboard", func(c *gin.Context) {
 			authInfo := auth.GetAuthInfoFromContext(c)
 			var accounts []database.Account
@@ -525,34 +1347,131 @@ func main() {
 			})
 		})
 
-		r.GET("/analytics/:accountID", func(c *gin.Context) {
+		r.GET("/analytics/:accountID", func(c *gin.Context) {
+			authInfo := auth.GetAuthInfoFromContext(c)
+			accountIDParam := c.Param("accountID")
+			accountID, err := strconv.ParseUint(accountIDParam, 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid accountID parameter"})
+				return
+			}
+			var account database.Account
+			err = db.Where("user_id = ? AND id = ?", authInfo.UserID, accountID).First(&account).Error
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
+				return
+			}
+			rewinds, err := database.GetRewindsForAccount(db, account.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			branches, err := database.GetBranchesOfAccount(db, account.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			var trades []analytics.Trade
+			var rewindID uint64
+			if rewindParam := c.Query("rewind"); rewindParam != "" {
+				// Show an attempt that was rewound as the account was when it ended
+				rewindID, err = strconv.ParseUint(rewindParam, 10, 32)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rewind parameter"})
+					return
+				}
+				rewind, err := database.GetRewindByID(db, uint(rewindID))
+				if err != nil || rewind.AccountID != account.ID {
+					c.JSON(http.StatusNotFound, gin.H{"error": "rewind not found"})
+					return
+				}
+				trades, err = analytics.GetRewoundTrades(db, account, rewind)
+				account.Date = rewind.FromDate
+				account.RealizedPnL = rewind.RealizedPnL
+				account.NetLiquidationValue = rewind.NetLiquidationValue
+			} else {
+				trades, err = analytics.GetTrades(db, account)
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			tradeMetrics := analytics.CalculateTradeMetrics(trades)
+			c.HTML(http.StatusOK, "analytics.tmpl", gin.H{
+				"title":        "Trading Cage - Analytics",
+				"account":      account,
+				"trades":       trades,
+				"tradeMetrics": tradeMetrics,
+				"rewinds":      rewinds,
+				"rewindID":     uint(rewindID),
+				"branched":     len(branches) > 0 || account.ParentAccountID != nil,
+			})
+		})
+
+		r.GET("/analytics/:accountID/branches", func(c *gin.Context) {
 			authInfo := auth.GetAuthInfoFromContext(c)
-			accountIDParam := c.Param("accountID")
-			accountID, err := strconv.ParseUint(accountIDParam, 10, 32)
+			accountID, err := strconv.ParseUint(c.Param("accountID"), 10, 32)
 			if err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid accountID parameter"})
 				return
 			}
-			var account database.Account
-			err = db.Where("user_id = ? AND id = ?", authInfo.UserID, accountID).First(&account).Error
-			if err != nil {
-				if errors.Is(err, gorm.ErrRecordNotFound) {
-					c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
-				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				}
+			root, err := database.GetAccountByID(db, uint(accountID))
+			if err != nil || root.UserID != authInfo.UserID {
+				c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
 				return
 			}
-			trades, err := analytics.GetTrades(db, uint(accountID))
+			// Branches are compared alongside the account they came from
+			if root.ParentAccountID != nil {
+				parent, err := database.GetAccountByID(db, *root.ParentAccountID)
+				if err == nil && parent.UserID == authInfo.UserID {
+					root = parent
+				}
+			}
+			branches, err := database.GetBranchesOfAccount(db, root.ID)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
 			}
-			tradeMetrics := analytics.CalculateTradeMetrics(trades)
-			c.HTML(http.StatusOK, "analytics.tmpl", gin.H{
-				"title":        "Trading Cage - Analytics",
-				"account":      account,
-				"trades":       trades,
-				"tradeMetrics": tradeMetrics,
+
+			// Only trades since the first branch are compared for the account
+			// they came from, and since its branch point for each branch
+			var since time.Time
+			for _, branch := range branches {
+				if since.IsZero() || branch.BranchedAt.Before(since) {
+					since = *branch.BranchedAt
+				}
+			}
+			type branchSummary struct {
+				Account      database.Account
+				Trades       int
+				TradeMetrics analytics.TradeMetrics
+			}
+			var summaries []branchSummary
+			for _, account := range append([]database.Account{root}, branches...) {
+				trades, err := analytics.GetTrades(db, account)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				from := since
+				if account.BranchedAt != nil && account.ID != root.ID {
+					from = *account.BranchedAt
+				}
+				trades = analytics.TradesSince(trades, from)
+				summaries = append(summaries, branchSummary{
+					Account:      account,
+					Trades:       len(trades),
+					TradeMetrics: analytics.CalculateTradeMetrics(trades),
+				})
+			}
+			c.HTML(http.StatusOK, "branches.tmpl", gin.H{
+				"title":     "Trading Cage - Compare Branches",
+				"account":   root,
+				"since":     since,
+				"summaries": summaries,
 			})
 		})
 
@@ -593,6 +1512,9 @@ func main() {
 				if account.UserID != authInfo.UserID {
 					return auth.ErrNotAuthorized
 				}
+				if err = database.EnsureLedger(db, accountID); err != nil {
+					return err
+				}
 				activeOrders, err = database.GetReadyOrders(db, accountID)
 				if err != nil {
 					return err
@@ -610,12 +1532,19 @@ func main() {
 			if checkJSONError(c, err) {
 				return
 			}
+			marks := make(map[uint]float64)
+			if err = simulate.FillMissingMarks(marks, barsData, account.Date, positions); checkJSONError(c, err) {
+				return
+			}
+			// Only for display, so the account isn't saved
+			equity, _ := simulate.MarkToMarket(&account, positions, marks)
 			c.HTML(http.StatusOK, "simulator.tmpl", gin.H{
 				"title":           "Trading Cage - Simulator",
 				"date":            account.Date.UnixMilli(),
 				"activeOrders":    activeOrders,
 				"positions":       positions,
 				"realizedPnl":     account.RealizedPnL,
+				"equity":          equity,
 				"fulfilledOrders": fulfilledOrders,
 				"accountID":       accountID,
 				"buildHash":       buildHash,
@@ -661,70 +1590,416 @@ func main() {
 				Bars:       resultBars,
 				LastPrices: lastPrices,
 			}
-			resultJSON, err := json.Marshal(payload)
+			resultJSON, err := json.Marshal(payload)
+			if checkJSONError(c, err) {
+				return
+			}
+			c.Data(http.StatusOK, "application/json", resultJSON)
+		})
+		r.POST("/inc-date", func(c *gin.Context) {
+			var req struct {
+				Inc       string `json:"inc"`
+				AccountID uint   `json:"accountID"`
+			}
+			err := c.ShouldBindJSON(&req)
+			if checkJSONError(c, err) {
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+
+			account, activeOrders, fulfilledOrders, newPositions, equity, err := simulate.IncDate(
+				db, authInfo, barsData, req.AccountID, req.Inc,
+			)
+
+			if checkJSONError(c, err) {
+				return
+			}
+			runningSimulations.CloseAccount(account.ID)
+
+			c.JSON(http.StatusOK, replayData{
+				Account:         &account,
+				ActiveOrders:    activeOrders,
+				FulfilledOrders: fulfilledOrders,
+				Positions:       newPositions,
+				Equity:          &equity,
+			})
+		})
+		r.POST("/submit-order", func(c *gin.Context) {
+			var req struct {
+				AccountID  uint `json:"accountID"`
+				SymbolID   uint `json:"symbolID"`
+				EntryOrder struct {
+					OrderType   string     `json:"orderType"`
+					Direction   string     `json:"direction"`
+					Price       float64    `json:"price"`
+					LimitPrice  float64    `json:"limitPrice"`
+					TrailAmount float64    `json:"trailAmount"`
+					TrailUnit   string     `json:"trailUnit"`
+					Quantity    int        `json:"quantity"`
+					TimeInForce string     `json:"timeInForce"`
+					ExpiresAt   *time.Time `json:"expiresAt"` // Only used by GTD orders
+				} `json:"entryOrder"`
+				LinkedOrders []struct {
+					OrderType      string     `json:"orderType"`
+					Direction      string     `json:"direction"`
+					Price          float64    `json:"price"`
+					LimitPrice     float64    `json:"limitPrice"`
+					TrailAmount    float64    `json:"trailAmount"`
+					TrailUnit      string     `json:"trailUnit"`
+					Quantity       int        `json:"quantity"`
+					TimeInForce    string     `json:"timeInForce"`
+					ExpiresAt      *time.Time `json:"expiresAt"`
+					ActivateOnFill bool       `json:"activateOnFill"`
+				} `json:"linkedOrders"`
+				SnapToTick bool   `json:"snapToTick"` // Round off-tick prices instead of rejecting them
+				Action     string `json:"action"`     // "reverse" turns the entry order into a market order that reverses the position
+			}
+			err := c.ShouldBindJSON(&req)
+			if checkJSONError(c, err) {
+				return
+			}
+			if _, ok := simulate.OrderActions[req.Action]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid action: " + req.Action})
+				return
+			}
+
+			entryOrder := database.Order{
+				AccountID:   req.AccountID,
+				SymbolID:    req.SymbolID,
+				OrderType:   req.EntryOrder.OrderType,
+				Direction:   req.EntryOrder.Direction,
+				Price:       req.EntryOrder.Price,
+				LimitPrice:  req.EntryOrder.LimitPrice,
+				TrailAmount: req.EntryOrder.TrailAmount,
+				TrailUnit:   req.EntryOrder.TrailUnit,
+				Quantity:    req.EntryOrder.Quantity,
+				TimeInForce: req.EntryOrder.TimeInForce,
+				ExpiresAt:   req.EntryOrder.ExpiresAt,
+			}
+			var validationErrors simulate.ValidationErrors
+			// A reversal's direction and quantity depend on the position,
+			// so it's validated once that's loaded
+			if req.Action != "reverse" {
+				validationErrors = simulate.ValidateOrder("entryOrder", &entryOrder, req.SnapToTick)
+			}
+			linkedOrders := make([]database.Order, 0, len(req.LinkedOrders))
+			for i, linkedOrder := range req.LinkedOrders {
+				newOrder := database.Order{
+					AccountID:   req.AccountID,
+					SymbolID:    req.SymbolID,
+					OrderType:   linkedOrder.OrderType,
+					Direction:   linkedOrder.Direction,
+					Price:       linkedOrder.Price,
+					LimitPrice:  linkedOrder.LimitPrice,
+					TrailAmount: linkedOrder.TrailAmount,
+					TrailUnit:   linkedOrder.TrailUnit,
+					Quantity:    linkedOrder.Quantity,
+					TimeInForce: linkedOrder.TimeInForce,
+					ExpiresAt:   linkedOrder.ExpiresAt,
+				}
+				validationErrors = append(validationErrors, simulate.ValidateOrder(fmt.Sprintf("linkedOrders[%d]", i), &newOrder, req.SnapToTick)...)
+				linkedOrders = append(linkedOrders, newOrder)
+			}
+			if len(validationErrors) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": validationErrors.Error(), "validationErrors": validationErrors})
+				return
+			}
+
+			authInfo := auth.GetAuthInfoFromContext(c)
+			var activeOrders []database.Order
+			err = database.Transaction(db, func(db *gorm.DB) error {
+
+				account, err := database.GetAccountByID(db, req.AccountID)
+				if err != nil {
+					return err
+				}
+				if account.UserID != authInfo.UserID {
+					return auth.ErrNotAuthorized
+				}
+
+				// Expiries depend on the account's simulated date
+				validationErrors = simulate.SetExpiry("entryOrder", &entryOrder, account.Date)
+				for i := range linkedOrders {
+					validationErrors = append(validationErrors, simulate.SetExpiry(fmt.Sprintf("linkedOrders[%d]", i), &linkedOrders[i], account.Date)...)
+				}
+				if len(validationErrors) > 0 {
+					return nil
+				}
+
+				positions, err := database.GetPositionsForAccount(db, account.ID)
+				if err != nil {
+					return err
+				}
+				if req.Action == "reverse" {
+					validationErrors = simulate.ReversePosition("entryOrder", &entryOrder, positions)
+					if len(validationErrors) > 0 {
+						return nil
+					}
+					validationErrors = simulate.ValidateOrder("entryOrder", &entryOrder, req.SnapToTick)
+					if len(validationErrors) > 0 {
+						return nil
+					}
+				}
+				workingOrders, err := database.GetReadyOrders(db, account.ID)
+				if err != nil {
+					return err
+				}
+				positionSymbolIDs := make([]uint, 0, len(positions))
+				for _, position := range positions {
+					positionSymbolIDs = append(positionSymbolIDs, position.SymbolID)
+				}
+				lastPrices, err := simulate.LastPrices(barsData, account.Date, positionSymbolIDs)
+				if err != nil {
+					return err
+				}
+				// Linked orders only close out the entry, so they don't need margin
+				validationErrors = simulate.CheckBuyingPower("entryOrder", account.RealizedPnL, positions, workingOrders, []database.Order{entryOrder}, lastPrices)
+				if len(validationErrors) > 0 {
+					return nil
+				}
+
+				entryOrder.CreatedAt = &account.Date
+				entryOrder.ActivatedAt = &account.Date
+				err = entryOrder.Create(db)
+				if err != nil {
+					return err
+				}
+				event := database.NewOrderEvent("created", entryOrder, account.Date)
+				if err = event.Create(db); err != nil {
+					return err
+				}
+				if err = database.RecordOrder(db, "order-placed", entryOrder, account.Date); err != nil {
+					return err
+				}
+
+				for i, newOrder := range linkedOrders {
+					newOrder.CreatedAt = &account.Date
+					newOrder.EntryOrderID = &entryOrder.ID
+					if req.LinkedOrders[i].ActivateOnFill {
+						// Leave ActivatedAt as nil to indicate that this order is activated after the entry order is filled.
+						newOrder.ActivatedAt = nil
+					} else {
+						newOrder.ActivatedAt = &account.Date
+					}
+					if err = newOrder.Create(db); err != nil {
+						return err
+					}
+					event := database.NewOrderEvent("created", newOrder, account.Date)
+					if err = event.Create(db); err != nil {
+						return err
+					}
+					if err = database.RecordOrder(db, "order-placed", newOrder, account.Date); err != nil {
+						return err
+					}
+				}
+
+				activeOrders, err = database.GetReadyOrders(db, account.ID)
+				if err != nil {
+					return err
+				}
+
+				return nil
+			})
+			if checkJSONError(c, err) {
+				return
+			}
+			if len(validationErrors) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": validationErrors.Error(), "validationErrors": validationErrors})
+				return
+			}
+			runningSimulations.Changed(req.AccountID)
+			c.JSON(http.StatusOK, activeOrders)
+		})
+		r.POST("/accounts/:id/flatten", func(c *gin.Context) {
+			accountID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id parameter"})
+				return
+			}
+			// Without a replay running there's no next bar to fill at
+			immediate := c.Query("immediate") == "true"
+			authInfo := auth.GetAuthInfoFromContext(c)
+			ret, err := flattenAccount(db, authInfo.UserID, uint(accountID), immediate)
+			if errors.Is(err, auth.ErrNotAuthorized) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				return
+			}
+			if checkJSONError(c, err) {
+				return
+			}
+			runningSimulations.Changed(uint(accountID))
+			c.JSON(http.StatusOK, ret)
+		})
+		r.GET("/accounts/:id/ledger", func(c *gin.Context) {
+			accountID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id parameter"})
+				return
+			}
+			account, err := database.GetAccountByID(db, uint(accountID))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			if account.UserID != authInfo.UserID {
+				c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				return
+			}
+			events, err := database.GetLedgerForAccount(db, account.ID)
+			if checkJSONError(c, err) {
+				return
+			}
+			c.JSON(http.StatusOK, events)
+		})
+		r.POST("/accounts/:id/rebuild", func(c *gin.Context) {
+			accountID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id parameter"})
+				return
+			}
+			// Only reports discrepancies unless asked to fix them
+			apply := c.Query("apply") == "true"
+			authInfo := auth.GetAuthInfoFromContext(c)
+			discrepancies, err := rebuildAccount(db, authInfo.UserID, uint(accountID), apply)
+			if errors.Is(err, auth.ErrNotAuthorized) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				return
+			}
+			if checkJSONError(c, err) {
+				return
+			}
+			if apply {
+				runningSimulations.Changed(uint(accountID))
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"consistent":    len(discrepancies) == 0,
+				"applied":       apply && len(discrepancies) > 0,
+				"discrepancies": discrepancies,
+			})
+		})
+		r.POST("/accounts/:id/clone", func(c *gin.Context) {
+			accountID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id parameter"})
+				return
+			}
+			var req struct {
+				Name string `json:"name"`
+			}
+			// The name is optional, so an empty body is fine
+			if c.Request.ContentLength > 0 {
+				if err = c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+			}
+			account, err := database.GetAccountByID(db, uint(accountID))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			if account.UserID != authInfo.UserID {
+				c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				return
+			}
+			clone, err := database.CloneAccount(db, account.ID, req.Name)
+			if checkJSONError(c, err) {
+				return
+			}
+			c.JSON(http.StatusOK, clone)
+		})
+		r.POST("/accounts/:id/rewind", func(c *gin.Context) {
+			accountID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id parameter"})
+				return
+			}
+			var req struct {
+				Date time.Time `json:"date" binding:"required"`
+			}
+			if err = c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			account, positions, equity, err := simulate.RewindAccount(db, authInfo, barsData, uint(accountID), req.Date)
+			var validationErrors simulate.ValidationErrors
+			if errors.As(err, &validationErrors) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": validationErrors.Error(), "validationErrors": validationErrors})
+				return
+			}
+			if errors.Is(err, auth.ErrNotAuthorized) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				return
+			}
+			if checkJSONError(c, err) {
+				return
+			}
+			runningSimulations.CloseAccount(account.ID)
+			ret := replayData{Account: &account, Positions: positions, Equity: &equity}
+			ret.ActiveOrders, err = database.GetReadyOrders(db, account.ID)
+			if checkJSONError(c, err) {
+				return
+			}
+			ret.FulfilledOrders, err = database.GetFulfilledOrders(db, account.ID)
+			if checkJSONError(c, err) {
+				return
+			}
+			c.JSON(http.StatusOK, ret)
+		})
+		r.GET("/accounts/:id/rewinds", func(c *gin.Context) {
+			accountID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id parameter"})
+				return
+			}
+			account, err := database.GetAccountByID(db, uint(accountID))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			if account.UserID != authInfo.UserID {
+				c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				return
+			}
+			rewinds, err := database.GetRewindsForAccount(db, account.ID)
 			if checkJSONError(c, err) {
 				return
 			}
-			c.Data(http.StatusOK, "application/json", resultJSON)
+			c.JSON(http.StatusOK, rewinds)
 		})
-		r.POST("/inc-date", func(c *gin.Context) {
-			var req struct {
-				Inc       string `json:"inc"`
-				AccountID uint   `json:"accountID"`
-			}
-			err := c.ShouldBindJSON(&req)
-			if checkJSONError(c, err) {
+		r.POST("/accounts/:id/cancel-all", func(c *gin.Context) {
+			accountID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id parameter"})
 				return
 			}
 			authInfo := auth.GetAuthInfoFromContext(c)
-
-			account, activeOrders, fulfilledOrders, newPositions, err := simulate.IncDate(
-				db, authInfo, barsData, req.AccountID, req.Inc,
-			)
-
+			ret, err := cancelAllOrders(db, authInfo.UserID, uint(accountID))
+			if errors.Is(err, auth.ErrNotAuthorized) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				return
+			}
 			if checkJSONError(c, err) {
 				return
 			}
-
-			c.JSON(http.StatusOK, replayData{
-				Account:         &account,
-				ActiveOrders:    activeOrders,
-				FulfilledOrders: fulfilledOrders,
-				Positions:       newPositions,
-			})
+			runningSimulations.Changed(uint(accountID))
+			c.JSON(http.StatusOK, ret)
 		})
-		r.POST("/submit-order", func(c *gin.Context) {
+		r.POST("/cancel-order", func(c *gin.Context) {
 			var req struct {
-				AccountID  uint `json:"accountID"`
-				SymbolID   uint `json:"symbolID"`
-				EntryOrder struct {
-					OrderType string  `json:"orderType"`
-					Direction string  `json:"direction"`
-					Price     float64 `json:"price"`
-					Quantity  int     `json:"quantity"`
-				} `json:"entryOrder"`
-				LinkedOrders []struct {
-					OrderType      string  `json:"orderType"`
-					Direction      string  `json:"direction"`
-					Price          float64 `json:"price"`
-					Quantity       int     `json:"quantity"`
-					ActivateOnFill bool    `json:"activateOnFill"`
-				} `json:"linkedOrders"`
+				AccountID uint `json:"accountID"`
+				OrderID   uint `json:"orderID"`
 			}
 			err := c.ShouldBindJSON(&req)
 			if checkJSONError(c, err) {
 				return
 			}
-			if req.SymbolID < 1 || req.SymbolID > 3 {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid symbol id"})
-				return
-			}
-			if req.EntryOrder.Quantity == 0 {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "quantity cannot be 0"})
-				return
-			}
 			authInfo := auth.GetAuthInfoFromContext(c)
-			var activeOrders []database.Order
+			var orders []database.Order
 			err = database.Transaction(db, func(db *gorm.DB) error {
 
 				account, err := database.GetAccountByID(db, req.AccountID)
@@ -735,66 +2010,73 @@ func main() {
 					return auth.ErrNotAuthorized
 				}
 
-				entryOrder := database.Order{
-					AccountID:   req.AccountID,
-					SymbolID:    req.SymbolID,
-					OrderType:   req.EntryOrder.OrderType,
-					Direction:   req.EntryOrder.Direction,
-					Price:       req.EntryOrder.Price,
-					Quantity:    req.EntryOrder.Quantity,
-					CreatedAt:   &account.Date,
-					ActivatedAt: &account.Date,
-				}
-				err = entryOrder.Create(db)
+				order, err := database.GetOrderByID(db, req.OrderID)
 				if err != nil {
 					return err
 				}
-
-				for _, linkedOrder := range req.LinkedOrders {
-					newOrder := database.Order{
-						AccountID:    req.AccountID,
-						SymbolID:     req.SymbolID,
-						OrderType:    linkedOrder.OrderType,
-						Direction:    linkedOrder.Direction,
-						Price:        linkedOrder.Price,
-						Quantity:     linkedOrder.Quantity,
-						CreatedAt:    &account.Date,
-						EntryOrderID: &entryOrder.ID,
-					}
-					if linkedOrder.ActivateOnFill {
-						// Leave ActivatedAt as nil to indicate that this order is activated after the entry order is filled.
-						newOrder.ActivatedAt = nil
-					} else {
-						newOrder.ActivatedAt = &account.Date
-					}
-					if err = newOrder.Create(db); err != nil {
+				if order.AccountID != account.ID {
+					c.JSON(http.StatusBadRequest, "You can't cancel this order")
+					return err
+				}
+				order.CancelledAt = &account.Date
+				if err := order.Update(db); err != nil {
+					return err
+				}
+				event := database.NewOrderEvent("cancelled", order, account.Date)
+				if err := event.Create(db); err != nil {
+					return err
+				}
+				if err := database.RecordOrder(db, "order-cancelled", order, account.Date); err != nil {
+					return err
+				}
+				if order.EntryOrderID == nil {
+					linkedOrders, err := database.GetLinkedOrdersFromEntryOrder(db, order)
+					if err != nil {
 						return err
 					}
+					for _, linkedOrder := range linkedOrders {
+						if linkedOrder.ActivatedAt == nil {
+							linkedOrder.CancelledAt = &account.Date
+							if err := linkedOrder.Update(db); err != nil {
+								return err
+							}
+							event := database.NewOrderEvent("cancelled", linkedOrder, account.Date)
+							if err := event.Create(db); err != nil {
+								return err
+							}
+							if err := database.RecordOrder(db, "order-cancelled", linkedOrder, account.Date); err != nil {
+								return err
+							}
+						}
+					}
 				}
-
-				activeOrders, err = database.GetReadyOrders(db, account.ID)
+				orders, err = database.GetReadyOrders(db, account.ID)
 				if err != nil {
 					return err
 				}
-
 				return nil
 			})
-			if checkJSONError(c, err) {
+			if err != nil {
 				return
 			}
-			c.JSON(http.StatusOK, activeOrders)
+			runningSimulations.Changed(req.AccountID)
+			c.JSON(http.StatusOK, orders)
 		})
-		r.POST("/cancel-order", func(c *gin.Context) {
+		r.POST("/modify-order", func(c *gin.Context) {
 			var req struct {
 				AccountID uint `json:"accountID"`
 				OrderID   uint `json:"orderID"`
+				simulate.OrderModification
+				SnapToTick bool `json:"snapToTick"` // Round off-tick prices instead of rejecting them
 			}
 			err := c.ShouldBindJSON(&req)
-			if checkJSONError(c, err) {
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 			authInfo := auth.GetAuthInfoFromContext(c)
 			var orders []database.Order
+			var validationErrors simulate.ValidationErrors
 			err = database.Transaction(db, func(db *gorm.DB) error {
 
 				account, err := database.GetAccountByID(db, req.AccountID)
@@ -810,37 +2092,93 @@ func main() {
 					return err
 				}
 				if order.AccountID != account.ID {
-					c.JSON(http.StatusBadRequest, "You can't cancel this order")
+					return auth.ErrNotAuthorized
+				}
+				previous := order
+				validationErrors = simulate.ModifyOrder(&order, req.OrderModification, req.SnapToTick)
+				if len(validationErrors) > 0 {
+					return nil
+				}
+
+				positions, err := database.GetPositionsForAccount(db, account.ID)
+				if err != nil {
 					return err
 				}
-				order.CancelledAt = &account.Date
+				workingOrders, err := database.GetReadyOrders(db, account.ID)
+				if err != nil {
+					return err
+				}
+				positionSymbolIDs := make([]uint, 0, len(positions))
+				for _, position := range positions {
+					positionSymbolIDs = append(positionSymbolIDs, position.SymbolID)
+				}
+				lastPrices, err := simulate.LastPrices(barsData, account.Date, positionSymbolIDs)
+				if err != nil {
+					return err
+				}
+				validationErrors = simulate.CheckModifiedBuyingPower("order", account.RealizedPnL, positions, workingOrders, order, lastPrices)
+				if len(validationErrors) > 0 {
+					return nil
+				}
+
 				if err := order.Update(db); err != nil {
 					return err
 				}
-				if order.EntryOrderID == nil {
-					linkedOrders, err := database.GetLinkedOrdersFromEntryOrder(db, order)
-					if err != nil {
-						return err
-					}
-					for _, linkedOrder := range linkedOrders {
-						if linkedOrder.ActivatedAt == nil {
-							linkedOrder.CancelledAt = &account.Date
-							if err := linkedOrder.Update(db); err != nil {
-								return err
-							}
-						}
-					}
+				event := database.NewOrderEvent("modified", order, account.Date)
+				event.SetPrevious(previous)
+				if err := event.Create(db); err != nil {
+					return err
+				}
+				if err := database.RecordOrder(db, "order-modified", order, account.Date); err != nil {
+					return err
 				}
+
 				orders, err = database.GetReadyOrders(db, account.ID)
+				return err
+			})
+			if err != nil {
+				if errors.Is(err, auth.ErrNotAuthorized) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
+				return
+			}
+			if len(validationErrors) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": validationErrors.Error(), "validationErrors": validationErrors})
+				return
+			}
+			runningSimulations.Changed(req.AccountID)
+			c.JSON(http.StatusOK, orders)
+		})
+		r.GET("/order-events/:accountID", func(c *gin.Context) {
+			accountID, err := strconv.ParseUint(c.Param("accountID"), 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid accountID parameter"})
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			var events []database.OrderEvent
+			err = database.Transaction(db, func(db *gorm.DB) error {
+				account, err := database.GetAccountByID(db, uint(accountID))
 				if err != nil {
 					return err
 				}
-				return nil
+				if account.UserID != authInfo.UserID {
+					return auth.ErrNotAuthorized
+				}
+				events, err = database.GetOrderEventsForAccount(db, account.ID)
+				return err
 			})
 			if err != nil {
+				if errors.Is(err, auth.ErrNotAuthorized) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
 				return
 			}
-			c.JSON(http.StatusOK, orders)
+			c.JSON(http.StatusOK, events)
 		})
 		r.POST("/create-account", func(c *gin.Context) {
 			type CreateAccountRequest struct {
@@ -896,8 +2234,8 @@ func main() {
 
 			authInfo := auth.GetAuthInfoFromContext(c)
 			err = database.Transaction(db, func(db *gorm.DB) error {
-				var account database.Account
-				if err := db.First(&account, accountIDUint).Error; err != nil {
+				account, err := database.GetAccountByID(db, uint(accountIDUint))
+				if err != nil {
 					if errors.Is(err, gorm.ErrRecordNotFound) {
 						return nil // Return nil to not rollback the transaction when the account is not found
 					}
@@ -919,6 +2257,7 @@ func main() {
 				return
 			}
 
+			runningSimulations.CloseAccount(uint(accountIDUint))
 			c.Status(http.StatusOK)
 		})
 
@@ -933,8 +2272,8 @@ func main() {
 			}
 			authInfo := auth.GetAuthInfoFromContext(c)
 			err := database.Transaction(db, func(db *gorm.DB) error {
-				var account database.Account
-				if err := db.First(&account, req.AccountID).Error; err != nil {
+				account, err := database.GetAccountByID(db, req.AccountID)
+				if err != nil {
 					return err
 				}
 				if account.UserID != authInfo.UserID {
@@ -951,6 +2290,155 @@ func main() {
 				}
 				return
 			}
+			runningSimulations.Changed(req.AccountID)
+			c.Status(http.StatusOK)
+		})
+
+		r.POST("/update-simulation-settings", func(c *gin.Context) {
+			var req struct {
+				AccountID               uint    `json:"accountID"`
+				IntrabarPath            string  `json:"intrabarPath"`
+				IntrabarDrillDown       bool    `json:"intrabarDrillDown"`
+				LiquidityModel          string  `json:"liquidityModel"`
+				LiquidityVolumeFraction float64 `json:"liquidityVolumeFraction"`
+				LotMatching             string  `json:"lotMatching"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if _, ok := simulate.IntrabarPaths[req.IntrabarPath]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid intrabar path: " + req.IntrabarPath})
+				return
+			}
+			if _, ok := simulate.LiquidityModels[req.LiquidityModel]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid liquidity model: " + req.LiquidityModel})
+				return
+			}
+			if req.LiquidityModel == "volume" && (req.LiquidityVolumeFraction <= 0 || req.LiquidityVolumeFraction > 1) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "liquidityVolumeFraction must be greater than 0 and at most 1"})
+				return
+			}
+			if _, ok := simulate.LotMatchings[req.LotMatching]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid lot matching: " + req.LotMatching})
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			err := database.Transaction(db, func(db *gorm.DB) error {
+				account, err := database.GetAccountByID(db, req.AccountID)
+				if err != nil {
+					return err
+				}
+				if account.UserID != authInfo.UserID {
+					return auth.ErrNotAuthorized
+				}
+				account.IntrabarPath = req.IntrabarPath
+				account.IntrabarDrillDown = req.IntrabarDrillDown
+				account.LiquidityModel = req.LiquidityModel
+				account.LiquidityVolumeFraction = req.LiquidityVolumeFraction
+				account.LotMatching = req.LotMatching
+				return db.Save(&account).Error
+			})
+			if err != nil {
+				if errors.Is(err, auth.ErrNotAuthorized) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
+				return
+			}
+			runningSimulations.Changed(req.AccountID)
+			c.Status(http.StatusOK)
+		})
+
+		r.GET("/cost-settings/:accountID", func(c *gin.Context) {
+			accountID, err := strconv.ParseUint(c.Param("accountID"), 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid accountID parameter"})
+				return
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			var settings []database.CostSetting
+			err = database.Transaction(db, func(db *gorm.DB) error {
+				account, err := database.GetAccountByID(db, uint(accountID))
+				if err != nil {
+					return err
+				}
+				if account.UserID != authInfo.UserID {
+					return auth.ErrNotAuthorized
+				}
+				settings, err = database.GetCostSettingsForAccount(db, account.ID)
+				return err
+			})
+			if err != nil {
+				if errors.Is(err, auth.ErrNotAuthorized) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
+				return
+			}
+			c.JSON(http.StatusOK, settings)
+		})
+
+		r.POST("/update-cost-settings", func(c *gin.Context) {
+			var req struct {
+				AccountID uint `json:"accountID"`
+				Settings  []struct {
+					SymbolID               uint    `json:"symbolID"`
+					CommissionPerContract  float64 `json:"commissionPerContract"`
+					ExchangeFeePerContract float64 `json:"exchangeFeePerContract"`
+					SlippageModel          string  `json:"slippageModel"`
+					SlippageTicks          float64 `json:"slippageTicks"`
+					SlippageRangeFraction  float64 `json:"slippageRangeFraction"`
+				} `json:"settings"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			settings := make([]database.CostSetting, 0, len(req.Settings))
+			for _, setting := range req.Settings {
+				if _, ok := simulate.SlippageModels[setting.SlippageModel]; !ok {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid slippage model: " + setting.SlippageModel})
+					return
+				}
+				if setting.CommissionPerContract < 0 ||
+					setting.ExchangeFeePerContract < 0 ||
+					setting.SlippageTicks < 0 ||
+					setting.SlippageRangeFraction < 0 {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "costs cannot be negative"})
+					return
+				}
+				settings = append(settings, database.CostSetting{
+					SymbolID:               setting.SymbolID,
+					CommissionPerContract:  setting.CommissionPerContract,
+					ExchangeFeePerContract: setting.ExchangeFeePerContract,
+					SlippageModel:          setting.SlippageModel,
+					SlippageTicks:          setting.SlippageTicks,
+					SlippageRangeFraction:  setting.SlippageRangeFraction,
+				})
+			}
+			authInfo := auth.GetAuthInfoFromContext(c)
+			err := database.Transaction(db, func(db *gorm.DB) error {
+				account, err := database.GetAccountByID(db, req.AccountID)
+				if err != nil {
+					return err
+				}
+				if account.UserID != authInfo.UserID {
+					return auth.ErrNotAuthorized
+				}
+				return database.ReplaceCostSettingsForAccount(db, account.ID, settings)
+			})
+			if err != nil {
+				if errors.Is(err, auth.ErrNotAuthorized) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "you do not have permission"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
+				return
+			}
+			runningSimulations.Changed(req.AccountID)
 			c.Status(http.StatusOK)
 		})
 
@@ -973,7 +2461,7 @@ func main() {
 				return
 			}
 
-			trades, err := analytics.GetTrades(db, uint(accountID))
+			trades, err := analytics.GetTrades(db, account)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
@@ -6,12 +6,17 @@ import (
 
 // TradeMetrics holds calculated trade statistics.
 type TradeMetrics struct {
-	WinRate       float64
-	ProfitFactor  float64
-	LargestLoss   float64
-	LargestProfit float64
-	MedianLoss    float64
-	MedianProfit  float64
+	WinRate           float64
+	ProfitFactor      float64
+	LargestLoss       float64
+	LargestProfit     float64
+	MedianLoss        float64
+	MedianProfit      float64
+	GrossProfitOrLoss float64
+	TotalFees         float64
+	TotalSlippage     float64
+	NetProfitOrLoss   float64
+	Liquidations      int // Trades closed out by a margin call
 }
 
 // CalculateTradeMetrics calculates various metrics given an array of trades.
@@ -26,8 +31,16 @@ func CalculateTradeMetrics(trades []Trade) TradeMetrics {
 	totalLoss := 0.0
 	profits := []float64{}
 	losses := []float64{}
+	var metrics TradeMetrics
 
 	for _, trade := range trades {
+		metrics.GrossProfitOrLoss += trade.GrossProfitOrLoss
+		metrics.TotalFees += trade.Fees
+		metrics.TotalSlippage += trade.Slippage
+		metrics.NetProfitOrLoss += trade.ProfitOrLoss
+		if trade.Liquidation {
+			metrics.Liquidations++
+		}
 		if trade.ProfitOrLoss > 0 {
 			totalWins++
 			totalProfit += trade.ProfitOrLoss
@@ -61,14 +74,12 @@ func CalculateTradeMetrics(trades []Trade) TradeMetrics {
 		largestLoss = losses[0] // First element after sorting
 	}
 
-	metrics := TradeMetrics{
-		WinRate:       winRate,
-		ProfitFactor:  profitFactor,
-		LargestLoss:   largestLoss,
-		LargestProfit: largestProfit,
-		MedianLoss:    medianLoss,
-		MedianProfit:  medianProfit,
-	}
+	metrics.WinRate = winRate
+	metrics.ProfitFactor = profitFactor
+	metrics.LargestLoss = largestLoss
+	metrics.LargestProfit = largestProfit
+	metrics.MedianLoss = medianLoss
+	metrics.MedianProfit = medianProfit
 
 	return metrics
 }
@@ -22,7 +22,7 @@ func GenerateTradesExcel(trades []Trade) (*os.File, error) {
 	xlsx.DeleteSheet("Sheet1")
 
 	// Set titles for the columns
-	titles := []string{"Account ID", "Symbol ID", "Quantity", "Entry Price", "Exit Price", "Entered At", "Exited At", "Profit or Loss"}
+	titles := []string{"Account ID", "Symbol ID", "Quantity", "Entry Price", "Exit Price", "Entered At", "Exited At", "Gross Profit or Loss", "Commissions and Fees", "Slippage", "Net Profit or Loss", "Liquidation"}
 	for i, title := range titles {
 		cell, _ := excelize.CoordinatesToCellName(i+1, 1) // Columns start at 1, not 0
 		xlsx.SetCellValue(sheetName, cell, title)
@@ -38,7 +38,11 @@ func GenerateTradesExcel(trades []Trade) (*os.File, error) {
 		xlsx.SetCellValue(sheetName, fmt.Sprintf("E%d", row), trade.ExitPrice)
 		xlsx.SetCellValue(sheetName, fmt.Sprintf("F%d", row), trade.EnteredAt)
 		xlsx.SetCellValue(sheetName, fmt.Sprintf("G%d", row), trade.ExitedAt)
-		xlsx.SetCellValue(sheetName, fmt.Sprintf("H%d", row), trade.ProfitOrLoss)
+		xlsx.SetCellValue(sheetName, fmt.Sprintf("H%d", row), trade.GrossProfitOrLoss)
+		xlsx.SetCellValue(sheetName, fmt.Sprintf("I%d", row), trade.Fees)
+		xlsx.SetCellValue(sheetName, fmt.Sprintf("J%d", row), trade.Slippage)
+		xlsx.SetCellValue(sheetName, fmt.Sprintf("K%d", row), trade.ProfitOrLoss)
+		xlsx.SetCellValue(sheetName, fmt.Sprintf("L%d", row), trade.Liquidation)
 	}
 
 	// Create temporary file
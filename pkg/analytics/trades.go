@@ -5,6 +5,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
 	"github.com/tradingcage/tradingcage-go/pkg/database"
 	"github.com/tradingcage/tradingcage-go/pkg/simulate"
 	"gorm.io/gorm"
@@ -17,104 +18,164 @@ var (
 )
 
 type Trade struct {
-	AccountID    uint    `json:"accountID"`
-	SymbolID     uint    `json:"symbolID"`
-	Quantity     int     `json:"quantity"`
-	EntryPrice   float64 `json:"entryPrice"`
-	ExitPrice    float64 `json:"exitPrice"`
-	EnteredAt    string  `json:"enteredAt"`
-	ExitedAt     string  `json:"exitedAt"`
-	ProfitOrLoss float64 `json:"profitOrLoss"`
+	AccountID         uint    `json:"accountID"`
+	SymbolID          uint    `json:"symbolID"`
+	Quantity          int     `json:"quantity"`
+	EntryPrice        float64 `json:"entryPrice"`
+	ExitPrice         float64 `json:"exitPrice"`
+	EnteredAt         string  `json:"enteredAt"`
+	ExitedAt          string  `json:"exitedAt"`
+	GrossProfitOrLoss float64 `json:"grossProfitOrLoss"`
+	Fees              float64 `json:"fees"`     // Commission and exchange fees for both sides
+	Slippage          float64 `json:"slippage"` // Dollar cost of slippage, already included in the gross
+	ProfitOrLoss      float64 `json:"profitOrLoss"`
+	Liquidation       bool    `json:"liquidation"` // Closed out by a margin call
 }
 
-// GetTrades retrieves trades for a given account ID and converts matched
-// buy and sell orders into trades. It also accounts for symbol matching and short entries.
-func GetTrades(db *gorm.DB, accountID uint) ([]Trade, error) {
-	fulfilledOrders, err := database.GetAllFulfilledOrders(db, accountID)
+// GetTrades retrieves the fills for an account and converts them into
+// trades, matching closing fills against open lots with the method the
+// simulator used when they filled.
+func GetTrades(db *gorm.DB, account database.Account) ([]Trade, error) {
+	fills, err := GetFills(db, account)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get fulfilled orders: %w", err)
+		return nil, err
 	}
+	return matchTrades(account, fills), nil
+}
 
-	var trades []Trade
-	orderQueue := make(map[uint][]database.Order) // Keyed by SymbolID
-
-	// Sort fulfilled orders by their fulfilled timestamp
-	sort.Slice(fulfilledOrders, func(i, j int) bool {
-		return fulfilledOrders[i].FulfilledAt.Before(*fulfilledOrders[j].FulfilledAt)
-	})
-
-	// Group orders by SymbolID
-	for _, order := range fulfilledOrders {
-		orderQueue[order.SymbolID] = append(orderQueue[order.SymbolID], order)
+// GetRewoundTrades returns the trades of an attempt that was rewound: the
+// account's fills up to the date it went back to, then the ones the rewind
+// archived.
+func GetRewoundTrades(db *gorm.DB, account database.Account, rewind database.Rewind) ([]Trade, error) {
+	fills, err := GetFills(db, account)
+	if err != nil {
+		return nil, err
 	}
-
-	// Generate trades per symbol
-	for symbolID, orders := range orderQueue {
-		var buyQueue []database.Order
-		var sellQueue []database.Order
-
-		// Separate orders by buy and sell
-		for _, order := range orders {
-			switch order.Direction {
-			case "buy":
-				buyQueue = append(buyQueue, order)
-			case "sell":
-				sellQueue = append(sellQueue, order)
-			}
+	var attemptFills []database.Fill
+	for _, fill := range fills {
+		if !fill.FilledAt.After(rewind.ToDate) {
+			attemptFills = append(attemptFills, fill)
 		}
+	}
+	rewound, err := database.GetRewoundFills(db, rewind.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rewound fills: %w", err)
+	}
+	return matchTrades(account, append(attemptFills, rewound...)), nil
+}
 
-		for len(buyQueue) > 0 && len(sellQueue) > 0 {
-			buyOrder := &buyQueue[0]
-			sellOrder := &sellQueue[0]
-
-			// Determine trade quantity based on the smaller of the two order quantities
-			tradeQuantity := buyOrder.Quantity
-			if sellOrder.Quantity < buyOrder.Quantity {
-				tradeQuantity = sellOrder.Quantity
-			}
-
-			var trade Trade
-			var profitOrLoss float64
-
-			var entryOrder *database.Order
-			var exitOrder *database.Order
+// TradesSince returns the trades closed at or after the given time.
+func TradesSince(trades []Trade, t time.Time) []Trade {
+	var since []Trade
+	for _, trade := range trades {
+		exitedAt, err := time.ParseInLocation(timeFormat, trade.ExitedAt, locationChicago)
+		if err == nil && !exitedAt.Before(t) {
+			since = append(since, trade)
+		}
+	}
+	return since
+}
 
-			if buyOrder.FulfilledAt.Before(*sellOrder.FulfilledAt) {
-				entryOrder = buyOrder
-				exitOrder = sellOrder
-				profitOrLoss = float64(tradeQuantity) * (exitOrder.FulfilledPrice - entryOrder.FulfilledPrice) * simulate.TickerMultiplier[symbolID]
-			} else {
-				entryOrder = sellOrder
-				exitOrder = buyOrder
-				profitOrLoss = float64(tradeQuantity) * (entryOrder.FulfilledPrice - exitOrder.FulfilledPrice) * simulate.TickerMultiplier[symbolID]
+// Matches fills, in the order they happened, into trades.
+func matchTrades(account database.Account, fills []database.Fill) []Trade {
+	var trades []Trade
+	openLots := make(map[uint][]database.Lot) // Keyed by SymbolID
+	for i, fill := range fills {
+		// Fills synthesized for older orders have no ID of their own, so
+		// each lot is tied to its fill's position in the sorted list instead
+		var closed []database.Lot
+		openLots[fill.SymbolID], closed = simulate.MatchLots(simulate.FillLotMatching(fill, account.LotMatching), openLots[fill.SymbolID], database.Lot{
+			ID:        uint(i),
+			AccountID: fill.AccountID,
+			SymbolID:  fill.SymbolID,
+			Direction: fill.Direction,
+			Price:     fill.Price,
+			Quantity:  fill.Quantity,
+			OpenedAt:  fill.FilledAt,
+		})
+
+		for _, lot := range closed {
+			entryFill := fills[lot.ID]
+			pointValue := contracts.PointValue(fill.SymbolID)
+			profitOrLoss := float64(lot.Quantity) * (fill.Price - lot.Price) * pointValue
+			if lot.Direction == "sell" {
+				profitOrLoss = -profitOrLoss
 			}
+			fees := float64(lot.Quantity) * (feesPerContract(entryFill) + feesPerContract(fill))
+			slippage := float64(lot.Quantity) * (entryFill.Slippage + fill.Slippage) * pointValue
+
+			trades = append(trades, Trade{
+				AccountID:         account.ID,
+				SymbolID:          fill.SymbolID,
+				Quantity:          lot.Quantity,
+				EntryPrice:        lot.Price,
+				ExitPrice:         fill.Price,
+				EnteredAt:         lot.OpenedAt.In(locationChicago).Format(timeFormat),
+				ExitedAt:          fill.FilledAt.In(locationChicago).Format(timeFormat),
+				GrossProfitOrLoss: profitOrLoss,
+				Fees:              fees,
+				Slippage:          slippage,
+				ProfitOrLoss:      profitOrLoss - fees,
+				Liquidation:       fill.Liquidation,
+			})
+		}
+	}
 
-			trade = Trade{
-				AccountID:    accountID,
-				SymbolID:     symbolID,
-				Quantity:     tradeQuantity,
-				EntryPrice:   entryOrder.FulfilledPrice,
-				ExitPrice:    exitOrder.FulfilledPrice,
-				EnteredAt:    entryOrder.FulfilledAt.In(locationChicago).Format(timeFormat),
-				ExitedAt:     exitOrder.FulfilledAt.In(locationChicago).Format(timeFormat),
-				ProfitOrLoss: profitOrLoss,
-			}
+	return trades
+}
 
-			trades = append(trades, trade)
+// Returns the commission and exchange fees paid on each contract of a fill.
+func feesPerContract(fill database.Fill) float64 {
+	if fill.Quantity == 0 {
+		return 0
+	}
+	return (fill.Commission + fill.ExchangeFees) / float64(fill.Quantity)
+}
 
-			// Decrement order quantities by the trade quantity
-			buyOrder.Quantity -= tradeQuantity
-			sellOrder.Quantity -= tradeQuantity
+// GetFills returns every execution on an account in the order it happened.
+// Orders filled before fills were recorded are treated as a single fill of
+// their whole quantity, except those a branch copied from its parent, which
+// filled in the parent's history.
+func GetFills(db *gorm.DB, account database.Account) ([]database.Fill, error) {
+	accountID := account.ID
+	fills, err := database.GetFillsForAccount(db, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fills: %w", err)
+	}
+	fulfilledOrders, err := database.GetAllFulfilledOrders(db, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fulfilled orders: %w", err)
+	}
 
-			// Remove the order from the queue if its quantity is now zero
-			if buyOrder.Quantity == 0 {
-				buyQueue = buyQueue[1:]
-			}
-			if sellOrder.Quantity == 0 {
-				sellQueue = sellQueue[1:]
-			}
+	hasFills := make(map[uint]bool)
+	for _, fill := range fills {
+		hasFills[fill.OrderID] = true
+	}
+	for _, order := range fulfilledOrders {
+		if hasFills[order.ID] {
+			continue
 		}
+		if account.BranchedAt != nil && !order.FulfilledAt.After(*account.BranchedAt) {
+			continue
+		}
+		fills = append(fills, database.Fill{
+			OrderID:      order.ID,
+			AccountID:    order.AccountID,
+			SymbolID:     order.SymbolID,
+			Direction:    order.Direction,
+			Price:        order.FulfilledPrice,
+			Quantity:     order.Quantity,
+			Slippage:     order.Slippage,
+			Commission:   order.Commission,
+			ExchangeFees: order.ExchangeFees,
+			Liquidation:  order.Liquidation,
+			FilledAt:     *order.FulfilledAt,
+		})
 	}
 
-	return trades, nil
+	// Sort fills by the time they happened
+	sort.SliceStable(fills, func(i, j int) bool {
+		return fills[i].FilledAt.Before(fills[j].FilledAt)
+	})
+	return fills, nil
 }
@@ -115,6 +115,11 @@ func IsSameGroupOfHours(t1, t2 int64, groupSize int) bool {
 		t1Time.Hour()/groupSize == t2Time.Hour()/groupSize
 }
 
+func IsSameGroupOfSeconds(t1, t2 int64, groupSize int) bool {
+	size := int64(groupSize) * 1000
+	return (t1+size-1)/size == (t2+size-1)/size
+}
+
 func IsSameDay(t1, t2 int64) bool {
 	t1Time := time.UnixMilli(t1)
 	t2Time := time.UnixMilli(t2)
@@ -123,6 +128,41 @@ func IsSameDay(t1, t2 int64) bool {
 		t1Time.Day() == t2Time.Day()
 }
 
+// IsSameFrame reports whether bars at the two dates fall into the same bar of
+// the timeframe.
+func IsSameFrame(tf Timeframe, t1, t2 int64) bool {
+	switch tf.Unit {
+	case "s":
+		return IsSameGroupOfSeconds(t1, t2, tf.Value)
+	case "m":
+		return IsSameGroupOfMinutes(t1, t2, tf.Value)
+	case "h":
+		return IsSameGroupOfHours(t1, t2, tf.Value)
+	case "d":
+		return IsSameDay(t1, t2)
+	case "w":
+		return IsSameWeek(t1, t2)
+	case "mo":
+		return IsSameMonth(t1, t2)
+	default:
+		return false
+	}
+}
+
+// AppendBar adds a bar of a finer timeframe to bars of the given one,
+// combining it into the last bar if it falls into the same frame.
+func AppendBar(tf Timeframe, frameBars []Bar, bar Bar) []Bar {
+	if len(frameBars) > 0 && IsSameFrame(tf, frameBars[len(frameBars)-1].Date, bar.Date) {
+		frameBars[len(frameBars)-1] = combineBars(frameBars[len(frameBars)-1], bar)
+		return frameBars
+	}
+	switch tf.Unit {
+	case "s", "m", "h":
+		RoundUpBar(&bar, tf)
+	}
+	return append(frameBars, bar)
+}
+
 func DummyBar(date int64) Bar {
 	return Bar{
 		Date:   date,
@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
+
 	_ "github.com/jackc/pgx/v4/stdlib" // Import the PostgreSQL Driver used by TimescaleDB
 	"golang.org/x/sync/errgroup"
 )
@@ -23,56 +25,33 @@ var (
 	timeFormat = "2006-01-02 15:04:05"
 
 	locationChicago, _ = time.LoadLocation("America/Chicago")
+)
 
-	RTHTables = map[uint]string{
-		1:  "ohlcv_daily_rth",
-		2:  "ohlcv_daily_rth",
-		3:  "ohlcv_daily_rth",
-		14: "ohlcv_daily_rth_3",
-		15: "ohlcv_daily_rth_3",
-		16: "ohlcv_daily_rth_2",
-		17: "ohlcv_daily_rth",
-		18: "ohlcv_daily_rth_3",
-		19: "ohlcv_daily_rth",
-		20: "ohlcv_daily_rth_3",
-		21: "ohlcv_daily_rth_3",
-		22: "ohlcv_daily_rth",
-		23: "ohlcv_daily_rth_2",
-		24: "ohlcv_daily_rth",
-		25: "ohlcv_daily_rth_3",
-		26: "ohlcv_daily_rth_3",
+// The condition keeping a query to the symbol's regular session, on a time
+// column stamped with the end of each bar's period. Unknown symbols aren't
+// restricted.
+func rthClause(symbolID uint, timeCol string) string {
+	session, ok := contracts.GetSession(symbolID)
+	if !ok {
+		return ""
 	}
-
-	rthClauses = map[string]string{
-		"ohlcv_daily_rth": `
-      AND (
-          (EXTRACT(HOUR FROM %s) BETWEEN 9 AND 14) OR
-          (EXTRACT(MINUTE FROM %s) > 30 AND EXTRACT(HOUR FROM %s) = 8) OR
-          (EXTRACT(MINUTE FROM %s) <= 15 AND EXTRACT(HOUR FROM %s) = 15)
-      )
-    `,
-		"ohlcv_daily_rth_2": `
+	openHour, openMinute, closeHour, closeMinute := session.Clock()
+	return fmt.Sprintf(`
       AND (
-          (EXTRACT(HOUR FROM %s) BETWEEN 9 AND 12) OR
-          (EXTRACT(MINUTE FROM %s) > 0 AND EXTRACT(HOUR FROM %s) = 8) OR
-          (EXTRACT(MINUTE FROM %s) <= 30 AND EXTRACT(HOUR FROM %s) = 13)
+          (EXTRACT(HOUR FROM %[1]s) BETWEEN %[2]d AND %[3]d) OR
+          (EXTRACT(MINUTE FROM %[1]s) > %[4]d AND EXTRACT(HOUR FROM %[1]s) = %[5]d) OR
+          (EXTRACT(MINUTE FROM %[1]s) <= %[6]d AND EXTRACT(HOUR FROM %[1]s) = %[7]d)
       )
-    `,
-		"ohlcv_daily_rth_3": `
-      AND (
-          (EXTRACT(HOUR FROM %s) BETWEEN 8 AND 13) OR
-          (EXTRACT(MINUTE FROM %s) > 20 AND EXTRACT(HOUR FROM %s) = 7) OR
-          (EXTRACT(MINUTE FROM %s) = 0 AND EXTRACT(HOUR FROM %s) = 14)
-      )
-    `,
-	}
-)
+    `, timeCol, openHour+1, closeHour-1, openMinute, openHour, closeMinute, closeHour)
+}
 
 func InvertedRTHTables() map[string][]uint {
 	// Initialize the inverted map
 	invertedTables := make(map[string][]uint)
-	// Iterate through the original RTHTables map
-	for symbolID, tableName := range RTHTables {
+	// Iterate through every contract's session table
+	for _, contract := range contracts.All() {
+		symbolID := contract.ID
+		tableName := contracts.RTHTable(symbolID)
 		// Check if the table name already exists in the inverted map
 		if _, exists := invertedTables[tableName]; !exists {
 			// If it doesn't exist, initialize an empty slice for this key
@@ -164,7 +143,7 @@ func (td *timescaleData) GetBarsBetween(req GetBarsBetweenRequest) ([]Bar, error
 
 	var endDateQuery string
 	if timeframe.Unit == "d" || timeframe.Unit == "w" || timeframe.Unit == "mo" {
-		endDateQuery = getEndDateQuery(req.RTH)
+		endDateQuery = getEndDateQuery(req.SymbolID, req.RTH)
 	}
 
 	start := time.UnixMilli(req.StartDate).In(locationChicago).Format(timeFormat)
@@ -172,7 +151,7 @@ func (td *timescaleData) GetBarsBetween(req GetBarsBetweenRequest) ([]Bar, error
 
 	var endingSecondsQuery string
 	if req.EndDate%60000 != 0 && timeframe.Unit != "s" {
-		endingSecondsQuery = getEndingSecondsQuery(req.RTH)
+		endingSecondsQuery = getEndingSecondsQuery(req.SymbolID, req.RTH)
 	}
 
 	// Execute both queries
@@ -442,7 +421,7 @@ func getMainQuery(
 		intervalAdjustment = " - INTERVAL '1 minute'"
 	case "d", "w", "mo":
 		if rth {
-			tableName = RTHTables[symbolID]
+			tableName = contracts.RTHTable(symbolID)
 			bucketFormat = true
 		} else {
 			tableName = "ohlcv_daily"
@@ -494,7 +473,7 @@ func getMainQuery(
 		} else {
 			timeCol = "ts"
 		}
-		query += fmt.Sprintf(rthClauses[RTHTables[symbolID]], timeCol, timeCol, timeCol, timeCol, timeCol)
+		query += rthClause(symbolID, timeCol)
 	}
 
 	query += fmt.Sprintf(`
@@ -514,11 +493,13 @@ func getMainQuery(
 	return query, nil
 }
 
-func getEndDateQuery(rth bool) string {
+func getEndDateQuery(symbolID uint, rth bool) string {
 	// Assemble the last day out of 1 minute bars
 	var timeAdjustment string
 	if rth {
-		timeAdjustment = ` + INTERVAL '8 hours 30 minutes'`
+		session, _ := contracts.GetSession(symbolID)
+		openHour, openMinute, _, _ := session.Clock()
+		timeAdjustment = fmt.Sprintf(` + INTERVAL '%d hours %d minutes'`, openHour, openMinute)
 	} else {
 		timeAdjustment = ` - INTERVAL '7 hours'`
 	}
@@ -533,14 +514,10 @@ func getEndDateQuery(rth bool) string {
   FROM aggs`, timeAdjustment)
 }
 
-func getEndingSecondsQuery(rth bool) string {
-	var rthClause string
+func getEndingSecondsQuery(symbolID uint, rth bool) string {
+	var rthCondition string
 	if rth {
-		rthClause = `AND (
-      (EXTRACT(HOUR FROM ts) BETWEEN 9 AND 14) OR
-      (EXTRACT(MINUTE FROM ts) > 30 AND EXTRACT(HOUR FROM ts) = 8) OR
-      (EXTRACT(MINUTE FROM ts) <= 15 AND EXTRACT(HOUR FROM ts) = 15)
-    )`
+		rthCondition = rthClause(symbolID, "ts")
 	}
 	return fmt.Sprintf(`WITH aggs AS (
     SELECT TIME_BUCKET('1 minute'::interval, ts) + INTERVAL '1 minute' AS bucket, rollup(candlestick(ts, open, high, low, close, volume)) AS agg
@@ -549,5 +526,5 @@ func getEndingSecondsQuery(rth bool) string {
     GROUP BY bucket
   )
   SELECT bucket, open(agg) AS open, high(agg) AS high, low(agg) AS low, close(agg) AS close, volume(agg) AS volume
-  FROM aggs`, rthClause)
+  FROM aggs`, rthCondition)
 }
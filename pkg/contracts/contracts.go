@@ -0,0 +1,283 @@
+package contracts
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//go:embed contracts.json
+var defaultContracts []byte
+
+// Contract describes a tradeable (or chart-only) futures market.
+type Contract struct {
+	ID                uint    `json:"id"`
+	Root              string  `json:"root"`
+	Name              string  `json:"name"`
+	TickSize          float64 `json:"tickSize"`
+	PointValue        float64 `json:"pointValue"`
+	Currency          string  `json:"currency"`
+	Session           string  `json:"session"`
+	InitialMargin     float64 `json:"initialMargin"`
+	MaintenanceMargin float64 `json:"maintenanceMargin"`
+	Chartable         bool    `json:"chartable"` // Offered as a chart in the replay simulator
+	Tradeable         bool    `json:"tradeable"`
+}
+
+// SessionTemplate describes the regular trading hours shared by a group of
+// contracts. Open and Close are "HH:MM" in Chicago time.
+type SessionTemplate struct {
+	Name     string `json:"name"`
+	RTHTable string `json:"rthTable"`
+	Open     string `json:"open"`
+	Close    string `json:"close"`
+}
+
+// Clock returns the hour and minute of the session's open and close.
+func (s SessionTemplate) Clock() (openHour, openMinute, closeHour, closeMinute int) {
+	// Clocks are validated when the registry is loaded
+	openHour, openMinute, _ = parseClock(s.Open)
+	closeHour, closeMinute, _ = parseClock(s.Close)
+	return openHour, openMinute, closeHour, closeMinute
+}
+
+type registryFile struct {
+	Sessions  []SessionTemplate `json:"sessions"`
+	Contracts []Contract        `json:"contracts"`
+}
+
+type registry struct {
+	sync.RWMutex
+	contracts map[uint]Contract
+	sessions  map[string]SessionTemplate
+}
+
+var (
+	reg registry
+
+	locationChicago, _ = time.LoadLocation("America/Chicago")
+)
+
+func init() {
+	if err := Load(bytes.NewReader(defaultContracts)); err != nil {
+		panic(fmt.Sprintf("could not load default contracts: %s", err))
+	}
+}
+
+// Load replaces the registry with the contracts and sessions in the given JSON.
+func Load(r io.Reader) error {
+	var file registryFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return fmt.Errorf("could not decode contracts: %w", err)
+	}
+
+	sessions := make(map[string]SessionTemplate)
+	for _, session := range file.Sessions {
+		if _, _, err := parseClock(session.Open); err != nil {
+			return fmt.Errorf("session %s: %w", session.Name, err)
+		}
+		if _, _, err := parseClock(session.Close); err != nil {
+			return fmt.Errorf("session %s: %w", session.Name, err)
+		}
+		sessions[session.Name] = session
+	}
+
+	contracts := make(map[uint]Contract)
+	for _, contract := range file.Contracts {
+		if contract.TickSize <= 0 || contract.PointValue <= 0 {
+			return fmt.Errorf("contract %s must have a positive tick size and point value", contract.Root)
+		}
+		if _, ok := sessions[contract.Session]; !ok {
+			return fmt.Errorf("contract %s has unknown session %s", contract.Root, contract.Session)
+		}
+		if _, ok := contracts[contract.ID]; ok {
+			return fmt.Errorf("duplicate contract id %d", contract.ID)
+		}
+		contracts[contract.ID] = contract
+	}
+
+	reg.Lock()
+	defer reg.Unlock()
+	reg.contracts = contracts
+	reg.sessions = sessions
+	return nil
+}
+
+// LoadFile replaces the registry with the contents of a JSON file.
+func LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Get returns the contract for a symbol ID.
+func Get(symbolID uint) (Contract, bool) {
+	reg.RLock()
+	defer reg.RUnlock()
+	contract, ok := reg.contracts[symbolID]
+	return contract, ok
+}
+
+// All returns every contract ordered by symbol ID.
+func All() []Contract {
+	reg.RLock()
+	defer reg.RUnlock()
+	ret := make([]Contract, 0, len(reg.contracts))
+	for _, contract := range reg.contracts {
+		ret = append(ret, contract)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+	return ret
+}
+
+// Sessions returns every session template ordered by name.
+func Sessions() []SessionTemplate {
+	reg.RLock()
+	defer reg.RUnlock()
+	ret := make([]SessionTemplate, 0, len(reg.sessions))
+	for _, session := range reg.sessions {
+		ret = append(ret, session)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// GetSession returns the session template used by a symbol.
+func GetSession(symbolID uint) (SessionTemplate, bool) {
+	reg.RLock()
+	defer reg.RUnlock()
+	contract, ok := reg.contracts[symbolID]
+	if !ok {
+		return SessionTemplate{}, false
+	}
+	session, ok := reg.sessions[contract.Session]
+	return session, ok
+}
+
+// NextSessionOpen returns the first regular session open of the symbol at or
+// after t. Sessions run Monday to Friday; holidays aren't accounted for.
+func NextSessionOpen(symbolID uint, t time.Time) (time.Time, bool) {
+	session, ok := GetSession(symbolID)
+	if !ok {
+		return time.Time{}, false
+	}
+	return nextSessionTime(session.Open, t), true
+}
+
+// NextSessionClose returns the first regular session close of the symbol at
+// or after t. Sessions run Monday to Friday; holidays aren't accounted for.
+func NextSessionClose(symbolID uint, t time.Time) (time.Time, bool) {
+	session, ok := GetSession(symbolID)
+	if !ok {
+		return time.Time{}, false
+	}
+	return nextSessionTime(session.Close, t), true
+}
+
+// NextClockTime returns the first weekday at or after t when it's the given
+// "HH:MM" in Chicago time.
+func NextClockTime(clock string, t time.Time) (time.Time, error) {
+	if _, _, err := parseClock(clock); err != nil {
+		return time.Time{}, err
+	}
+	return nextSessionTime(clock, t), nil
+}
+
+// TradingDay returns the trading day t falls in, as midnight Chicago time.
+// A trading day starts at 17:00 Chicago time the evening before, and
+// weekends belong to the following Monday.
+func TradingDay(t time.Time) time.Time {
+	local := t.In(locationChicago)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, locationChicago)
+	if local.Hour() >= 17 {
+		day = day.AddDate(0, 0, 1)
+	}
+	switch day.Weekday() {
+	case time.Saturday:
+		day = day.AddDate(0, 0, 2)
+	case time.Sunday:
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}
+
+// Clocks are validated when the registry is loaded.
+func nextSessionTime(clock string, t time.Time) time.Time {
+	hour, minute, _ := parseClock(clock)
+	local := t.In(locationChicago)
+	next := time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, locationChicago)
+	for next.Before(t) || next.Weekday() == time.Saturday || next.Weekday() == time.Sunday {
+		next = time.Date(next.Year(), next.Month(), next.Day()+1, hour, minute, 0, 0, locationChicago)
+	}
+	return next
+}
+
+// PointValue returns the dollar value of a one point move, or 0 for unknown symbols.
+func PointValue(symbolID uint) float64 {
+	contract, _ := Get(symbolID)
+	return contract.PointValue
+}
+
+// TickSize returns the minimum price fluctuation, or 0 for unknown symbols.
+func TickSize(symbolID uint) float64 {
+	contract, _ := Get(symbolID)
+	return contract.TickSize
+}
+
+// IsTradeable reports whether orders can be placed on the symbol.
+func IsTradeable(symbolID uint) bool {
+	contract, ok := Get(symbolID)
+	return ok && contract.Tradeable
+}
+
+// RTHTable returns the continuous aggregate holding the symbol's regular
+// trading hours daily bars.
+func RTHTable(symbolID uint) string {
+	session, _ := GetSession(symbolID)
+	return session.RTHTable
+}
+
+func parseClock(s string) (int, int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil {
+		return 0, 0, fmt.Errorf("invalid time %q: %w", s, err)
+	}
+	if hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour, minute, nil
+}
+
+// RoundToTick snaps a price to the symbol's nearest valid tick. Prices for
+// unknown symbols are returned unchanged.
+func RoundToTick(symbolID uint, price float64) float64 {
+	tickSize := TickSize(symbolID)
+	if tickSize <= 0 {
+		return price
+	}
+	return math.Round(price/tickSize) * tickSize
+}
+
+// IsOnTick reports whether the price is a whole number of ticks.
+func IsOnTick(symbolID uint, price float64) bool {
+	tickSize := TickSize(symbolID)
+	if tickSize <= 0 {
+		return true
+	}
+	ticks := price / tickSize
+	return math.Abs(ticks-math.Round(ticks)) < 1e-6
+}
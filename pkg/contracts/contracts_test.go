@@ -0,0 +1,105 @@
+package contracts
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultContracts(t *testing.T) {
+	es, ok := Get(1)
+	if !ok {
+		t.Fatalf("Get(1) returned no contract")
+	}
+	if es.Root != "ES" || es.TickSize != 0.25 || es.PointValue != 50 || !es.Tradeable {
+		t.Errorf("Get(1) = %+v, want tradeable ES with 0.25 ticks worth $50 a point", es)
+	}
+	if table := RTHTable(16); table != "ohlcv_daily_rth_2" {
+		t.Errorf("RTHTable(16) = %s, want ohlcv_daily_rth_2", table)
+	}
+	session, _ := GetSession(16)
+	if openHour, openMinute, closeHour, closeMinute := session.Clock(); openHour != 8 || openMinute != 0 || closeHour != 13 || closeMinute != 30 {
+		t.Errorf("GetSession(16).Clock() = %d:%d to %d:%d, want 8:0 to 13:30", openHour, openMinute, closeHour, closeMinute)
+	}
+	if IsTradeable(24) {
+		t.Errorf("IsTradeable(24) = true, want false")
+	}
+	if cl, _ := Get(16); !cl.Chartable || cl.Tradeable {
+		t.Errorf("Get(16) = %+v, want chartable CL that isn't tradeable", cl)
+	}
+	if sp, _ := Get(24); sp.Chartable {
+		t.Errorf("Get(24) = %+v, want SP that isn't chartable", sp)
+	}
+	if PointValue(999) != 0 {
+		t.Errorf("PointValue(999) = %v, want 0", PointValue(999))
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown session": `{"sessions":[],"contracts":[{"id":1,"root":"ES","tickSize":0.25,"pointValue":50,"session":"equity"}]}`,
+		"zero tick size":  `{"sessions":[{"name":"equity","open":"08:30","close":"15:15"}],"contracts":[{"id":1,"root":"ES","pointValue":50,"session":"equity"}]}`,
+		"bad clock":       `{"sessions":[{"name":"equity","open":"8.30","close":"15:15"}],"contracts":[]}`,
+	}
+	for name, data := range tests {
+		if err := Load(strings.NewReader(data)); err == nil {
+			t.Errorf("%s: Load() error = nil, want error", name)
+		}
+	}
+	// A failed load must leave the registry untouched
+	if _, ok := Get(1); !ok {
+		t.Errorf("Get(1) returned no contract after failed loads")
+	}
+}
+
+func TestNextSessionClose(t *testing.T) {
+	tests := []struct {
+		name string
+		t    time.Time
+		want time.Time
+	}{
+		{"during the session", time.Date(2023, 11, 1, 10, 0, 0, 0, locationChicago), time.Date(2023, 11, 1, 15, 15, 0, 0, locationChicago)},
+		{"at the close", time.Date(2023, 11, 1, 15, 15, 0, 0, locationChicago), time.Date(2023, 11, 1, 15, 15, 0, 0, locationChicago)},
+		{"after the close", time.Date(2023, 11, 1, 16, 0, 0, 0, locationChicago), time.Date(2023, 11, 2, 15, 15, 0, 0, locationChicago)},
+		{"friday evening", time.Date(2023, 11, 3, 17, 0, 0, 0, locationChicago), time.Date(2023, 11, 6, 15, 15, 0, 0, locationChicago)},
+	}
+	for _, tt := range tests {
+		got, ok := NextSessionClose(1, tt.t.UTC())
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("%s: NextSessionClose() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, ok := NextSessionClose(999, time.Now()); ok {
+		t.Errorf("NextSessionClose(999) ok = true, want false")
+	}
+}
+
+func TestNextClockTime(t *testing.T) {
+	friday := time.Date(2023, 11, 3, 9, 0, 0, 0, locationChicago)
+	got, err := NextClockTime("08:30", friday)
+	if err != nil || !got.Equal(time.Date(2023, 11, 6, 8, 30, 0, 0, locationChicago)) {
+		t.Errorf("NextClockTime() = %v, %v, want Monday 08:30", got, err)
+	}
+	if _, err := NextClockTime("8.30", friday); err == nil {
+		t.Errorf("NextClockTime() error = nil, want error")
+	}
+}
+
+func TestTradingDay(t *testing.T) {
+	monday := time.Date(2023, 11, 6, 0, 0, 0, 0, locationChicago)
+	tests := []struct {
+		name string
+		t    time.Time
+		want time.Time
+	}{
+		{"monday morning", time.Date(2023, 11, 6, 9, 0, 0, 0, locationChicago), monday},
+		{"sunday evening", time.Date(2023, 11, 5, 17, 0, 0, 0, locationChicago), monday},
+		{"friday evening", time.Date(2023, 11, 3, 18, 0, 0, 0, locationChicago), monday},
+		{"monday evening", time.Date(2023, 11, 6, 17, 30, 0, 0, locationChicago), monday.AddDate(0, 0, 1)},
+	}
+	for _, tt := range tests {
+		if got := TradingDay(tt.t.UTC()); !got.Equal(tt.want) {
+			t.Errorf("%s: TradingDay() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -11,10 +11,20 @@ var loc, _ = time.LoadLocation("America/New_York")
 
 type Account struct {
 	gorm.Model
-	Name        string
-	UserID      uint
-	Date        time.Time
-	RealizedPnL float64
+	Name                    string
+	UserID                  uint
+	Date                    time.Time
+	RealizedPnL             float64
+	IntrabarPath            string     // How to resolve brackets that are hit on both sides within a bar
+	IntrabarDrillDown       bool       // Look at one second bars before falling back to IntrabarPath
+	LiquidityModel          string     // How limit orders fill: "touch", "through" or "volume"
+	LiquidityVolumeFraction float64    // Share of each bar's volume a limit order can take with the "volume" model
+	LotMatching             string     // How closing fills are matched against open lots: "fifo", "lifo" or "average"
+	NetLiquidationValue     float64    // Cash plus open positions at their last mark
+	TradingDay              time.Time  // Trading day of the last mark
+	DayStartValue           float64    // Net liquidation value at the first mark of the trading day
+	ParentAccountID         *uint      `gorm:"index"` // Account this one was branched off, if any
+	BranchedAt              *time.Time // Parent's simulated date when it was branched
 }
 
 func (a *Account) Create(db *gorm.DB) error {
@@ -29,6 +39,15 @@ func (a *Account) Update(db *gorm.DB) error {
 	return nil
 }
 
+// UpdateSimulated saves only the columns a running simulation changes: the
+// date, cash and marks. Anything else changed since the account was loaded,
+// like its name or settings, is left as it is in the database.
+func (a *Account) UpdateSimulated(db *gorm.DB) error {
+	return db.Model(a).
+		Select("Date", "RealizedPnL", "NetLiquidationValue", "TradingDay", "DayStartValue").
+		Updates(a).Error
+}
+
 func GetAccountByID(db *gorm.DB, accountID uint) (Account, error) {
 	var account Account
 	result := db.First(&account, accountID)
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"gorm.io/gorm"
+)
+
+// CloneAccount branches a new account off the given one at its current
+// simulated date. The new account starts with the same cash, settings,
+// commissions and slippage, working orders and positions. Its trade history stays with the parent, so
+// only the fills that opened its lots come along, for trades closing them
+// to match up against.
+func CloneAccount(db *gorm.DB, accountID uint, name string) (Account, error) {
+	var clone Account
+	err := Transaction(db, func(db *gorm.DB) error {
+		parent, err := GetAccountByID(db, accountID)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			name = parent.Name + " (branch)"
+		}
+		branchedAt := parent.Date
+		clone = parent
+		clone.Model = gorm.Model{}
+		clone.Name = name
+		clone.ParentAccountID = &parent.ID
+		clone.BranchedAt = &branchedAt
+		if err = clone.Create(db); err != nil {
+			return err
+		}
+		costSettings, err := GetCostSettingsForAccount(db, accountID)
+		if err != nil {
+			return err
+		}
+		if err = ReplaceCostSettingsForAccount(db, clone.ID, costSettings); err != nil {
+			return err
+		}
+
+		orders, err := GetReadyOrders(db, accountID)
+		if err != nil {
+			return err
+		}
+		// Linked orders whose entry has already filled still need it to
+		// group their bracket, so the entry comes along too
+		copied := make(map[uint]struct{})
+		for _, order := range orders {
+			copied[order.ID] = struct{}{}
+		}
+		for _, order := range orders {
+			if order.EntryOrderID == nil {
+				continue
+			}
+			if _, ok := copied[*order.EntryOrderID]; ok {
+				continue
+			}
+			var entry Order
+			if err = db.First(&entry, *order.EntryOrderID).Error; err != nil {
+				return err
+			}
+			copied[entry.ID] = struct{}{}
+			orders = append([]Order{entry}, orders...)
+		}
+
+		// Entries are created before the orders linked to them so their
+		// new IDs are known
+		newIDs := make(map[uint]uint)
+		for _, linked := range []bool{false, true} {
+			for _, order := range orders {
+				if (order.EntryOrderID != nil) != linked {
+					continue
+				}
+				oldID := order.ID
+				order.ID = 0
+				order.AccountID = clone.ID
+				if linked {
+					entryID := newIDs[*order.EntryOrderID]
+					order.EntryOrderID = &entryID
+				}
+				if err = order.Create(db); err != nil {
+					return err
+				}
+				newIDs[oldID] = order.ID
+				event := NewOrderEvent("created", order, clone.Date)
+				if err = event.Create(db); err != nil {
+					return err
+				}
+			}
+		}
+
+		positions, err := GetPositionsForAccount(db, accountID)
+		if err != nil {
+			return err
+		}
+		if err = ReplacePositionsForAccount(db, clone.ID, positions); err != nil {
+			return err
+		}
+		if err = cloneOpenFills(db, accountID, clone.ID, positions, newIDs); err != nil {
+			return err
+		}
+		return recordOpeningState(db, clone)
+	})
+	return clone, err
+}
+
+// Copies the fills behind the open lots of the positions onto the clone,
+// cut down to what's still open. Lots that can't be tied to a fill get one
+// made up from the lot.
+func cloneOpenFills(db *gorm.DB, accountID, cloneID uint, positions []Position, newIDs map[uint]uint) error {
+	fills, err := GetFillsForAccount(db, accountID)
+	if err != nil {
+		return err
+	}
+	used := make(map[uint]struct{})
+	for _, position := range positions {
+		for _, lot := range position.Lots {
+			fill := Fill{
+				SymbolID:  position.SymbolID,
+				Direction: lot.Direction,
+				Leg:       "open",
+				FilledAt:  lot.OpenedAt,
+			}
+			for _, parentFill := range fills {
+				if _, ok := used[parentFill.ID]; ok ||
+					parentFill.SymbolID != position.SymbolID ||
+					parentFill.Direction != lot.Direction ||
+					!parentFill.FilledAt.Equal(lot.OpenedAt) ||
+					parentFill.Quantity < lot.Quantity {
+					continue
+				}
+				used[parentFill.ID] = struct{}{}
+				share := float64(lot.Quantity) / float64(parentFill.Quantity)
+				fill = parentFill
+				fill.OrderID = newIDs[parentFill.OrderID] // Zero unless the order was copied too
+				fill.Commission *= share
+				fill.ExchangeFees *= share
+				fill.Cash = 0 // The clone's starting cash has it already
+				break
+			}
+			fill.ID = 0
+			fill.AccountID = cloneID
+			fill.Price = lot.Price
+			fill.Quantity = lot.Quantity
+			if err = db.Create(&fill).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetBranchesOfAccount returns the accounts branched off the given one,
+// oldest first.
+func GetBranchesOfAccount(db *gorm.DB, accountID uint) ([]Account, error) {
+	var accounts []Account
+	err := db.Where("parent_account_id = ?", accountID).Order("created_at asc").Find(&accounts).Error
+	return accounts, err
+}
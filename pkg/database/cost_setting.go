@@ -0,0 +1,41 @@
+package database
+
+import (
+	"gorm.io/gorm"
+)
+
+// CostSetting configures the commission, exchange fees and slippage charged
+// on fills for an account. A SymbolID of 0 is the account-wide default for
+// every symbol that doesn't have its own row.
+type CostSetting struct {
+	gorm.Model
+	AccountID              uint `gorm:"index;not null"`
+	SymbolID               uint
+	CommissionPerContract  float64
+	ExchangeFeePerContract float64
+	SlippageModel          string  // "none", "ticks" or "volatility"
+	SlippageTicks          float64 // Used by the "ticks" model
+	SlippageRangeFraction  float64 // Used by the "volatility" model, as a fraction of the bar's range
+}
+
+func GetCostSettingsForAccount(db *gorm.DB, accountID uint) ([]CostSetting, error) {
+	var settings []CostSetting
+	err := db.Where("account_id = ?", accountID).Order("symbol_id asc").Find(&settings).Error
+	return settings, err
+}
+
+func ReplaceCostSettingsForAccount(db *gorm.DB, accountID uint, settings []CostSetting) error {
+	return Transaction(db, func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("account_id = ?", accountID).Delete(&CostSetting{}).Error; err != nil {
+			return err
+		}
+		for _, setting := range settings {
+			setting.ID = 0
+			setting.AccountID = accountID
+			if err := tx.Create(&setting).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -33,7 +33,7 @@ func Init() *gorm.DB {
 	// Set the maximum amount of time a connection may be reused.
 	sqlDB.SetConnMaxLifetime(time.Hour)
 
-	err = db.AutoMigrate(&Account{}, &Order{}, &Position{}, &User{}, &ForgotPasswordEntry{})
+	err = db.AutoMigrate(&Account{}, &Order{}, &Position{}, &User{}, &ForgotPasswordEntry{}, &CostSetting{}, &Fill{}, &OrderEvent{}, &Lot{}, &LedgerEvent{}, &Rewind{})
 	if err != nil {
 		log.Fatal("failed to migrate database:", err)
 	}
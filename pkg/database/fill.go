@@ -0,0 +1,47 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Fill records one execution of an order. An order that fills in several
+// pieces has one Fill per piece.
+type Fill struct {
+	ID           uint `gorm:"primaryKey"`
+	OrderID      uint `gorm:"index"`
+	AccountID    uint `gorm:"index"`
+	SymbolID     uint
+	Direction    string
+	Leg          string // "open" if the fill added to the position, "close" if it reduced it
+	Price        float64
+	Quantity     int
+	Slippage     float64
+	Commission   float64
+	ExchangeFees float64
+	Cash         float64   // Realized P&L the fill made, net of its fees
+	Liquidation  bool      // Filled by a margin call
+	LotMatching  string    // How the fill was matched against open lots, so it's matched the same way later
+	RewindID     *uint     `gorm:"index"` // Rewind that archived the fill, or nil while it's part of the account
+	FilledAt     time.Time `gorm:"index"`
+}
+
+func GetFillsForAccount(db *gorm.DB, accountID uint) ([]Fill, error) {
+	var fills []Fill
+	err := db.Where("account_id = ? AND rewind_id IS NULL", accountID).Order("filled_at asc, id asc").Find(&fills).Error
+	return fills, err
+}
+
+func GetFillsForOrder(db *gorm.DB, orderID uint) ([]Fill, error) {
+	var fills []Fill
+	err := db.Where("order_id = ? AND rewind_id IS NULL", orderID).Order("filled_at asc, id asc").Find(&fills).Error
+	return fills, err
+}
+
+// GetRewoundFills returns the fills a rewind archived.
+func GetRewoundFills(db *gorm.DB, rewindID uint) ([]Fill, error) {
+	var fills []Fill
+	err := db.Where("rewind_id = ?", rewindID).Order("filled_at asc, id asc").Find(&fills).Error
+	return fills, err
+}
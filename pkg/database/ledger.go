@@ -0,0 +1,187 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LedgerEvent is an entry in an account's append-only ledger. Orders,
+// positions and cash are projections of the ledger, so every change to them
+// is recorded here in the same transaction. Events are never updated or
+// deleted, and replay in ID order.
+type LedgerEvent struct {
+	ID          uint   `gorm:"primaryKey"`
+	AccountID   uint   `gorm:"index"`
+	EventType   string // "order-placed", "order-activated", "order-modified", "order-updated", "order-filled", "order-cancelled", "cash-adjusted" or "account-rewound"
+	OrderID     uint   `gorm:"index"`
+	Amount      float64
+	Reason      string    // Why cash was adjusted
+	Payload     string    // LedgerPayload as JSON
+	SimulatedAt time.Time // The account's simulated date when it happened
+	RecordedAt  time.Time // Wall-clock time it was recorded
+}
+
+// LedgerPayload is what an order event knows about the order afterwards,
+// and for fills the fill itself.
+type LedgerPayload struct {
+	Order *Order `json:"order,omitempty"`
+	Fill  *Fill  `json:"fill,omitempty"`
+}
+
+func (event LedgerEvent) Decode() (LedgerPayload, error) {
+	var payload LedgerPayload
+	if event.Payload == "" {
+		return payload, nil
+	}
+	err := json.Unmarshal([]byte(event.Payload), &payload)
+	return payload, err
+}
+
+func appendLedgerEvent(db *gorm.DB, event LedgerEvent, payload LedgerPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	event.Payload = string(data)
+	event.RecordedAt = time.Now()
+	return db.Create(&event).Error
+}
+
+// RecordOrder appends an event with the order as it is after the change.
+func RecordOrder(db *gorm.DB, eventType string, order Order, simulatedAt time.Time) error {
+	return appendLedgerEvent(db, LedgerEvent{
+		AccountID:   order.AccountID,
+		EventType:   eventType,
+		OrderID:     order.ID,
+		SimulatedAt: simulatedAt,
+	}, LedgerPayload{Order: &order})
+}
+
+// RecordFill appends an "order-filled" event for one fill of the order.
+func RecordFill(db *gorm.DB, order Order, fill Fill) error {
+	return appendLedgerEvent(db, LedgerEvent{
+		AccountID:   fill.AccountID,
+		EventType:   "order-filled",
+		OrderID:     fill.OrderID,
+		SimulatedAt: fill.FilledAt,
+	}, LedgerPayload{Order: &order, Fill: &fill})
+}
+
+// AdjustCash changes the account's cash and records why. The account still
+// needs saving afterwards.
+func (a *Account) AdjustCash(db *gorm.DB, amount float64, reason string) error {
+	if amount == 0 {
+		return nil
+	}
+	a.RealizedPnL += amount
+	return appendLedgerEvent(db, LedgerEvent{
+		AccountID:   a.ID,
+		EventType:   "cash-adjusted",
+		Amount:      amount,
+		Reason:      reason,
+		SimulatedAt: a.Date,
+	}, LedgerPayload{})
+}
+
+// AddFillCash adds the cash made by fills to the account. Their
+// "order-filled" events record it, each at the time of its fill, so a
+// rewind between fills keeps exactly the cash of the fills it keeps. The
+// account still needs saving afterwards.
+func (a *Account) AddFillCash(amount float64) {
+	a.RealizedPnL += amount
+}
+
+// RecordRewind appends an "account-rewound" event, which undoes every
+// earlier event that happened after the date the account went back to.
+func RecordRewind(db *gorm.DB, rewind Rewind) error {
+	return appendLedgerEvent(db, LedgerEvent{
+		AccountID:   rewind.AccountID,
+		EventType:   "account-rewound",
+		SimulatedAt: rewind.ToDate,
+	}, LedgerPayload{})
+}
+
+// AfterCreate opens the ledger of a new account with its starting cash.
+func (a *Account) AfterCreate(db *gorm.DB) error {
+	return appendLedgerEvent(db, LedgerEvent{
+		AccountID:   a.ID,
+		EventType:   "cash-adjusted",
+		Amount:      a.RealizedPnL,
+		Reason:      "opening balance",
+		SimulatedAt: a.Date,
+	}, LedgerPayload{})
+}
+
+func GetLedgerForAccount(db *gorm.DB, accountID uint) ([]LedgerEvent, error) {
+	var events []LedgerEvent
+	err := db.Where("account_id = ?", accountID).Order("id asc").Find(&events).Error
+	return events, err
+}
+
+// EnsureLedger opens a ledger for an account created before there was one,
+// from its current cash, working orders and open lots.
+func EnsureLedger(db *gorm.DB, accountID uint) error {
+	var count int64
+	if err := db.Model(&LedgerEvent{}).Where("account_id = ?", accountID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	return Transaction(db, func(db *gorm.DB) error {
+		account, err := GetAccountByID(db, accountID)
+		if err != nil {
+			return err
+		}
+		if err = account.AfterCreate(db); err != nil {
+			return err
+		}
+		return recordOpeningState(db, account)
+	})
+}
+
+// Records the account's working orders and open lots as of its date, as if
+// they had been placed and filled then.
+func recordOpeningState(db *gorm.DB, account Account) error {
+	orders, err := GetReadyOrders(db, account.ID)
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		if err = RecordOrder(db, "order-placed", order, account.Date); err != nil {
+			return err
+		}
+	}
+	positions, err := GetPositionsForAccount(db, account.ID)
+	if err != nil {
+		return err
+	}
+	for _, position := range positions {
+		lots := position.Lots
+		if len(lots) == 0 {
+			lots = []Lot{{Direction: position.Direction, Price: position.Price, Quantity: position.Quantity, OpenedAt: account.Date}}
+		}
+		for _, lot := range lots {
+			err = appendLedgerEvent(db, LedgerEvent{
+				AccountID:   account.ID,
+				EventType:   "order-filled",
+				SimulatedAt: account.Date,
+			}, LedgerPayload{Fill: &Fill{
+				AccountID: account.ID,
+				SymbolID:  position.SymbolID,
+				Direction: lot.Direction,
+				Leg:       "open",
+				Price:     lot.Price,
+				Quantity:  lot.Quantity,
+				FilledAt:  lot.OpenedAt,
+			}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Lot is the open part of a fill that added to a position. A position is
+// made up of its symbol's lots, oldest first. Only open lots are stored; the
+// history of closed ones is in the fills, which keep the method they were
+// matched with.
+type Lot struct {
+	ID        uint `gorm:"primaryKey"`
+	AccountID uint `gorm:"index"`
+	SymbolID  uint
+	Direction string
+	Price     float64 // Cost basis, which average lot matching keeps at the position's average price
+	Quantity  int     // Contracts still open
+	OpenedAt  time.Time
+}
+
+func GetLotsForAccount(db *gorm.DB, accountID uint) ([]Lot, error) {
+	var lots []Lot
+	err := db.Where("account_id = ?", accountID).Order("opened_at asc, id asc").Find(&lots).Error
+	return lots, err
+}
@@ -11,15 +11,34 @@ type Order struct {
 	AccountID      uint `gorm:"index"`
 	SymbolID       uint `gorm:"index"`
 	Direction      string
-	Price          float64
-	FulfilledPrice float64
+	Price          float64 // Trigger price for stop, stop-limit and trailing stop orders
+	LimitPrice     float64 // Only used by stop-limit orders once they have triggered
+	TrailAmount    float64 // Distance a trailing stop follows price by, in TrailUnit
+	TrailUnit      string  // "points", "ticks" or "percent"
+	HighWaterMark  float64 // Best price seen since a trailing stop was activated
+	FulfilledPrice float64 // Includes any slippage
+	Slippage       float64 // Price points per contract that the fill was moved against the order
+	Commission     float64 // Total commission charged for the fill
+	ExchangeFees   float64 // Total exchange fees charged for the fill
 	Quantity       int
+	FilledQuantity int // Contracts filled so far, which may be less than Quantity for partial fills
 	OrderType      string
+	TimeInForce    string     // "day", "gtc" (the default), "gtd" or "ioc"
+	ExpiresAt      *time.Time // When DAY and GTD orders stop working
 	CreatedAt      *time.Time
 	ActivatedAt    *time.Time `gorm:"index:idx_order_active"`
 	CancelledAt    *time.Time `gorm:"index:idx_order_active"`
+	TriggeredAt    *time.Time // Set when a stop-limit order's stop price is hit
 	FulfilledAt    *time.Time `gorm:"index:idx_order_active,sort:desc;index:idx_order_fulfilled,sort:desc"`
 	EntryOrderID   *uint      // If EntryOrderID is non-null, this is a linked order in a OCO bracket
+	Liquidation    bool       // Placed by a margin call rather than the trader
+	RewindID       *uint      `gorm:"index"`      // Rewind that archived the order, or nil while it's part of the account
+	PendingFills   []Fill     `gorm:"-" json:"-"` // Fills from the simulation that UpdateMultipleOrders still has to save
+}
+
+// RemainingQuantity is the number of contracts still working.
+func (order *Order) RemainingQuantity() int {
+	return order.Quantity - order.FilledQuantity
 }
 
 func (order *Order) Create(db *gorm.DB) error {
@@ -43,8 +62,25 @@ func UpdateMultipleOrders(db *gorm.DB, orders []Order) error {
 	err := Transaction(db, func(tx *gorm.DB) error {
 		for _, order := range orders {
 			accountIDs[order.AccountID] = struct{}{}
-			if err := tx.Model(&Order{}).Where("id = ?", order.ID).Updates(order).Error; err != nil {
-				return err // rollback will be triggered
+			var prev Order
+			if order.ID == 0 {
+				// Orders the simulation placed itself, like liquidations
+				if err := tx.Create(&order).Error; err != nil {
+					return err
+				}
+				if err := RecordOrder(tx, "order-placed", order, *order.CreatedAt); err != nil {
+					return err
+				}
+			} else {
+				if err := tx.First(&prev, order.ID).Error; err != nil {
+					return err
+				}
+				if err := tx.Model(&Order{}).Where("id = ?", order.ID).Updates(order).Error; err != nil {
+					return err // rollback will be triggered
+				}
+			}
+			if err := recordOrderChanges(tx, prev, order); err != nil {
+				return err
 			}
 		}
 		return nil
@@ -57,19 +93,19 @@ func UpdateMultipleOrders(db *gorm.DB, orders []Order) error {
 
 func GetReadyOrders(db *gorm.DB, accountID uint) ([]Order, error) {
 	var orders []Order
-	result := db.Where("account_id = ? AND cancelled_at IS NULL AND fulfilled_at IS NULL", accountID).Order("fulfilled_at desc").Find(&orders)
+	result := db.Where("account_id = ? AND cancelled_at IS NULL AND fulfilled_at IS NULL AND rewind_id IS NULL", accountID).Order("fulfilled_at desc").Find(&orders)
 	return orders, result.Error
 }
 
 func GetFulfilledOrders(db *gorm.DB, accountID uint) ([]Order, error) {
 	var orders []Order
-	result := db.Where("account_id = ? AND fulfilled_at IS NOT NULL", accountID).Order("fulfilled_at desc").Limit(50).Find(&orders)
+	result := db.Where("account_id = ? AND fulfilled_at IS NOT NULL AND rewind_id IS NULL", accountID).Order("fulfilled_at desc").Limit(50).Find(&orders)
 	return orders, result.Error
 }
 
 func GetAllFulfilledOrders(db *gorm.DB, accountID uint) ([]Order, error) {
 	var orders []Order
-	result := db.Where("account_id = ? AND fulfilled_at IS NOT NULL", accountID).Order("fulfilled_at desc").Find(&orders)
+	result := db.Where("account_id = ? AND fulfilled_at IS NOT NULL AND rewind_id IS NULL", accountID).Order("fulfilled_at desc").Find(&orders)
 	return orders, result.Error
 }
 
@@ -84,3 +120,44 @@ func GetLinkedOrdersFromEntryOrder(db *gorm.DB, order Order) ([]Order, error) {
 	err := db.Where("entry_order_id = ?", order.ID).Find(&linkedOrders).Error
 	return linkedOrders, err
 }
+
+// Records what the simulation did to an order in the ledger, saving its
+// fills along the way.
+func recordOrderChanges(tx *gorm.DB, prev Order, order Order) error {
+	recorded := false
+	if prev.ActivatedAt == nil && order.ActivatedAt != nil && order.ID == prev.ID {
+		if err := RecordOrder(tx, "order-activated", order, *order.ActivatedAt); err != nil {
+			return err
+		}
+		recorded = true
+	}
+	for _, fill := range order.PendingFills {
+		fill.OrderID = order.ID
+		if err := tx.Create(&fill).Error; err != nil {
+			return err
+		}
+		if err := RecordFill(tx, order, fill); err != nil {
+			return err
+		}
+		recorded = true
+	}
+	if prev.CancelledAt == nil && order.CancelledAt != nil {
+		return RecordOrder(tx, "order-cancelled", order, *order.CancelledAt)
+	}
+	if !recorded && order.ID == prev.ID {
+		// Triggers, trailing stops moving and the like
+		return RecordOrder(tx, "order-updated", order, latestOrderTime(order))
+	}
+	return nil
+}
+
+// Returns the most recent time anything happened to the order.
+func latestOrderTime(order Order) time.Time {
+	var latest time.Time
+	for _, t := range []*time.Time{order.CreatedAt, order.ActivatedAt, order.TriggeredAt, order.FulfilledAt, order.CancelledAt} {
+		if t != nil && t.After(latest) {
+			latest = *t
+		}
+	}
+	return latest
+}
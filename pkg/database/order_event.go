@@ -0,0 +1,64 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OrderEvent records a change a trader made to an order, stamped with the
+// account's simulated date rather than the wall clock. Modifications keep
+// both the old and the new values.
+type OrderEvent struct {
+	ID             uint      `gorm:"primaryKey"`
+	OrderID        uint      `gorm:"index"`
+	AccountID      uint      `gorm:"index"`
+	EventType      string    // "created", "modified" or "cancelled"
+	OccurredAt     time.Time `gorm:"index"`
+	PrevOrderType  string
+	OrderType      string
+	PrevPrice      float64
+	Price          float64
+	PrevLimitPrice float64
+	LimitPrice     float64
+	PrevQuantity   int
+	Quantity       int
+}
+
+// NewOrderEvent describes an order as it is now. For modifications, call
+// SetPrevious with the order as it was before.
+func NewOrderEvent(eventType string, order Order, occurredAt time.Time) OrderEvent {
+	return OrderEvent{
+		OrderID:    order.ID,
+		AccountID:  order.AccountID,
+		EventType:  eventType,
+		OccurredAt: occurredAt,
+		OrderType:  order.OrderType,
+		Price:      order.Price,
+		LimitPrice: order.LimitPrice,
+		Quantity:   order.Quantity,
+	}
+}
+
+func (event *OrderEvent) SetPrevious(order Order) {
+	event.PrevOrderType = order.OrderType
+	event.PrevPrice = order.Price
+	event.PrevLimitPrice = order.LimitPrice
+	event.PrevQuantity = order.Quantity
+}
+
+func (event *OrderEvent) Create(db *gorm.DB) error {
+	return db.Create(event).Error
+}
+
+func GetOrderEventsForAccount(db *gorm.DB, accountID uint) ([]OrderEvent, error) {
+	var events []OrderEvent
+	err := db.Where("account_id = ?", accountID).Order("occurred_at asc, id asc").Find(&events).Error
+	return events, err
+}
+
+func GetOrderEventsForOrder(db *gorm.DB, orderID uint) ([]OrderEvent, error) {
+	var events []OrderEvent
+	err := db.Where("order_id = ?", orderID).Order("occurred_at asc, id asc").Find(&events).Error
+	return events, err
+}
@@ -10,6 +10,8 @@ type Position struct {
 	Direction string `gorm:"type:text;not null"`
 	Price     float64
 	Quantity  int
+	DayPrice  float64 // Mark the position started the trading day at, or 0 if it was opened during the day
+	Lots      []Lot   `gorm:"-"` // Open lots making up the position, oldest first
 }
 
 // Upsert function is no longer required because GORM handles this natively.
@@ -33,7 +35,22 @@ func (position *Position) Update(db *gorm.DB) error {
 func GetPositionsForAccount(db *gorm.DB, accountID uint) ([]Position, error) {
 	var positions []Position
 	err := db.Where("account_id = ?", accountID).Find(&positions).Error
-	return positions, err
+	if err != nil {
+		return nil, err
+	}
+	lots, err := GetLotsForAccount(db, accountID)
+	if err != nil {
+		return nil, err
+	}
+	for _, lot := range lots {
+		for i := range positions {
+			if positions[i].SymbolID == lot.SymbolID {
+				positions[i].Lots = append(positions[i].Lots, lot)
+				break
+			}
+		}
+	}
+	return positions, nil
 }
 
 func ReplacePositionsForAccount(db *gorm.DB, accountID uint, positions []Position) error {
@@ -43,6 +60,9 @@ func ReplacePositionsForAccount(db *gorm.DB, accountID uint, positions []Positio
 		if err := tx.Where("account_id = ?", accountID).Delete(&Position{}).Error; err != nil {
 			return err // return will roll back the transaction
 		}
+		if err := tx.Where("account_id = ?", accountID).Delete(&Lot{}).Error; err != nil {
+			return err
+		}
 
 		// Insert new positions
 		for _, position := range positions {
@@ -50,6 +70,14 @@ func ReplacePositionsForAccount(db *gorm.DB, accountID uint, positions []Positio
 			if err := tx.Create(&position).Error; err != nil {
 				return err // return will roll back the transaction
 			}
+			for _, lot := range position.Lots {
+				lot.ID = 0
+				lot.AccountID = accountID
+				lot.SymbolID = position.SymbolID
+				if err := tx.Create(&lot).Error; err != nil {
+					return err
+				}
+			}
 		}
 		// If no errors are returned, the transaction is committed
 		return nil
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Rewind records an account being rolled back to an earlier simulated date.
+// The orders and fills after that date are archived under the rewind
+// rather than deleted, so each attempt can still be looked at.
+type Rewind struct {
+	ID                  uint      `gorm:"primaryKey"`
+	AccountID           uint      `gorm:"index"`
+	FromDate            time.Time // Simulated date the account had reached
+	ToDate              time.Time // Simulated date it went back to
+	RealizedPnL         float64   // Cash the rewound attempt ended with
+	NetLiquidationValue float64   // And its value with open positions at their last mark
+	CreatedAt           time.Time
+}
+
+func (rewind *Rewind) Create(db *gorm.DB) error {
+	return db.Create(rewind).Error
+}
+
+// Archive moves the account's orders placed, and fills made, after the
+// rewind's date into the rewind.
+func (rewind *Rewind) Archive(db *gorm.DB) error {
+	err := db.Model(&Order{}).
+		Where("account_id = ? AND rewind_id IS NULL AND created_at > ?", rewind.AccountID, rewind.ToDate).
+		Update("rewind_id", rewind.ID).Error
+	if err != nil {
+		return err
+	}
+	return db.Model(&Fill{}).
+		Where("account_id = ? AND rewind_id IS NULL AND filled_at > ?", rewind.AccountID, rewind.ToDate).
+		Update("rewind_id", rewind.ID).Error
+}
+
+func GetRewindsForAccount(db *gorm.DB, accountID uint) ([]Rewind, error) {
+	var rewinds []Rewind
+	err := db.Where("account_id = ?", accountID).Order("id asc").Find(&rewinds).Error
+	return rewinds, err
+}
+
+func GetRewindByID(db *gorm.DB, rewindID uint) (Rewind, error) {
+	var rewind Rewind
+	err := db.First(&rewind, rewindID).Error
+	return rewind, err
+}
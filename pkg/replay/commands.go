@@ -3,8 +3,10 @@ package replay
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
 )
 
 type Command struct {
@@ -31,10 +33,51 @@ func ParseCommand(data []byte) (Command, error) {
 		if err := json.Unmarshal(data, &cmd); err != nil {
 			return Command{}, err
 		}
-		return NewCommand(rawCmd.Cmd, cmd), nil
+		return NewCommand(rawCmd.Cmd, &cmd), nil
 	case "pause":
-		var cmd PauseCommand
-		return NewCommand(rawCmd.Cmd, cmd), nil
+		return NewCommand(rawCmd.Cmd, &PauseCommand{}), nil
+	case "step":
+		cmd := StepCommand{Bars: 1}
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return Command{}, err
+		}
+		return NewCommand(rawCmd.Cmd, &cmd), nil
+	case "speed":
+		var cmd SpeedCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return Command{}, err
+		}
+		return NewCommand(rawCmd.Cmd, &cmd), nil
+	case "seek":
+		var cmd SeekCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return Command{}, err
+		}
+		return NewCommand(rawCmd.Cmd, &cmd), nil
+	case "subscribe":
+		var cmd SubscribeCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return Command{}, err
+		}
+		return NewCommand(rawCmd.Cmd, &cmd), nil
+	case "unsubscribe":
+		var cmd UnsubscribeCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return Command{}, err
+		}
+		return NewCommand(rawCmd.Cmd, &cmd), nil
+	case "ack":
+		var cmd AckCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			return Command{}, err
+		}
+		return NewCommand(rawCmd.Cmd, &cmd), nil
+	case "ping":
+		return NewCommand(rawCmd.Cmd, &PingCommand{}), nil
+	case "flatten":
+		return NewCommand(rawCmd.Cmd, &FlattenCommand{}), nil
+	case "cancel-all":
+		return NewCommand(rawCmd.Cmd, &CancelAllCommand{}), nil
 	default:
 		return Command{}, fmt.Errorf("unknown command: %s", rawCmd.Cmd)
 	}
@@ -44,11 +87,16 @@ func (c *Command) GetPayload() interface{} {
 	return c.payload
 }
 
+// MinInterval is the shortest time allowed between frames of bars.
+const MinInterval = 50 * time.Millisecond
+
 type PlayCommand struct {
-	Frame      bars.Timeframe `json:"frame"`
-	ChartFrame bars.Timeframe `json:"chartFrame"`
-	Seconds    int            `json:"seconds"`
-	RTH        bool           `json:"rth"`
+	Frame       bars.Timeframe   `json:"frame"`
+	ChartFrame  bars.Timeframe   `json:"chartFrame"`
+	ChartFrames []bars.Timeframe `json:"chartFrames"` // More charts, such as a higher timeframe for context, to build from the same bars
+	Seconds     int              `json:"seconds"`
+	Millis      int              `json:"millis"` // Takes the place of Seconds for sub-second intervals
+	RTH         bool             `json:"rth"`
 }
 
 func (c *PlayCommand) Valid() error {
@@ -58,10 +106,210 @@ func (c *PlayCommand) Valid() error {
 	if c.ChartFrame.Empty() {
 		return fmt.Errorf("chartFrame is empty")
 	}
-	if c.Seconds <= 0 {
+	if err := validChartFrames(c.ChartFrames); err != nil {
+		return err
+	}
+	return validInterval(c.Seconds, c.Millis)
+}
+
+// Charts returns every chart frame to replay, ChartFrame first.
+func (c *PlayCommand) Charts() []bars.Timeframe {
+	return chartFrames(c.ChartFrame, c.ChartFrames)
+}
+
+// Interval is how long to wait between frames of bars.
+func (c *PlayCommand) Interval() time.Duration {
+	return interval(c.Seconds, c.Millis)
+}
+
+type PauseCommand struct{}
+
+// StepCommand sends the next Bars frames of bars straight away and leaves
+// the replay paused. Frame and the chart frames default to those of the last
+// play.
+type StepCommand struct {
+	Frame       bars.Timeframe   `json:"frame"`
+	ChartFrame  bars.Timeframe   `json:"chartFrame"`
+	ChartFrames []bars.Timeframe `json:"chartFrames"`
+	Bars        int              `json:"bars"`
+	RTH         bool             `json:"rth"`
+}
+
+func (c *StepCommand) Valid() error {
+	if c.Frame.Empty() != c.ChartFrame.Empty() {
+		return fmt.Errorf("frame and chartFrame must be given together")
+	}
+	if c.Frame.Empty() && len(c.ChartFrames) > 0 {
+		return fmt.Errorf("chartFrames need frame and chartFrame")
+	}
+	if err := validChartFrames(c.ChartFrames); err != nil {
+		return err
+	}
+	if c.Bars <= 0 {
+		return fmt.Errorf("bars must be greater than 0")
+	}
+	return nil
+}
+
+func (c *StepCommand) Charts() []bars.Timeframe {
+	return chartFrames(c.ChartFrame, c.ChartFrames)
+}
+
+// Lists the chart frames once each, in the order given.
+func chartFrames(chartFrame bars.Timeframe, more []bars.Timeframe) []bars.Timeframe {
+	frames := []bars.Timeframe{chartFrame}
+	for _, frame := range more {
+		if !containsTimeframe(frames, frame) {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+func containsTimeframe(frames []bars.Timeframe, frame bars.Timeframe) bool {
+	for _, f := range frames {
+		if f == frame {
+			return true
+		}
+	}
+	return false
+}
+
+func validChartFrames(frames []bars.Timeframe) error {
+	for _, frame := range frames {
+		if frame.Empty() {
+			return fmt.Errorf("chartFrames has an empty frame")
+		}
+		if frame.Millis() <= 0 {
+			return fmt.Errorf("chartFrames has an unknown frame %s", frame)
+		}
+	}
+	return nil
+}
+
+// SpeedCommand changes how often frames of bars are sent, keeping the
+// bars that are already buffered.
+type SpeedCommand struct {
+	Seconds int `json:"seconds"`
+	Millis  int `json:"millis"`
+}
+
+func (c *SpeedCommand) Valid() error {
+	return validInterval(c.Seconds, c.Millis)
+}
+
+func (c *SpeedCommand) Interval() time.Duration {
+	return interval(c.Seconds, c.Millis)
+}
+
+func interval(seconds, millis int) time.Duration {
+	if millis > 0 {
+		return time.Duration(millis) * time.Millisecond
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func validInterval(seconds, millis int) error {
+	if seconds <= 0 && millis <= 0 {
 		return fmt.Errorf("seconds is empty")
 	}
+	if interval(seconds, millis) < MinInterval {
+		return fmt.Errorf("interval must be at least %s", MinInterval)
+	}
 	return nil
 }
 
-type PauseCommand struct{}
+// FlattenCommand closes every position on the account being simulated. It
+// acts on the account rather than the replay.
+type FlattenCommand struct{}
+
+// CancelAllCommand cancels every working order on the account being
+// simulated. It acts on the account rather than the replay.
+type CancelAllCommand struct{}
+
+var (
+	SeekTargets = map[string]struct{}{
+		"time":          {},
+		"session-open":  {},
+		"session-close": {},
+		"clock":         {},
+	}
+)
+
+// SeekCommand jumps the replay forward and leaves it paused. The target is
+// a timestamp, the next regular session open or close of a symbol, or the
+// next time it's a given time of day.
+type SeekCommand struct {
+	Target   string `json:"target"`   // "time", "session-open", "session-close" or "clock"
+	Date     int64  `json:"date"`     // Milliseconds since the epoch for "time", and where the seek ends up once resolved
+	Clock    string `json:"clock"`    // "HH:MM" Chicago time for "clock"
+	SymbolID uint   `json:"symbolID"` // Symbol whose sessions to use, if not the chart's
+}
+
+func (c *SeekCommand) Valid() error {
+	if _, ok := SeekTargets[c.Target]; !ok {
+		return fmt.Errorf("unknown seek target %q", c.Target)
+	}
+	if c.Target == "time" && c.Date <= 0 {
+		return fmt.Errorf("date is empty")
+	}
+	return nil
+}
+
+// Resolve works out the date to seek to from the given one, which it has to
+// be after, and sets Date to it. Session targets use the command's symbol,
+// or the given one if it has none.
+func (c *SeekCommand) Resolve(from time.Time, symbolID uint) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	if c.SymbolID != 0 {
+		symbolID = c.SymbolID
+	}
+	// Anything at or before the current date has already been replayed
+	after := from.Add(time.Millisecond)
+	var to time.Time
+	var ok bool
+	switch c.Target {
+	case "time":
+		to = time.UnixMilli(c.Date)
+	case "session-open":
+		if to, ok = contracts.NextSessionOpen(symbolID, after); !ok {
+			return fmt.Errorf("symbol %d has no trading sessions", symbolID)
+		}
+	case "session-close":
+		if to, ok = contracts.NextSessionClose(symbolID, after); !ok {
+			return fmt.Errorf("symbol %d has no trading sessions", symbolID)
+		}
+	case "clock":
+		var err error
+		if to, err = contracts.NextClockTime(c.Clock, after); err != nil {
+			return err
+		}
+	}
+	if !to.After(from) {
+		return fmt.Errorf("can only seek forward from %s", from.Format(time.RFC3339))
+	}
+	c.Date = to.UnixMilli()
+	return nil
+}
+
+// SubscribeCommand adds symbols to the replay. Their bars are sent from the
+// replay's current date onwards.
+type SubscribeCommand struct {
+	SymbolIDs []uint `json:"symbolIDs"`
+}
+
+// UnsubscribeCommand stops sending bars for symbols.
+type UnsubscribeCommand struct {
+	SymbolIDs []uint `json:"symbolIDs"`
+}
+
+// PingCommand asks for a pong, for clients that can't see websocket pings.
+type PingCommand struct{}
+
+// AckCommand tells the session the client has seen the messages up to and
+// including Seq, so they needn't be kept for resuming.
+type AckCommand struct {
+	Seq uint64 `json:"seq"`
+}
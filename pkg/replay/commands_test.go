@@ -3,6 +3,7 @@ package replay
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/tradingcage/tradingcage-go/pkg/bars"
 )
@@ -63,3 +64,139 @@ func TestParseCommand_Invalid(t *testing.T) {
 		t.Fatalf("ParseCommand() error = %v, wantErr %v", err, true)
 	}
 }
+
+func TestParseCommand_Subscribe(t *testing.T) {
+	cmd, err := ParseCommand([]byte(`{"cmd":"subscribe","symbolIDs":[2,5]}`))
+	if err != nil {
+		t.Fatalf("ParseCommand() error = %v, wantErr %v", err, false)
+	}
+
+	payload, ok := cmd.GetPayload().(*SubscribeCommand)
+	if !ok || !reflect.DeepEqual(payload.SymbolIDs, []uint{2, 5}) {
+		t.Errorf("ParseCommand() payload = %v, want symbols [2 5]", cmd.GetPayload())
+	}
+}
+
+func TestParseCommand_Step(t *testing.T) {
+	cmd, err := ParseCommand([]byte(`{"cmd":"step"}`))
+	if err != nil {
+		t.Fatalf("ParseCommand() error = %v, wantErr %v", err, false)
+	}
+	step, ok := cmd.GetPayload().(*StepCommand)
+	if !ok || step.Bars != 1 || !step.Frame.Empty() {
+		t.Fatalf("ParseCommand() payload = %v, want a step of 1 bar", cmd.GetPayload())
+	}
+	if err := step.Valid(); err != nil {
+		t.Errorf("Valid() error = %v, wantErr %v", err, false)
+	}
+
+	cmd, err = ParseCommand([]byte(`{"cmd":"step","frame":{"value":5,"unit":"m"},"chartFrame":{"value":5,"unit":"m"},"bars":3}`))
+	if err != nil {
+		t.Fatalf("ParseCommand() error = %v, wantErr %v", err, false)
+	}
+	expected := &StepCommand{
+		Frame:      bars.Timeframe{Value: 5, Unit: "m"},
+		ChartFrame: bars.Timeframe{Value: 5, Unit: "m"},
+		Bars:       3,
+	}
+	if !reflect.DeepEqual(cmd.GetPayload(), expected) {
+		t.Errorf("ParseCommand() payload = %v, want %v", cmd.GetPayload(), expected)
+	}
+
+	for _, invalid := range []string{
+		`{"cmd":"step","bars":0}`,
+		`{"cmd":"step","frame":{"value":5,"unit":"m"}}`,
+	} {
+		cmd, err = ParseCommand([]byte(invalid))
+		if err != nil {
+			t.Fatalf("ParseCommand() error = %v, wantErr %v", err, false)
+		}
+		if err := cmd.GetPayload().(*StepCommand).Valid(); err == nil {
+			t.Errorf("Valid() for %s error = %v, wantErr %v", invalid, err, true)
+		}
+	}
+}
+
+func TestParseCommand_Speed(t *testing.T) {
+	cmd, err := ParseCommand([]byte(`{"cmd":"speed","millis":250}`))
+	if err != nil {
+		t.Fatalf("ParseCommand() error = %v, wantErr %v", err, false)
+	}
+	speed, ok := cmd.GetPayload().(*SpeedCommand)
+	if !ok {
+		t.Fatalf("ParseCommand() payload = %v, want a speed command", cmd.GetPayload())
+	}
+	if err := speed.Valid(); err != nil || speed.Interval() != 250*time.Millisecond {
+		t.Errorf("Interval() = %v, %v, want 250ms", speed.Interval(), err)
+	}
+
+	for _, invalid := range []string{`{"cmd":"speed"}`, `{"cmd":"speed","millis":10}`} {
+		cmd, err = ParseCommand([]byte(invalid))
+		if err != nil {
+			t.Fatalf("ParseCommand() error = %v, wantErr %v", err, false)
+		}
+		if err := cmd.GetPayload().(*SpeedCommand).Valid(); err == nil {
+			t.Errorf("Valid() for %s error = %v, wantErr %v", invalid, err, true)
+		}
+	}
+}
+
+func TestPlayCommand_SubSecondInterval(t *testing.T) {
+	play := PlayCommand{
+		Frame:      bars.Timeframe{Value: 1, Unit: "m"},
+		ChartFrame: bars.Timeframe{Value: 1, Unit: "m"},
+		Millis:     500,
+	}
+	if err := play.Valid(); err != nil {
+		t.Fatalf("Valid() error = %v, wantErr %v", err, false)
+	}
+	if play.Interval() != 500*time.Millisecond {
+		t.Errorf("Interval() = %v, want 500ms", play.Interval())
+	}
+
+	play.Millis = 0
+	play.Seconds = 2
+	if play.Interval() != 2*time.Second {
+		t.Errorf("Interval() = %v, want 2s", play.Interval())
+	}
+}
+
+func TestSeekCommand_Resolve(t *testing.T) {
+	chicago, _ := time.LoadLocation("America/Chicago")
+	// A Friday evening, after the session has closed
+	from := time.Date(2023, 11, 3, 16, 0, 0, 0, chicago)
+
+	cmd, err := ParseCommand([]byte(`{"cmd":"seek","target":"session-open"}`))
+	if err != nil {
+		t.Fatalf("ParseCommand() error = %v, wantErr %v", err, false)
+	}
+	seek, ok := cmd.GetPayload().(*SeekCommand)
+	if !ok {
+		t.Fatalf("ParseCommand() payload = %v, want a seek command", cmd.GetPayload())
+	}
+	if err := seek.Resolve(from, 1); err != nil {
+		t.Fatalf("Resolve() error = %v, wantErr %v", err, false)
+	}
+	if want := time.Date(2023, 11, 6, 8, 30, 0, 0, chicago); seek.Date != want.UnixMilli() {
+		t.Errorf("Resolve() date = %v, want %v", time.UnixMilli(seek.Date).In(chicago), want)
+	}
+
+	seek = &SeekCommand{Target: "clock", Clock: "16:00"}
+	if err := seek.Resolve(from, 1); err != nil {
+		t.Fatalf("Resolve() error = %v, wantErr %v", err, false)
+	}
+	if want := time.Date(2023, 11, 6, 16, 0, 0, 0, chicago); seek.Date != want.UnixMilli() {
+		t.Errorf("Resolve() date = %v, want the next 16:00 rather than now", time.UnixMilli(seek.Date).In(chicago))
+	}
+
+	for _, invalid := range []*SeekCommand{
+		{Target: "time", Date: from.Add(-time.Hour).UnixMilli()},
+		{Target: "time"},
+		{Target: "session-open", SymbolID: 999},
+		{Target: "somewhere"},
+	} {
+		if err := invalid.Resolve(from, 1); err == nil {
+			t.Errorf("Resolve() for %+v error = %v, wantErr %v", invalid, err, true)
+		}
+	}
+}
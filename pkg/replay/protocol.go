@@ -0,0 +1,67 @@
+package replay
+
+import "time"
+
+// ProtocolVersion is the version of the messages sent over replay
+// websockets. It goes up whenever a change would break existing clients.
+const ProtocolVersion = 1
+
+// HeartbeatInterval is how often the server pings replay websockets. A
+// websocket that hasn't answered within two intervals is taken to have
+// dropped.
+const HeartbeatInterval = 15 * time.Second
+
+// Types of message sent to clients
+const (
+	MessageHello = "hello" // Sent first on every websocket, with a Hello
+	MessageData  = "data"  // Bars and account updates
+	MessageError = "error" // An ErrorFrame for a command that wasn't carried out
+	MessagePong  = "pong"  // Answers a ping command
+
+	MessageLeaderboard = "leaderboard" // A room's Leaderboard, whenever it changes
+)
+
+// Codes of error frames
+const (
+	ErrorParse       = "parse"       // The message isn't a command
+	ErrorUnsupported = "unsupported" // The websocket doesn't take the command
+	ErrorInvalid     = "invalid"     // The command isn't valid
+	ErrorFailed      = "failed"      // The command couldn't be carried out
+)
+
+var (
+	// ReplayCommands are taken by every replay websocket, and
+	// AccountCommands only by those simulating an account.
+	ReplayCommands  = []string{"play", "pause", "step", "speed", "seek", "ack", "ping"}
+	AccountCommands = []string{"subscribe", "unsubscribe", "flatten", "cancel-all"}
+
+	// MemberCommands are taken from everyone in a room. Only its host
+	// controls the replay, with ReplayCommands.
+	MemberCommands = []string{"ack", "ping", "subscribe", "flatten", "cancel-all"}
+)
+
+// Envelope wraps every message sent over a replay websocket.
+type Envelope struct {
+	Version int         `json:"v"`
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq"` // Numbered by the session, for acknowledging and resuming
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// Hello is the handshake that starts every websocket, telling the client
+// what it can do.
+type Hello struct {
+	Version          int      `json:"version"`
+	SessionID        string   `json:"sessionID,omitempty"` // Only for sessions that can be resumed
+	Resumed          bool     `json:"resumed"`
+	Commands         []string `json:"commands"`
+	Capabilities     []string `json:"capabilities"`
+	HeartbeatSeconds int      `json:"heartbeatSeconds"`
+}
+
+// ErrorFrame says why a command wasn't carried out.
+type ErrorFrame struct {
+	Cmd     string `json:"cmd,omitempty"` // Missing if the message couldn't be read
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,204 @@
+package replay
+
+import (
+	"sync"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+)
+
+// DefaultQueueSize is how many updates a replayer holds for a consumer that
+// has fallen behind before its overflow policy kicks in.
+const DefaultQueueSize = 64
+
+// OverflowPolicy is what a replayer does with a new update when its queue
+// is full.
+type OverflowPolicy int
+
+const (
+	// Coalesce merges the update into the newest one waiting, so bars still
+	// all arrive, just in fewer updates.
+	Coalesce OverflowPolicy = iota
+	// DropOldest throws away the oldest update waiting, for consumers that
+	// only need to keep up with the latest bars.
+	DropOldest
+)
+
+// Holds the updates the replayer has sent until they're taken, so sending
+// them never waits on the consumer.
+type updateQueue struct {
+	sync.Mutex
+	updates []Update
+	size    int
+	policy  OverflowPolicy
+	ready   chan struct{} // Signalled when an update is pushed
+	dropped int
+	cleared chan struct{} // Signalled when the queue is cleared
+	taken   chan struct{} // Signalled when an update is taken, if set
+	// Bumped whenever the queue is cleared, so an update taken before then
+	// and still being handed out is dropped too
+	generation int
+}
+
+func newUpdateQueue(size int, policy OverflowPolicy) *updateQueue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	return &updateQueue{
+		size:    size,
+		policy:  policy,
+		ready:   make(chan struct{}, 1),
+		cleared: make(chan struct{}, 1),
+	}
+}
+
+func (q *updateQueue) push(update Update) {
+	q.Lock()
+	if len(q.updates) < q.size {
+		q.updates = append(q.updates, update)
+	} else if q.policy == DropOldest {
+		q.updates = append(q.updates[1:], update)
+		q.dropped++
+	} else {
+		q.updates[len(q.updates)-1].merge(update)
+	}
+	q.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *updateQueue) pop() (Update, bool) {
+	update, _, ok := q.take()
+	return update, ok
+}
+
+// Pops the oldest update, along with the generation of the queue it was
+// taken from.
+func (q *updateQueue) take() (Update, int, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.updates) == 0 {
+		return Update{}, q.generation, false
+	}
+	update := q.updates[0]
+	q.updates = q.updates[1:]
+	if q.taken != nil {
+		select {
+		case q.taken <- struct{}{}:
+		default:
+		}
+	}
+	return update, q.generation, true
+}
+
+// Throws away the updates waiting, and the one being handed out if any.
+func (q *updateQueue) clear() {
+	q.Lock()
+	q.updates = nil
+	q.generation++
+	q.Unlock()
+
+	select {
+	case q.cleared <- struct{}{}:
+	default:
+	}
+}
+
+func (q *updateQueue) clearedSince(generation int) bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.generation != generation
+}
+
+// Hands the queued updates to out as they're taken, closing it once done
+// is.
+func pumpUpdates(q *updateQueue, out chan<- Update, done <-chan struct{}) {
+	defer close(out)
+	for {
+		update, generation, ok := q.take()
+		if !ok {
+			select {
+			case <-q.ready:
+			case <-q.cleared:
+			case <-done:
+				return
+			}
+			continue
+		}
+	handOut:
+		for {
+			select {
+			case out <- update:
+				break handOut
+			case <-q.cleared:
+				if q.clearedSince(generation) {
+					break handOut
+				}
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// Copies the update, so it can be queued for several consumers that each
+// merge into their own.
+func (u Update) clone() Update {
+	c := Update{
+		Bars:   make(map[uint][]bars.Bar, len(u.Bars)),
+		Frames: make(map[uint]map[string][]bars.Bar, len(u.Frames)),
+	}
+	for symbolID, symbolBars := range u.Bars {
+		c.Bars[symbolID] = append([]bars.Bar{}, symbolBars...)
+	}
+	for symbolID, frames := range u.Frames {
+		c.Frames[symbolID] = make(map[string][]bars.Bar, len(frames))
+		for frame, frameBars := range frames {
+			c.Frames[symbolID][frame] = append([]bars.Bar{}, frameBars...)
+		}
+	}
+	return c
+}
+
+// Folds a later update into this one. A symbol's placeholder bars are only
+// kept if it has no real ones, and a chart frame's bar sent again replaces
+// the earlier one.
+func (u *Update) merge(later Update) {
+	for symbolID, symbolBars := range later.Bars {
+		u.Bars[symbolID] = mergeBars(u.Bars[symbolID], symbolBars)
+	}
+	for symbolID, frames := range later.Frames {
+		merged, ok := u.Frames[symbolID]
+		if !ok {
+			merged = make(map[string][]bars.Bar)
+			u.Frames[symbolID] = merged
+		}
+		for frame, frameBars := range frames {
+			for _, bar := range frameBars {
+				current := merged[frame]
+				if len(current) > 0 && current[len(current)-1].Date == bar.Date {
+					current[len(current)-1] = bar
+				} else {
+					merged[frame] = append(current, bar)
+				}
+			}
+		}
+	}
+}
+
+func mergeBars(earlier, later []bars.Bar) []bars.Bar {
+	all := append(append([]bars.Bar{}, earlier...), later...)
+	var merged []bars.Bar
+	for _, bar := range all {
+		if bar.Volume >= 0 {
+			merged = append(merged, bar)
+		}
+	}
+	if len(merged) == 0 && len(all) > 0 {
+		// Only placeholders, of which the latest marks how far the replay got
+		return all[len(all)-1:]
+	}
+	return merged
+}
@@ -8,18 +8,41 @@ import (
 	"github.com/tradingcage/tradingcage-go/pkg/bars"
 )
 
+// Update is a frame of bars sent by the replayer. Bars has each symbol's
+// bars at the finest frame being replayed, and Frames has the bars of each
+// chart frame built up from them, keyed by symbol and then by timeframe. The
+// last bar of a chart frame is still forming and is sent again, updated, with
+// the next bars that fall into it.
+type Update struct {
+	Bars   map[uint][]bars.Bar
+	Frames map[uint]map[string][]bars.Bar
+}
+
+// ReplayerConfig tunes a replayer. The zero value runs on the real clock
+// and coalesces updates once DefaultQueueSize are waiting.
+type ReplayerConfig struct {
+	Clock     Clock
+	QueueSize int
+	Overflow  OverflowPolicy
+}
+
 type Replayer struct {
 	sync.Mutex
 	symbolIDs         []uint
 	timeframe         bars.Timeframe
-	chartFrame        bars.Timeframe
+	chartFrames       []bars.Timeframe
 	rth               bool
 	currentDateMillis int64
 	barData           bars.BarData
-	barCh             chan map[uint][]bars.Bar
+	clock             Clock
+	queue             *updateQueue
+	updates           chan Update
 	commsCh           chan Command
 	closeCh           chan struct{}
+	fetchCh           chan struct{} // Wakes the background fetch when a buffer runs low
 	buffers           map[uint][]bars.Bar
+	bufferGeneration  int                          // Bumped whenever the buffers are flushed, so fetches from before are dropped
+	forming           map[uint]map[string]bars.Bar // Last bar of each chart frame, missing for symbols whose frames aren't seeded yet
 	fetchThreshold    int
 }
 
@@ -27,17 +50,24 @@ func NewReplayer(
 	symbolIDs []uint,
 	startingDateMillis int64,
 	barData bars.BarData,
-	barCh chan map[uint][]bars.Bar,
+	cfg ReplayerConfig,
 ) *Replayer {
 
+	if cfg.Clock == nil {
+		cfg.Clock = realClock{}
+	}
 	r := &Replayer{
 		symbolIDs:         symbolIDs,
 		currentDateMillis: startingDateMillis,
 		barData:           barData,
-		barCh:             barCh,
+		clock:             cfg.Clock,
+		queue:             newUpdateQueue(cfg.QueueSize, cfg.Overflow),
+		updates:           make(chan Update),
 		commsCh:           make(chan Command),
 		closeCh:           make(chan struct{}),
+		fetchCh:           make(chan struct{}, 1),
 		buffers:           make(map[uint][]bars.Bar),
+		forming:           make(map[uint]map[string]bars.Bar),
 		fetchThreshold:    100,
 	}
 
@@ -47,31 +77,109 @@ func NewReplayer(
 
 	go r.runBackground()
 	go r.fetchBarsInBackground()
+	go pumpUpdates(r.queue, r.updates, r.closeCh)
 
 	return r
 }
 
+// Updates is where the replay's bars come out. It's closed once the
+// replayer is.
+func (r *Replayer) Updates() <-chan Update {
+	return r.updates
+}
+
+// SendCommand passes a command to the replay, unless it has been closed.
 func (r *Replayer) SendCommand(cmd Command) {
-	r.commsCh <- cmd
+	select {
+	case r.commsCh <- cmd:
+	case <-r.closeCh:
+	}
 }
 
 func (r *Replayer) Play(frame bars.Timeframe, chartFrame bars.Timeframe, seconds int, rth bool) {
-	r.commsCh <- NewCommand(
+	r.SendCommand(NewCommand(
 		"play",
-		PlayCommand{
+		&PlayCommand{
 			Frame:      frame,
 			ChartFrame: chartFrame,
 			Seconds:    seconds,
 			RTH:        rth,
 		},
-	)
+	))
 }
 
 func (r *Replayer) Pause() {
-	r.commsCh <- NewCommand(
+	r.SendCommand(NewCommand(
 		"pause",
-		PauseCommand{},
-	)
+		&PauseCommand{},
+	))
+}
+
+// DropUpdates throws away the bars sent but not yet taken from Updates, as
+// when seeking past them. The replay should be paused first, or more can
+// come straight after.
+func (r *Replayer) DropUpdates() {
+	r.queue.clear()
+}
+
+func (r *Replayer) Subscribe(symbolIDs ...uint) {
+	r.SendCommand(NewCommand(
+		"subscribe",
+		&SubscribeCommand{SymbolIDs: symbolIDs},
+	))
+}
+
+func (r *Replayer) Unsubscribe(symbolIDs ...uint) {
+	r.SendCommand(NewCommand(
+		"unsubscribe",
+		&UnsubscribeCommand{SymbolIDs: symbolIDs},
+	))
+}
+
+// CurrentDate returns the date the replay has reached.
+func (r *Replayer) CurrentDate() time.Time {
+	r.Lock()
+	defer r.Unlock()
+	return time.UnixMilli(r.currentDateMillis)
+}
+
+// SymbolIDs returns the symbols currently being replayed.
+func (r *Replayer) SymbolIDs() []uint {
+	r.Lock()
+	defer r.Unlock()
+	return append([]uint{}, r.symbolIDs...)
+}
+
+// Adds the symbols that aren't already being replayed and returns them.
+func (r *Replayer) addSymbols(symbolIDs []uint) []uint {
+	r.Lock()
+	defer r.Unlock()
+	var added []uint
+	for _, symbolID := range symbolIDs {
+		if _, ok := r.buffers[symbolID]; ok {
+			continue
+		}
+		r.symbolIDs = append(r.symbolIDs, symbolID)
+		r.buffers[symbolID] = make([]bars.Bar, 0)
+		added = append(added, symbolID)
+	}
+	return added
+}
+
+func (r *Replayer) removeSymbols(symbolIDs []uint) {
+	r.Lock()
+	defer r.Unlock()
+	for _, symbolID := range symbolIDs {
+		delete(r.buffers, symbolID)
+		delete(r.forming, symbolID)
+	}
+	kept := r.symbolIDs[:0]
+	for _, symbolID := range r.symbolIDs {
+		if _, ok := r.buffers[symbolID]; ok {
+			kept = append(kept, symbolID)
+		}
+	}
+	r.symbolIDs = kept
 }
 
 func (r *Replayer) fetchBarsInBackground() {
@@ -79,57 +187,80 @@ func (r *Replayer) fetchBarsInBackground() {
 		select {
 		case <-r.closeCh:
 			return
-		default:
+		case <-r.fetchCh:
+		case <-r.clock.After(3 * time.Second):
+		}
+
+		r.Lock()
+		timeframe := r.timeframe
+		r.Unlock()
+		if timeframe.Empty() {
+			continue // Nothing has played yet
+		}
+
+		for _, symbolID := range r.SymbolIDs() {
 			r.Lock()
-			timeframe := r.timeframe
-			chartFrame := r.chartFrame
+			buffered := len(r.buffers[symbolID])
 			r.Unlock()
-
-			if len(r.commsCh) > 0 || timeframe.Empty() {
-				time.Sleep(time.Second) // Avoid tight loop when paused
+			if buffered > r.fetchThreshold {
 				continue
 			}
-
-			for _, symbolID := range r.symbolIDs {
-				if len(r.buffers[symbolID]) > r.fetchThreshold {
-					continue
-				}
-				r.refreshBuffer(symbolID, timeframe, chartFrame)
-			}
-
-			time.Sleep(3 * time.Second)
+			r.refreshBuffer(symbolID)
 		}
 	}
 }
 
-func (r *Replayer) refreshBuffer(symbolID uint, timeframe bars.Timeframe, chartFrame bars.Timeframe) {
+func (r *Replayer) refreshBuffer(symbolID uint) {
 	// Fetch new bars here and append to the buffer
 	// Assuming fetching bars returns them in ascending date order
-	var tf string
-	if timeframe.Millis() < chartFrame.Millis() {
-		tf = timeframe.String()
-	} else {
-		tf = chartFrame.String()
+	r.Lock()
+	generation := r.bufferGeneration
+	startDate := r.currentDateMillis
+	timeframe := r.timeframe
+	fetchFrame := r.fetchFrame()
+	chartFrames := r.chartFrames
+	rth := r.rth
+	_, seeded := r.forming[symbolID]
+	r.Unlock()
+
+	// The chart frames' forming bars pick up from the bars already replayed
+	fetchFrom := startDate
+	if !seeded {
+		for _, frame := range chartFrames {
+			span := frame.Millis()
+			if frame.Unit == "mo" {
+				span += (24 * time.Hour).Milliseconds() // Months run up to 31 days
+			}
+			if startDate-span < fetchFrom {
+				fetchFrom = startDate - span
+			}
+		}
 	}
 	newBars, err := r.barData.GetBarsBetween(bars.GetBarsBetweenRequest{
 		SymbolID:  symbolID,
-		Timeframe: tf,
-		StartDate: r.currentDateMillis,
-		EndDate:   r.currentDateMillis + int64(r.fetchThreshold*int(timeframe.Millis())),
-		RTH:       r.rth,
+		Timeframe: fetchFrame.String(),
+		StartDate: fetchFrom,
+		EndDate:   startDate + int64(r.fetchThreshold*int(timeframe.Millis())),
+		RTH:       rth,
 	})
 	if err == nil {
 		r.Lock()
-		buffer := r.buffers[symbolID]
-		if len(buffer) > 0 {
-			lastBarDate := buffer[len(buffer)-1].Date
-			for _, bar := range newBars {
-				if bar.Date > lastBarDate {
-					buffer = append(buffer, bar)
-				}
+		buffer, ok := r.buffers[symbolID]
+		if !ok || generation != r.bufferGeneration {
+			// Unsubscribed or flushed while the bars were being fetched
+			r.Unlock()
+			return
+		}
+		if _, ok := r.forming[symbolID]; !ok {
+			r.forming[symbolID] = seedFrames(chartFrames, newBars, startDate)
+		}
+		for _, bar := range newBars {
+			if bar.Date < startDate {
+				continue
+			}
+			if len(buffer) == 0 || bar.Date > buffer[len(buffer)-1].Date {
+				buffer = append(buffer, bar)
 			}
-		} else {
-			buffer = append(buffer, newBars...)
 		}
 		r.buffers[symbolID] = buffer
 		r.Unlock()
@@ -138,9 +269,64 @@ func (r *Replayer) refreshBuffer(symbolID uint, timeframe bars.Timeframe, chartF
 	}
 }
 
+// Bars are fetched at the finest of the frames and built up into the rest.
+// The lock needs to be held.
+func (r *Replayer) fetchFrame() bars.Timeframe {
+	fetchFrame := r.timeframe
+	for _, frame := range r.chartFrames {
+		if frame.Millis() < fetchFrame.Millis() {
+			fetchFrame = frame
+		}
+	}
+	return fetchFrame
+}
+
+// Builds each chart frame's forming bar out of the bars before the given
+// date that fall into the same frame as it.
+func seedFrames(chartFrames []bars.Timeframe, barList []bars.Bar, date int64) map[string]bars.Bar {
+	forming := make(map[string]bars.Bar)
+	for _, frame := range chartFrames {
+		var frameBars []bars.Bar
+		for _, bar := range barList {
+			if bar.Date < date && bars.IsSameFrame(frame, bar.Date, date) {
+				frameBars = bars.AppendBar(frame, frameBars, bar)
+			}
+		}
+		if len(frameBars) > 0 {
+			forming[frame.String()] = frameBars[len(frameBars)-1]
+		}
+	}
+	return forming
+}
+
+// Adds newly replayed bars of a symbol to its chart frames and returns the
+// bars of each frame that changed. The lock needs to be held.
+func (r *Replayer) buildFrames(symbolID uint, newBars []bars.Bar) map[string][]bars.Bar {
+	forming, ok := r.forming[symbolID]
+	if !ok {
+		forming = make(map[string]bars.Bar)
+		r.forming[symbolID] = forming
+	}
+	frames := make(map[string][]bars.Bar)
+	for _, frame := range r.chartFrames {
+		key := frame.String()
+		var frameBars []bars.Bar
+		if bar, ok := forming[key]; ok {
+			frameBars = append(frameBars, bar)
+		}
+		for _, bar := range newBars {
+			frameBars = bars.AppendBar(frame, frameBars, bar)
+		}
+		forming[key] = frameBars[len(frameBars)-1]
+		frames[key] = frameBars
+	}
+	return frames
+}
+
 func (r *Replayer) runBackground() {
 	paused := true
-	ticker := time.NewTicker(time.Second)
+	ticker := r.clock.NewTicker(time.Second)
+	ticker.Stop()
 
 	for {
 		select {
@@ -148,60 +334,176 @@ func (r *Replayer) runBackground() {
 			return
 		case cmd := <-r.commsCh:
 			switch c := cmd.GetPayload().(type) {
-			case PlayCommand:
+			case *PlayCommand:
 				if err := c.Valid(); err != nil {
 					fmt.Printf("play command not valid: %v\n", err)
 					continue
 				}
 				paused = false
-				r.Lock()
-				r.chartFrame = c.ChartFrame
-				r.timeframe = c.Frame
-				for _, symbolID := range r.symbolIDs {
-					r.buffers[symbolID] = make([]bars.Bar, 0)
+				r.setFrames(c.Frame, c.Charts(), c.RTH)
+				ticker.Reset(c.Interval())
+				for _, symbolID := range r.SymbolIDs() {
+					r.refreshBuffer(symbolID)
+				}
+			case *PauseCommand:
+				paused = true
+				ticker.Stop()
+			case *StepCommand:
+				if err := c.Valid(); err != nil {
+					fmt.Printf("step command not valid: %v\n", err)
+					continue
 				}
-				r.rth = c.RTH
+				paused = true
+				ticker.Stop()
+				r.Lock()
+				timeframe := r.timeframe
+				sameFrames := c.Frame.Empty() || (c.Frame == r.timeframe && sameTimeframes(c.Charts(), r.chartFrames) && c.RTH == r.rth)
 				r.Unlock()
-				ticker.Reset(time.Duration(c.Seconds) * time.Second)
-				for _, symbolID := range r.symbolIDs {
-					r.refreshBuffer(symbolID, c.Frame, c.ChartFrame)
+				if !sameFrames {
+					r.setFrames(c.Frame, c.Charts(), c.RTH)
+					timeframe = c.Frame
+				}
+				if timeframe.Empty() {
+					fmt.Printf("step command not valid: nothing is playing yet, so frame is needed\n")
+					continue
+				}
+				for i := 0; i < c.Bars; i++ {
+					r.fillEmptyBuffers()
+					r.sendNextBars()
+				}
+			case *SeekCommand:
+				if c.Date <= 0 {
+					fmt.Printf("seek command not resolved\n")
+					continue
 				}
-			case PauseCommand:
 				paused = true
 				ticker.Stop()
+				r.queue.clear()
+				r.Lock()
+				r.currentDateMillis = c.Date
+				r.flushBuffers()
+				timeframe := r.timeframe
+				r.Unlock()
+				if !timeframe.Empty() {
+					r.fillEmptyBuffers()
+				}
+			case *SpeedCommand:
+				if err := c.Valid(); err != nil {
+					fmt.Printf("speed command not valid: %v\n", err)
+					continue
+				}
+				if !paused {
+					ticker.Reset(c.Interval())
+				}
+			case *SubscribeCommand:
+				added := r.addSymbols(c.SymbolIDs)
+				r.Lock()
+				timeframe := r.timeframe
+				r.Unlock()
+				if !timeframe.Empty() {
+					for _, symbolID := range added {
+						r.refreshBuffer(symbolID)
+					}
+				}
+			case *UnsubscribeCommand:
+				r.removeSymbols(c.SymbolIDs)
 			default:
 				fmt.Printf("unknown command type: %v\n", c)
 			}
-		case <-ticker.C:
-			r.Lock()
+		case <-ticker.C():
 			if !paused {
-				var barsToSend map[uint][]bars.Bar = make(map[uint][]bars.Bar)
-				for _, symbolID := range r.symbolIDs {
-					buffer := r.buffers[symbolID]
-					var barsForSymbol []bars.Bar
-					for _, bar := range buffer {
-						if bar.Date <= r.currentDateMillis || bar.Date-r.currentDateMillis <= r.timeframe.Millis() {
-							barsForSymbol = append(barsForSymbol, bar)
-						} else {
-							break
-						}
-					}
+				r.sendNextBars()
+			}
+		}
+	}
+}
 
-					if len(barsForSymbol) == 0 {
-						barsForSymbol = append(barsForSymbol, bars.DummyBar(r.currentDateMillis+r.timeframe.Millis()))
-					} else {
-						r.buffers[symbolID] = buffer[len(barsForSymbol):]
-					}
+// Switches to new frames, throwing away the bars buffered for the old ones.
+func (r *Replayer) setFrames(timeframe bars.Timeframe, chartFrames []bars.Timeframe, rth bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.chartFrames = chartFrames
+	r.timeframe = timeframe
+	r.flushBuffers()
+	r.rth = rth
+}
 
-					barsToSend[symbolID] = barsForSymbol
-				}
+// Empties the buffers, along with the chart frames' forming bars. The lock
+// needs to be held.
+func (r *Replayer) flushBuffers() {
+	for _, symbolID := range r.symbolIDs {
+		r.buffers[symbolID] = make([]bars.Bar, 0)
+	}
+	r.forming = make(map[uint]map[string]bars.Bar)
+	r.bufferGeneration++
+}
+
+func sameTimeframes(a, b []bars.Timeframe) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
 
-				r.barCh <- barsToSend
-				r.currentDateMillis += r.timeframe.Millis()
+// Fetches bars for symbols that have run out, rather than waiting for the
+// background fetch.
+func (r *Replayer) fillEmptyBuffers() {
+	r.Lock()
+	var empty []uint
+	for _, symbolID := range r.symbolIDs {
+		if len(r.buffers[symbolID]) == 0 {
+			empty = append(empty, symbolID)
+		}
+	}
+	r.Unlock()
+	for _, symbolID := range empty {
+		r.refreshBuffer(symbolID)
+	}
+}
+
+// Sends the bars up to the end of the next frame, with the chart frames they
+// update, and moves the replay's date on by a frame.
+func (r *Replayer) sendNextBars() {
+	r.Lock()
+	defer r.Unlock()
+	update := Update{
+		Bars:   make(map[uint][]bars.Bar),
+		Frames: make(map[uint]map[string][]bars.Bar),
+	}
+	for _, symbolID := range r.symbolIDs {
+		buffer := r.buffers[symbolID]
+		var barsForSymbol []bars.Bar
+		for _, bar := range buffer {
+			if bar.Date <= r.currentDateMillis || bar.Date-r.currentDateMillis <= r.timeframe.Millis() {
+				barsForSymbol = append(barsForSymbol, bar)
+			} else {
+				break
 			}
-			r.Unlock()
 		}
+
+		if len(barsForSymbol) == 0 {
+			barsForSymbol = append(barsForSymbol, bars.DummyBar(r.currentDateMillis+r.timeframe.Millis()))
+		} else {
+			r.buffers[symbolID] = buffer[len(barsForSymbol):]
+			update.Frames[symbolID] = r.buildFrames(symbolID, barsForSymbol)
+		}
+		if len(r.buffers[symbolID]) < r.fetchThreshold/4 {
+			select {
+			case r.fetchCh <- struct{}{}:
+			default:
+			}
+		}
+
+		update.Bars[symbolID] = barsForSymbol
 	}
+
+	r.queue.push(update)
+	r.currentDateMillis += r.timeframe.Millis()
 }
 
 func (r *Replayer) Close() {
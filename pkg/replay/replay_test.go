@@ -0,0 +1,240 @@
+package replay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+)
+
+func TestSendNextBars_ChartFrames(t *testing.T) {
+	start := time.Date(2023, 11, 6, 9, 37, 0, 0, time.UTC)
+	minute := func(m int, price float64) bars.Bar {
+		return bars.Bar{Date: start.Add(time.Duration(m) * time.Minute).UnixMilli(), Open: price, High: price + 1, Low: price - 1, Close: price, Volume: 10}
+	}
+	oneMinute := bars.Timeframe{Value: 1, Unit: "m"}
+	fifteenMinutes := bars.Timeframe{Value: 15, Unit: "m"}
+
+	r := &Replayer{
+		symbolIDs:         []uint{1},
+		timeframe:         oneMinute,
+		chartFrames:       []bars.Timeframe{oneMinute, fifteenMinutes},
+		currentDateMillis: start.UnixMilli(),
+		queue:             newUpdateQueue(10, Coalesce),
+		buffers:           map[uint][]bars.Bar{1: {minute(0, 100), minute(1, 104), minute(8, 90), minute(9, 91)}},
+		forming:           make(map[uint]map[string]bars.Bar),
+	}
+	// Only the 09:36 bar from before the replay started is in the forming 15m bar
+	r.forming[1] = seedFrames(r.chartFrames, []bars.Bar{minute(-8, 95), minute(-7, 110), minute(-1, 99)}, start.UnixMilli())
+	seeded := r.forming[1]["15m"]
+	if seeded.Open != 99 || seeded.High != 100 || seeded.Volume != 10 {
+		t.Fatalf("seedFrames() forming bar = %+v, want only the bar after 09:30", seeded)
+	}
+
+	r.sendNextBars()
+	update, _ := r.queue.pop()
+	if got := update.Bars[1]; len(got) != 2 {
+		t.Fatalf("sendNextBars() bars = %+v, want the bars at 09:37 and 09:38", got)
+	}
+	if got := update.Frames[1]["1m"]; len(got) != 2 || got[1].Close != 104 {
+		t.Errorf("sendNextBars() 1m frame = %+v, want the two bars", got)
+	}
+	fifteen := update.Frames[1]["15m"]
+	want := bars.Bar{Date: start.Add(8 * time.Minute).UnixMilli(), Open: 99, High: 105, Low: 98, Close: 104, Volume: 30}
+	if len(fifteen) != 1 || fifteen[0] != want {
+		t.Errorf("sendNextBars() 15m frame = %+v, want the forming bar updated in place to %+v", fifteen, want)
+	}
+
+	// Nothing new for the chart frames while there are no bars
+	for i := 0; i < 6; i++ {
+		r.sendNextBars()
+		update, _ = r.queue.pop()
+		if _, ok := update.Frames[1]; ok {
+			t.Fatalf("sendNextBars() frames = %+v, want none without bars", update.Frames)
+		}
+	}
+
+	// 09:45 finishes the 15m bar and 09:46 starts the next one
+	r.sendNextBars()
+	update, _ = r.queue.pop()
+	fifteen = update.Frames[1]["15m"]
+	if len(fifteen) != 1 || fifteen[0].Close != 90 || fifteen[0].Volume != 40 {
+		t.Fatalf("sendNextBars() 15m frame = %+v, want the finished bar", fifteen)
+	}
+	r.sendNextBars()
+	update, _ = r.queue.pop()
+	fifteen = update.Frames[1]["15m"]
+	if len(fifteen) != 2 || fifteen[1].Date != start.Add(23*time.Minute).UnixMilli() || fifteen[1].Open != 91 {
+		t.Errorf("sendNextBars() 15m frame = %+v, want a new bar ending at 10:00 opening at 91", fifteen)
+	}
+}
+
+type testBarData map[uint][]bars.Bar
+
+func (d testBarData) GetBars(req bars.GetBarsRequest) ([]bars.Bar, error) {
+	return nil, nil
+}
+
+func (d testBarData) GetBarsBetween(req bars.GetBarsBetweenRequest) ([]bars.Bar, error) {
+	var found []bars.Bar
+	for _, bar := range d[req.SymbolID] {
+		if bar.Date >= req.StartDate && bar.Date <= req.EndDate {
+			found = append(found, bar)
+		}
+	}
+	return found, nil
+}
+
+func (d testBarData) GetLastPrices(enddate int64, symbolID uint) (map[uint]float64, error) {
+	return nil, nil
+}
+
+func (d testBarData) GetSymbolDateRanges() ([]bars.SymbolDateRange, error) {
+	return nil, nil
+}
+
+// Minute bars for the ten minutes after start
+func testMinuteBars(start time.Time) []bars.Bar {
+	var minuteBars []bars.Bar
+	for i := 1; i <= 10; i++ {
+		price := float64(4500 + i)
+		minuteBars = append(minuteBars, bars.Bar{Date: start.Add(time.Duration(i) * time.Minute).UnixMilli(), Open: price, High: price, Low: price, Close: price, Volume: 10})
+	}
+	return minuteBars
+}
+
+func nextUpdate(t *testing.T, r *Replayer) Update {
+	t.Helper()
+	select {
+	case update := <-r.Updates():
+		return update
+	case <-time.After(time.Second):
+		t.Fatalf("Updates() sent nothing")
+		return Update{}
+	}
+}
+
+// Takes every update the replayer has left.
+func drainUpdates(r *Replayer) []Update {
+	var updates []Update
+	for {
+		select {
+		case update := <-r.Updates():
+			updates = append(updates, update)
+		case <-time.After(100 * time.Millisecond):
+			return updates
+		}
+	}
+}
+
+func TestReplayer_PlaysOnTheClock(t *testing.T) {
+	start := time.Date(2023, 11, 6, 9, 30, 0, 0, time.UTC)
+	clock := NewFakeClock(time.Now())
+	r := NewReplayer([]uint{1}, start.UnixMilli(), testBarData{1: testMinuteBars(start)}, ReplayerConfig{Clock: clock})
+	defer r.Close()
+
+	oneMinute := bars.Timeframe{Value: 1, Unit: "m"}
+	r.Play(oneMinute, oneMinute, 1, false)
+	// Commands run in order, so this returns once the play has started
+	r.SendCommand(NewCommand("speed", &SpeedCommand{Seconds: 1}))
+
+	for i, want := range []float64{4501, 4502} {
+		clock.Advance(time.Second)
+		update := nextUpdate(t, r)
+		if got := update.Bars[1]; len(got) != 1 || got[0].Close != want {
+			t.Fatalf("tick %d sent %+v, want the bar closing at %v", i, got, want)
+		}
+	}
+	if !r.CurrentDate().Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("CurrentDate() = %v, want two minutes in", r.CurrentDate())
+	}
+
+	r.Pause()
+	clock.Advance(5 * time.Second)
+	if updates := drainUpdates(r); len(updates) != 0 {
+		t.Errorf("Updates() sent %+v while paused", updates)
+	}
+}
+
+func TestReplayer_SlowConsumer(t *testing.T) {
+	start := time.Date(2023, 11, 6, 9, 30, 0, 0, time.UTC)
+	oneMinute := bars.Timeframe{Value: 1, Unit: "m"}
+	step := NewCommand("step", &StepCommand{
+		Frame:       oneMinute,
+		ChartFrame:  oneMinute,
+		ChartFrames: []bars.Timeframe{{Value: 15, Unit: "m"}},
+		Bars:        10,
+	})
+
+	// Nothing takes the updates while all ten bars are stepped through
+	coalesced := NewReplayer([]uint{1}, start.UnixMilli(), testBarData{1: testMinuteBars(start)}, ReplayerConfig{
+		Clock:     NewFakeClock(time.Now()),
+		QueueSize: 2,
+	})
+	defer coalesced.Close()
+	coalesced.SendCommand(step)
+	coalesced.Pause()
+	updates := drainUpdates(coalesced)
+	if len(updates) > 3 {
+		t.Errorf("Updates() sent %d updates, want at most the queue and the one being taken", len(updates))
+	}
+	sent := 0
+	for _, update := range updates {
+		sent += len(update.Bars[1])
+	}
+	fifteen := updates[len(updates)-1].Frames[1]["15m"]
+	if sent != 10 || len(fifteen) != 1 || fifteen[0].Volume != 100 {
+		t.Errorf("Coalesce sent %d bars and a 15m bar of %+v, want all 10 bars in it", sent, fifteen)
+	}
+
+	dropped := NewReplayer([]uint{1}, start.UnixMilli(), testBarData{1: testMinuteBars(start)}, ReplayerConfig{
+		Clock:     NewFakeClock(time.Now()),
+		QueueSize: 2,
+		Overflow:  DropOldest,
+	})
+	defer dropped.Close()
+	dropped.SendCommand(step)
+	dropped.Pause()
+	updates = drainUpdates(dropped)
+	if len(updates) > 3 {
+		t.Errorf("Updates() sent %d updates, want at most the queue and the one being taken", len(updates))
+	}
+	last := updates[len(updates)-1].Bars[1]
+	if len(last) != 1 || last[0].Close != 4510 {
+		t.Errorf("DropOldest ended on %+v, want the last bar kept", last)
+	}
+}
+
+func TestReplayer_DropUpdates(t *testing.T) {
+	start := time.Date(2023, 11, 6, 9, 30, 0, 0, time.UTC)
+	oneMinute := bars.Timeframe{Value: 1, Unit: "m"}
+	step := func(n int) Command {
+		return NewCommand("step", &StepCommand{Frame: oneMinute, ChartFrame: oneMinute, Bars: n})
+	}
+	r := NewReplayer([]uint{1}, start.UnixMilli(), testBarData{1: testMinuteBars(start)}, ReplayerConfig{Clock: NewFakeClock(time.Now())})
+	defer r.Close()
+	taken := make(chan struct{}, 1)
+	r.queue.Lock()
+	r.queue.taken = taken
+	r.queue.Unlock()
+
+	// Nothing takes the updates, so one is held waiting to be taken and the
+	// rest are queued
+	r.SendCommand(step(5))
+	r.Pause()
+	select {
+	case <-taken:
+	case <-time.After(time.Second):
+		t.Fatalf("no update was taken to be handed out")
+	}
+	r.DropUpdates()
+	if updates := drainUpdates(r); len(updates) != 0 {
+		t.Fatalf("Updates() sent %+v after they were dropped", updates)
+	}
+
+	r.SendCommand(step(1))
+	updates := drainUpdates(r)
+	if len(updates) != 1 || len(updates[0].Bars[1]) != 1 || updates[0].Bars[1][0].Date != start.Add(6*time.Minute).UnixMilli() {
+		t.Errorf("Updates() sent %+v after dropping, want the sixth bar", updates)
+	}
+}
@@ -0,0 +1,442 @@
+package replay
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// LeaderboardInterval is how often a room sends its leaderboard, if it
+	// has changed.
+	LeaderboardInterval = time.Second
+
+	// RoomIdlePeriod is how long a room is kept with nobody in it.
+	RoomIdlePeriod = 5 * time.Minute
+)
+
+// Room is a replay shared by several accounts. Its host controls the replay
+// and everyone trades their own account against the same bars, ranked by
+// P&L on the room's leaderboard.
+type Room struct {
+	sync.Mutex
+	ID         string
+	Name       string
+	HostID     uint // User controlling the replay
+	SymbolID   uint // Symbol the replay is charted and seeked on
+	Replayer   *Replayer
+	clock      Clock
+	members    map[uint]*Member // By account
+	changed    bool             // The leaderboard has changed since it was last sent
+	emptySince time.Time        // Zero while anyone is in the room
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// Member is an account in a room, simulated against the room's bars by
+// whoever holds it.
+type Member struct {
+	Session  *Session
+	standing Standing
+	queue    *updateQueue // Each member has their own, so a slow one doesn't hold the rest back
+	updates  chan Update
+	actions  chan Command
+	left     chan struct{}
+}
+
+// Standing is an account's place on a room's leaderboard.
+type Standing struct {
+	Name          string  `json:"name"`
+	AccountID     uint    `json:"accountID"`
+	Host          bool    `json:"host"`
+	StartingValue float64 `json:"startingValue"` // Net liquidation value on joining
+	Value         float64 `json:"value"`         // Net liquidation value at the latest bars
+	PnL           float64 `json:"pnl"`
+}
+
+// Leaderboard ranks a room's members, highest P&L first.
+type Leaderboard struct {
+	RoomID    string     `json:"roomID"`
+	Date      int64      `json:"date"` // How far the replay has got
+	Standings []Standing `json:"standings"`
+}
+
+// RoomInfo describes an open room.
+type RoomInfo struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	HostID   uint   `json:"hostID"`
+	SymbolID uint   `json:"symbolID"`
+	Date     int64  `json:"date"`
+	Members  int    `json:"members"`
+}
+
+// NewRoom opens a room around the replayer, which it closes along with
+// itself. A nil clock is the real one.
+func NewRoom(name string, hostID, symbolID uint, replayer *Replayer, clock Clock) (*Room, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	r := &Room{
+		ID:         id,
+		Name:       name,
+		HostID:     hostID,
+		SymbolID:   symbolID,
+		Replayer:   replayer,
+		clock:      clock,
+		members:    make(map[uint]*Member),
+		emptySince: clock.Now(),
+		done:       make(chan struct{}),
+	}
+	go r.run(clock.NewTicker(LeaderboardInterval))
+	return r, nil
+}
+
+// Passes the replay's bars on to every member, and the leaderboard when it
+// changes.
+func (r *Room) run(ticker Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case update, ok := <-r.Replayer.Updates():
+			if !ok {
+				return
+			}
+			r.Lock()
+			for _, m := range r.members {
+				m.queue.push(update.clone())
+			}
+			r.Unlock()
+		case <-ticker.C():
+			r.sendLeaderboard()
+		}
+	}
+}
+
+func (r *Room) sendLeaderboard() {
+	r.Lock()
+	if !r.changed {
+		r.Unlock()
+		return
+	}
+	r.changed = false
+	board := r.leaderboard()
+	sessions := make([]*Session, 0, len(r.members))
+	for _, m := range r.members {
+		sessions = append(sessions, m.Session)
+	}
+	r.Unlock()
+
+	for _, session := range sessions {
+		session.Send(MessageLeaderboard, board)
+	}
+}
+
+// Leaderboard ranks the room's members as they stand.
+func (r *Room) Leaderboard() Leaderboard {
+	r.Lock()
+	defer r.Unlock()
+	return r.leaderboard()
+}
+
+// The lock needs to be held.
+func (r *Room) leaderboard() Leaderboard {
+	board := Leaderboard{
+		RoomID:    r.ID,
+		Date:      r.Replayer.CurrentDate().UnixMilli(),
+		Standings: make([]Standing, 0, len(r.members)),
+	}
+	for _, m := range r.members {
+		board.Standings = append(board.Standings, m.standing)
+	}
+	sort.Slice(board.Standings, func(i, j int) bool {
+		a, b := board.Standings[i], board.Standings[j]
+		if a.PnL != b.PnL {
+			return a.PnL > b.PnL
+		}
+		return a.AccountID < b.AccountID
+	})
+	return board
+}
+
+// Info describes the room.
+func (r *Room) Info() RoomInfo {
+	r.Lock()
+	defer r.Unlock()
+	return RoomInfo{
+		ID:       r.ID,
+		Name:     r.Name,
+		HostID:   r.HostID,
+		SymbolID: r.SymbolID,
+		Date:     r.Replayer.CurrentDate().UnixMilli(),
+		Members:  len(r.members),
+	}
+}
+
+// HasMember reports whether the account is in the room.
+func (r *Room) HasMember(accountID uint) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, ok := r.members[accountID]
+	return ok
+}
+
+// Join adds the session's account to the room under the given name, valued
+// at startingValue. It's sent the room's bars from then on.
+func (r *Room) Join(session *Session, name string, startingValue float64) (*Member, error) {
+	r.Lock()
+	defer r.Unlock()
+	select {
+	case <-r.done:
+		return nil, fmt.Errorf("room %s is closed", r.ID)
+	default:
+	}
+	if _, ok := r.members[session.AccountID]; ok {
+		return nil, fmt.Errorf("account %d is already in room %s", session.AccountID, r.ID)
+	}
+	m := &Member{
+		Session: session,
+		standing: Standing{
+			Name:          name,
+			AccountID:     session.AccountID,
+			Host:          session.UserID == r.HostID,
+			StartingValue: startingValue,
+			Value:         startingValue,
+		},
+		queue:   newUpdateQueue(DefaultQueueSize, Coalesce),
+		updates: make(chan Update),
+		actions: make(chan Command),
+		left:    make(chan struct{}),
+	}
+	r.members[session.AccountID] = m
+	r.emptySince = time.Time{}
+	r.changed = true
+	go pumpUpdates(m.queue, m.updates, m.left)
+	return m, nil
+}
+
+// Leave takes the member out of the room. The replay is paused when the
+// host leaves, until they join again.
+func (r *Room) Leave(m *Member) {
+	r.Lock()
+	if r.members[m.Session.AccountID] != m {
+		r.Unlock()
+		return
+	}
+	delete(r.members, m.Session.AccountID)
+	close(m.left)
+	r.changed = true
+	if len(r.members) == 0 {
+		r.emptySince = r.clock.Now()
+	}
+	r.Unlock()
+
+	if m.standing.Host {
+		r.Replayer.Pause()
+	}
+}
+
+// SetValue updates the account's net liquidation value on the leaderboard.
+func (r *Room) SetValue(accountID uint, value float64) {
+	r.Lock()
+	defer r.Unlock()
+	m, ok := r.members[accountID]
+	if !ok || m.standing.Value == value {
+		return
+	}
+	m.standing.Value = value
+	m.standing.PnL = value - m.standing.StartingValue
+	r.changed = true
+}
+
+// Act passes a command on to every member's account, as with Member.Act.
+func (r *Room) Act(cmd Command) {
+	r.Lock()
+	members := make([]*Member, 0, len(r.members))
+	for _, m := range r.members {
+		members = append(members, m)
+	}
+	r.Unlock()
+
+	for _, m := range members {
+		m.Act(cmd)
+	}
+}
+
+// DropUpdates throws away the bars the replay and every member haven't
+// taken yet, as with Replayer.DropUpdates.
+func (r *Room) DropUpdates() {
+	r.Replayer.DropUpdates()
+	r.Lock()
+	defer r.Unlock()
+	for _, m := range r.members {
+		m.queue.clear()
+	}
+}
+
+// Done is closed once the room is.
+func (r *Room) Done() <-chan struct{} {
+	return r.done
+}
+
+// Close stops the replay and closes every member's session.
+func (r *Room) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.Replayer.Close()
+		r.Lock()
+		members := r.members
+		r.members = make(map[uint]*Member)
+		for _, m := range members {
+			close(m.left)
+		}
+		r.Unlock()
+		for _, m := range members {
+			m.Session.Close()
+		}
+	})
+}
+
+// Reports whether the room has been empty since before the given time.
+func (r *Room) emptyBefore(t time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+	return !r.emptySince.IsZero() && r.emptySince.Before(t)
+}
+
+// Updates is where the room's bars come out for the member. It's closed
+// once they leave.
+func (m *Member) Updates() <-chan Update {
+	return m.updates
+}
+
+// Actions is where commands for the member's account come out, from them
+// or from the room.
+func (m *Member) Actions() <-chan Command {
+	return m.actions
+}
+
+// Left is closed once the member leaves the room.
+func (m *Member) Left() <-chan struct{} {
+	return m.left
+}
+
+// Act passes a command on to whoever simulates the member's account,
+// unless they've left.
+func (m *Member) Act(cmd Command) {
+	select {
+	case m.actions <- cmd:
+	case <-m.left:
+	}
+}
+
+// Rooms holds the rooms open on the server.
+type Rooms struct {
+	sync.Mutex
+	rooms      map[string]*Room
+	idlePeriod time.Duration
+}
+
+func NewRooms(idlePeriod time.Duration) *Rooms {
+	return &Rooms{
+		rooms:      make(map[string]*Room),
+		idlePeriod: idlePeriod,
+	}
+}
+
+// Create opens a room, as with NewRoom.
+func (m *Rooms) Create(name string, hostID, symbolID uint, replayer *Replayer, clock Clock) (*Room, error) {
+	room, err := NewRoom(name, hostID, symbolID, replayer, clock)
+	if err != nil {
+		return nil, err
+	}
+	m.Lock()
+	m.rooms[room.ID] = room
+	m.Unlock()
+	return room, nil
+}
+
+// Get returns the room with the given ID, if it's still open.
+func (m *Rooms) Get(id string) (*Room, bool) {
+	m.Lock()
+	room, ok := m.rooms[id]
+	m.Unlock()
+	if !ok {
+		return nil, false
+	}
+	select {
+	case <-room.Done():
+		return nil, false
+	default:
+		return room, true
+	}
+}
+
+// List describes the open rooms, by name.
+func (m *Rooms) List() []RoomInfo {
+	m.Lock()
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	m.Unlock()
+
+	infos := make([]RoomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		select {
+		case <-room.Done():
+			continue
+		default:
+		}
+		infos = append(infos, room.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Name != infos[j].Name {
+			return infos[i].Name < infos[j].Name
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Reap closes the rooms that have been empty for longer than the idle
+// period before now, and returns how many it closed. Rooms closed some
+// other way are let go of too.
+func (m *Rooms) Reap(now time.Time) int {
+	m.Lock()
+	var idle []*Room
+	for id, room := range m.rooms {
+		select {
+		case <-room.Done():
+			delete(m.rooms, id)
+			continue
+		default:
+		}
+		if room.emptyBefore(now.Add(-m.idlePeriod)) {
+			idle = append(idle, room)
+			delete(m.rooms, id)
+		}
+	}
+	m.Unlock()
+
+	for _, room := range idle {
+		room.Close()
+	}
+	return len(idle)
+}
+
+// RunReaper reaps idle rooms every interval, forever.
+func (m *Rooms) RunReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n := m.Reap(time.Now()); n > 0 {
+			fmt.Printf("reaped %d idle replay rooms\n", n)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package replay
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+)
+
+// Waits for the websocket to be sent a leaderboard, returning the account
+// IDs on it in order.
+func nextLeaderboard(t *testing.T, conn *testConn, seen int) ([]uint, int) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		frames, written := conn.nextWrite()
+		for i := seen; i < len(frames); i++ {
+			if frames[i].Type != MessageLeaderboard {
+				continue
+			}
+			payload, _ := frames[i].Payload.(map[string]interface{})
+			standings, _ := payload["standings"].([]interface{})
+			var accountIDs []uint
+			for _, standing := range standings {
+				accountID, _ := standing.(map[string]interface{})["accountID"].(float64)
+				accountIDs = append(accountIDs, uint(accountID))
+			}
+			return accountIDs, i + 1
+		}
+		seen = len(frames)
+		select {
+		case <-written:
+		case <-timeout:
+			t.Fatalf("no leaderboard sent after frame %d", seen)
+			return nil, seen
+		}
+	}
+}
+
+func TestRoom_SharesBarsAndRanksMembers(t *testing.T) {
+	start := time.Date(2023, 11, 6, 9, 30, 0, 0, time.UTC)
+	clock := NewFakeClock(time.Now())
+	replayer := NewReplayer([]uint{1}, start.UnixMilli(), testBarData{1: testMinuteBars(start)}, ReplayerConfig{Clock: clock})
+	room, err := NewRoom("Open drive", 1, 1, replayer, clock)
+	if err != nil {
+		t.Fatalf("NewRoom() error = %v, wantErr %v", err, false)
+	}
+	defer room.Close()
+
+	var members []*Member
+	var conns []*testConn
+	for i, accountID := range []uint{10, 20} {
+		session, _ := NewSession(uint(i+1), accountID, nil, MemberCommands, handleNothing)
+		conn := &testConn{}
+		if err := session.Attach(conn, 0); err != nil {
+			t.Fatalf("Attach() error = %v, wantErr %v", err, false)
+		}
+		member, err := room.Join(session, fmt.Sprintf("trader %d", i+1), 1000)
+		if err != nil {
+			t.Fatalf("Join() error = %v, wantErr %v", err, false)
+		}
+		members = append(members, member)
+		conns = append(conns, conn)
+	}
+	again, _ := NewSession(2, 20, nil, MemberCommands, handleNothing)
+	if _, err := room.Join(again, "trader 2", 1000); err == nil {
+		t.Errorf("Join() error = %v, want the account already in the room", err)
+	}
+
+	oneMinute := bars.Timeframe{Value: 1, Unit: "m"}
+	replayer.Play(oneMinute, oneMinute, 1, false)
+	replayer.SendCommand(NewCommand("speed", &SpeedCommand{Seconds: 1}))
+	clock.Advance(time.Second)
+	for i, member := range members {
+		select {
+		case update := <-member.Updates():
+			if got := update.Bars[1]; len(got) != 1 || got[0].Close != 4501 {
+				t.Errorf("member %d sent %+v, want the bar closing at 4501", i, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("member %d sent nothing", i)
+		}
+	}
+
+	// The joins are ranked first, then the members' P&L once it moves
+	seen := make([]int, len(conns))
+	for i, conn := range conns {
+		_, seen[i] = nextLeaderboard(t, conn, 0)
+	}
+	room.SetValue(10, 900)
+	room.SetValue(20, 1250)
+	clock.Advance(LeaderboardInterval)
+	for i, conn := range conns {
+		var ranked []uint
+		ranked, seen[i] = nextLeaderboard(t, conn, seen[i])
+		if len(ranked) != 2 || ranked[0] != 20 || ranked[1] != 10 {
+			t.Errorf("member %d was sent a leaderboard of %v, want [20 10]", i, ranked)
+		}
+	}
+	if board := room.Leaderboard(); board.Standings[0].PnL != 250 || board.Standings[1].PnL != -100 {
+		t.Errorf("Leaderboard() = %+v, want P&L of 250 and -100", board.Standings)
+	}
+	// The same second played the next bar
+	for i, member := range members {
+		select {
+		case update := <-member.Updates():
+			if got := update.Bars[1]; len(got) != 1 || got[0].Close != 4502 {
+				t.Errorf("member %d sent %+v, want the bar closing at 4502", i, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("member %d sent nothing", i)
+		}
+	}
+
+	// The host leaving pauses the replay for everyone
+	room.Leave(members[0])
+	if room.HasMember(10) {
+		t.Errorf("HasMember(10) = true after leaving")
+	}
+	clock.Advance(5 * time.Second)
+	if _, ok := <-members[0].Updates(); ok {
+		t.Errorf("Updates() still open after leaving")
+	}
+	date := replayer.CurrentDate()
+	clock.Advance(5 * time.Second)
+	if !replayer.CurrentDate().Equal(date) {
+		t.Errorf("CurrentDate() = %v, want the replay paused at %v", replayer.CurrentDate(), date)
+	}
+}
+
+func TestRooms_ReapsEmptyRooms(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	rooms := NewRooms(time.Minute)
+	room, err := rooms.Create("Open drive", 1, 1, NewReplayer(nil, 0, nil, ReplayerConfig{Clock: clock}), clock)
+	if err != nil {
+		t.Fatalf("Create() error = %v, wantErr %v", err, false)
+	}
+	if infos := rooms.List(); len(infos) != 1 || infos[0].ID != room.ID {
+		t.Errorf("List() = %+v, want the room", infos)
+	}
+	if n := rooms.Reap(clock.Now()); n != 0 {
+		t.Errorf("Reap() = %d, want the room kept while it's new", n)
+	}
+	if n := rooms.Reap(clock.Now().Add(2 * time.Minute)); n != 1 {
+		t.Fatalf("Reap() = %d, want the empty room reaped", n)
+	}
+	if _, ok := rooms.Get(room.ID); ok {
+		t.Errorf("Get() found the reaped room")
+	}
+	select {
+	case <-room.Done():
+	default:
+		t.Errorf("Done() not closed after reaping")
+	}
+}
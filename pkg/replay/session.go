@@ -0,0 +1,372 @@
+package replay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// SessionGracePeriod is how long a session is kept after its websocket
+	// drops, waiting for the client to attach again.
+	SessionGracePeriod = 2 * time.Minute
+
+	// MaxUnacked is how many sent messages a session keeps for the client to
+	// acknowledge. Older ones are dropped, and a client that hasn't seen them
+	// can no longer resume.
+	MaxUnacked = 5000
+)
+
+// Conn is what a session writes its messages to, a websocket in practice.
+type Conn interface {
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+type sentMessage struct {
+	seq  uint64
+	data []byte
+}
+
+// Session keeps a replay running on the server between websockets. When
+// the websocket drops the replay is paused, and the client has the grace
+// period to attach a new one and pick up after the last message it saw.
+// Messages are numbered so the client can acknowledge them.
+type Session struct {
+	sync.Mutex
+	ID         string
+	UserID     uint
+	AccountID  uint
+	Replayer   *Replayer // Nil for sessions in a room, which owns the replay
+	commands   map[string]struct{}
+	handle     func(Command) error
+	resumable  bool // Only sessions held by Sessions can be resumed
+	conn       Conn
+	seq        uint64
+	unacked    []sentMessage
+	detachedAt time.Time // Zero while a websocket is attached
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewSession starts a session for the replay of an account, taking the
+// given commands, which handle carries out.
+func NewSession(userID, accountID uint, replayer *Replayer, commands []string, handle func(Command) error) (*Session, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{
+		ID:        id,
+		UserID:    userID,
+		AccountID: accountID,
+		Replayer:  replayer,
+		commands:  make(map[string]struct{}),
+		handle:    handle,
+		done:      make(chan struct{}),
+	}
+	for _, cmd := range commands {
+		session.commands[cmd] = struct{}{}
+	}
+	return session, nil
+}
+
+// Send wraps the payload in a numbered envelope, keeps it until it's
+// acknowledged and writes it to the websocket, if one is attached.
+func (s *Session) Send(msgType string, payload interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	s.seq++
+	data, err := json.Marshal(Envelope{
+		Version: ProtocolVersion,
+		Type:    msgType,
+		Seq:     s.seq,
+		Payload: payload,
+	})
+	if err != nil {
+		fmt.Printf("error marshaling message %d of session %s: %v\n", s.seq, s.ID, err)
+		return
+	}
+	s.unacked = append(s.unacked, sentMessage{seq: s.seq, data: data})
+	if len(s.unacked) > MaxUnacked {
+		s.unacked = s.unacked[len(s.unacked)-MaxUnacked:]
+	}
+	if s.conn != nil {
+		if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			fmt.Printf("error writing message %d of session %s: %v\n", s.seq, s.ID, err)
+		}
+	}
+}
+
+// SendError tells the client a command wasn't carried out.
+func (s *Session) SendError(cmd, code string, err error) {
+	s.Send(MessageError, ErrorFrame{Cmd: cmd, Code: code, Message: err.Error()})
+}
+
+// SendHello starts a websocket off with the handshake.
+func (s *Session) SendHello(resumed bool) {
+	hello := Hello{
+		Version:          ProtocolVersion,
+		Resumed:          resumed,
+		Capabilities:     []string{"ack", "heartbeat", "frames"},
+		HeartbeatSeconds: int(HeartbeatInterval / time.Second),
+	}
+	if s.resumable {
+		hello.SessionID = s.ID
+		hello.Capabilities = append(hello.Capabilities, "resume")
+	}
+	for _, cmd := range append(append([]string{}, ReplayCommands...), AccountCommands...) {
+		if _, ok := s.commands[cmd]; ok {
+			hello.Commands = append(hello.Commands, cmd)
+		}
+	}
+	s.Send(MessageHello, hello)
+}
+
+// Ack lets go of the messages up to and including seq.
+func (s *Session) Ack(seq uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.ack(seq)
+}
+
+// The lock needs to be held.
+func (s *Session) ack(seq uint64) {
+	i := 0
+	for i < len(s.unacked) && s.unacked[i].seq <= seq {
+		i++
+	}
+	s.unacked = s.unacked[i:]
+}
+
+// Resumable checks the client can carry on from lastSeq, the last message
+// it saw.
+func (s *Session) Resumable(lastSeq uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.checkResumable(lastSeq)
+}
+
+// The lock needs to be held.
+func (s *Session) checkResumable(lastSeq uint64) error {
+	if lastSeq > s.seq {
+		return fmt.Errorf("message %d hasn't been sent yet", lastSeq)
+	}
+	if len(s.unacked) > 0 && s.unacked[0].seq > lastSeq+1 {
+		return fmt.Errorf("messages after %d are no longer kept", lastSeq)
+	}
+	if len(s.unacked) == 0 && lastSeq < s.seq {
+		return fmt.Errorf("messages after %d were acknowledged", lastSeq)
+	}
+	return nil
+}
+
+// Attach makes conn the session's websocket, sending it the messages after
+// lastSeq first. Any websocket already attached is closed.
+func (s *Session) Attach(conn Conn, lastSeq uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-s.done:
+		return fmt.Errorf("session %s is closed", s.ID)
+	default:
+	}
+	if err := s.checkResumable(lastSeq); err != nil {
+		return err
+	}
+	s.ack(lastSeq)
+	for _, msg := range s.unacked {
+		if err := conn.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+			return err
+		}
+	}
+	if s.conn != nil && s.conn != conn {
+		s.conn.Close()
+	}
+	s.conn = conn
+	s.detachedAt = time.Time{}
+	return nil
+}
+
+// Detach pauses the replay after its websocket has dropped. It does nothing
+// if another websocket has been attached since.
+func (s *Session) Detach(conn Conn) {
+	s.Lock()
+	if s.conn != conn {
+		s.Unlock()
+		return
+	}
+	s.conn = nil
+	s.detachedAt = time.Now()
+	s.Unlock()
+	// Pausing can wait on bars being sent, which needs the lock
+	select {
+	case <-s.done:
+	default:
+		if s.Replayer != nil {
+			s.Replayer.Pause()
+		}
+	}
+}
+
+// Handle runs a command from the client, answering with an error frame if
+// it isn't carried out.
+func (s *Session) Handle(cmd Command) {
+	if _, ok := s.commands[cmd.Cmd]; !ok {
+		s.SendError(cmd.Cmd, ErrorUnsupported, fmt.Errorf("%s isn't taken here", cmd.Cmd))
+		return
+	}
+	switch c := cmd.GetPayload().(type) {
+	case *AckCommand:
+		s.Ack(c.Seq)
+		return
+	case *PingCommand:
+		s.Send(MessagePong, nil)
+		return
+	case interface{ Valid() error }:
+		if err := c.Valid(); err != nil {
+			s.SendError(cmd.Cmd, ErrorInvalid, err)
+			return
+		}
+	}
+	if err := s.handle(cmd); err != nil {
+		s.SendError(cmd.Cmd, ErrorFailed, err)
+	}
+}
+
+// Done is closed once the session is.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops the replay and closes the websocket, if one is attached.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		if s.Replayer != nil {
+			s.Replayer.Close()
+		}
+		close(s.done)
+		s.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		s.Unlock()
+	})
+}
+
+// Reports whether the session has been without a websocket since before
+// the given time.
+func (s *Session) detachedBefore(t time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	return !s.detachedAt.IsZero() && s.detachedAt.Before(t)
+}
+
+// Sessions holds the replay sessions running on the server.
+type Sessions struct {
+	sync.Mutex
+	sessions    map[string]*Session
+	gracePeriod time.Duration
+}
+
+func NewSessions(gracePeriod time.Duration) *Sessions {
+	return &Sessions{
+		sessions:    make(map[string]*Session),
+		gracePeriod: gracePeriod,
+	}
+}
+
+// Create starts a session that can be resumed, as with NewSession. Any
+// other session replaying the account is closed, so there's only ever one
+// simulating it.
+func (m *Sessions) Create(userID, accountID uint, replayer *Replayer, commands []string, handle func(Command) error) (*Session, error) {
+	session, err := NewSession(userID, accountID, replayer, commands, handle)
+	if err != nil {
+		return nil, err
+	}
+	session.resumable = true
+
+	m.Lock()
+	replaced := m.removeAccount(accountID)
+	m.sessions[session.ID] = session
+	m.Unlock()
+
+	for _, other := range replaced {
+		other.Close()
+	}
+	return session, nil
+}
+
+// CloseAccount closes the session replaying the account, if there is one.
+func (m *Sessions) CloseAccount(accountID uint) {
+	m.Lock()
+	closed := m.removeAccount(accountID)
+	m.Unlock()
+
+	for _, session := range closed {
+		session.Close()
+	}
+}
+
+// The lock needs to be held.
+func (m *Sessions) removeAccount(accountID uint) []*Session {
+	var removed []*Session
+	for id, session := range m.sessions {
+		if session.AccountID == accountID {
+			removed = append(removed, session)
+			delete(m.sessions, id)
+		}
+	}
+	return removed
+}
+
+// Get returns the session with the given ID, if it's still running.
+func (m *Sessions) Get(id string) (*Session, bool) {
+	m.Lock()
+	defer m.Unlock()
+	session, ok := m.sessions[id]
+	return session, ok
+}
+
+// Reap closes the sessions whose websocket dropped longer than the grace
+// period before now, and returns how many it closed.
+func (m *Sessions) Reap(now time.Time) int {
+	m.Lock()
+	var idle []*Session
+	for id, session := range m.sessions {
+		if session.detachedBefore(now.Add(-m.gracePeriod)) {
+			idle = append(idle, session)
+			delete(m.sessions, id)
+		}
+	}
+	m.Unlock()
+
+	for _, session := range idle {
+		session.Close()
+	}
+	return len(idle)
+}
+
+// RunReaper reaps idle sessions every interval, forever.
+func (m *Sessions) RunReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		if n := m.Reap(time.Now()); n > 0 {
+			fmt.Printf("reaped %d idle replay sessions\n", n)
+		}
+	}
+}
+
+// Makes a random ID for a session or room.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,182 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+)
+
+type testConn struct {
+	sync.Mutex
+	seqs    []uint64
+	frames  []Envelope
+	closed  bool
+	written chan struct{} // Closed on the next write, if anything waits for it
+}
+
+func (c *testConn) WriteMessage(messageType int, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	var msg Envelope
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	c.seqs = append(c.seqs, msg.Seq)
+	c.frames = append(c.frames, msg)
+	if c.written != nil {
+		close(c.written)
+		c.written = nil
+	}
+	return nil
+}
+
+// Returns the frames written so far, and a channel closed on the next write.
+func (c *testConn) nextWrite() ([]Envelope, <-chan struct{}) {
+	c.Lock()
+	defer c.Unlock()
+	if c.written == nil {
+		c.written = make(chan struct{})
+	}
+	return append([]Envelope{}, c.frames...), c.written
+}
+
+func (c *testConn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	return nil
+}
+
+func handleNothing(Command) error {
+	return nil
+}
+
+func TestSession_Resume(t *testing.T) {
+	sessions := NewSessions(time.Minute)
+	replayer := NewReplayer(nil, 0, nil, ReplayerConfig{})
+	session, err := sessions.Create(1, 2, replayer, ReplayCommands, handleNothing)
+	if err != nil {
+		t.Fatalf("Create() error = %v, wantErr %v", err, false)
+	}
+	first := &testConn{}
+	if err := session.Attach(first, 0); err != nil {
+		t.Fatalf("Attach() error = %v, wantErr %v", err, false)
+	}
+	for i := 0; i < 3; i++ {
+		session.Send(MessageData, nil)
+	}
+	if len(first.seqs) != 3 || first.seqs[2] != 3 {
+		t.Fatalf("Send() wrote %v, want messages 1 to 3", first.seqs)
+	}
+
+	// The client saw up to 3 but only acknowledged 1 before dropping
+	session.Handle(NewCommand("ack", &AckCommand{Seq: 1}))
+	session.Detach(first)
+	session.Send(MessageData, nil)
+	if len(first.seqs) != 3 {
+		t.Errorf("Send() wrote %v after detaching, want nothing more", first.seqs)
+	}
+	if err := session.Resumable(0); err == nil {
+		t.Errorf("Resumable(0) error = %v, want the acknowledged message gone", err)
+	}
+	if err := session.Resumable(5); err == nil {
+		t.Errorf("Resumable(5) error = %v, want it not sent yet", err)
+	}
+
+	second := &testConn{}
+	if err := session.Attach(second, 3); err != nil {
+		t.Fatalf("Attach() error = %v, wantErr %v", err, false)
+	}
+	session.Send(MessageData, nil)
+	if len(second.seqs) != 2 || second.seqs[0] != 4 || second.seqs[1] != 5 {
+		t.Errorf("Attach() resent %v, want messages 4 and 5 only", second.seqs)
+	}
+
+	// Only sessions detached for longer than the grace period are reaped
+	session.Detach(second)
+	if n := sessions.Reap(time.Now()); n != 0 {
+		t.Errorf("Reap() = %d, want the session kept during its grace period", n)
+	}
+	if n := sessions.Reap(time.Now().Add(2 * time.Minute)); n != 1 {
+		t.Fatalf("Reap() = %d, want the idle session reaped", n)
+	}
+	if _, ok := sessions.Get(session.ID); ok {
+		t.Errorf("Get() found the reaped session")
+	}
+	select {
+	case <-session.Done():
+	default:
+		t.Errorf("Done() not closed after reaping")
+	}
+}
+
+func TestSessions_CreateReplacesAccountSession(t *testing.T) {
+	sessions := NewSessions(time.Minute)
+	old, _ := sessions.Create(1, 2, NewReplayer(nil, 0, nil, ReplayerConfig{}), ReplayCommands, handleNothing)
+	conn := &testConn{}
+	if err := old.Attach(conn, 0); err != nil {
+		t.Fatalf("Attach() error = %v, wantErr %v", err, false)
+	}
+	other, _ := sessions.Create(1, 3, NewReplayer(nil, 0, nil, ReplayerConfig{}), ReplayCommands, handleNothing)
+	replacement, _ := sessions.Create(1, 2, NewReplayer(nil, 0, nil, ReplayerConfig{}), ReplayCommands, handleNothing)
+
+	if _, ok := sessions.Get(old.ID); ok || !conn.closed {
+		t.Errorf("Create() left the account's old session running")
+	}
+	for _, session := range []*Session{other, replacement} {
+		if _, ok := sessions.Get(session.ID); !ok {
+			t.Errorf("Get(%s) found nothing, want the session", session.ID)
+		}
+		session.Close()
+	}
+}
+
+func TestSession_Handle(t *testing.T) {
+	handled := 0
+	session, err := NewSession(1, 0, NewReplayer(nil, 0, nil, ReplayerConfig{}), ReplayCommands, func(Command) error {
+		handled++
+		return fmt.Errorf("no bars")
+	})
+	if err != nil {
+		t.Fatalf("NewSession() error = %v, wantErr %v", err, false)
+	}
+	defer session.Close()
+	conn := &testConn{}
+	if err := session.Attach(conn, 0); err != nil {
+		t.Fatalf("Attach() error = %v, wantErr %v", err, false)
+	}
+
+	session.SendHello(false)
+	hello, _ := conn.frames[0].Payload.(map[string]interface{})
+	if conn.frames[0].Type != MessageHello || conn.frames[0].Version != ProtocolVersion || hello["sessionID"] != nil {
+		t.Errorf("SendHello() sent %+v, want a hello without a session to resume", conn.frames[0])
+	}
+
+	session.Handle(NewCommand("flatten", &FlattenCommand{}))
+	session.Handle(NewCommand("play", &PlayCommand{Frame: bars.Timeframe{Value: 1, Unit: "m"}}))
+	session.Handle(NewCommand("ping", &PingCommand{}))
+	session.Handle(NewCommand("pause", &PauseCommand{}))
+	if handled != 1 {
+		t.Errorf("Handle() passed on %d commands, want only the pause", handled)
+	}
+	want := []struct{ msgType, code string }{
+		{MessageError, ErrorUnsupported},
+		{MessageError, ErrorInvalid},
+		{MessagePong, ""},
+		{MessageError, ErrorFailed},
+	}
+	frames := conn.frames[1:]
+	if len(frames) != len(want) {
+		t.Fatalf("Handle() sent %+v, want %d frames", frames, len(want))
+	}
+	for i, frame := range frames {
+		payload, _ := frame.Payload.(map[string]interface{})
+		if frame.Type != want[i].msgType || (want[i].code != "" && payload["code"] != want[i].code) {
+			t.Errorf("Handle() frame %d = %+v, want a %s %s", i, frame, want[i].code, want[i].msgType)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package simulate
+
+import (
+	"fmt"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+
+	"gorm.io/gorm"
+)
+
+var (
+	SlippageModels = map[string]struct{}{
+		"":           {},
+		"none":       {},
+		"ticks":      {},
+		"volatility": {},
+	}
+)
+
+// A CostModel decides how much a fill costs on top of its price.
+type CostModel interface {
+	// Fees returns the total commission and exchange fees in dollars
+	// charged for filling the given quantity of the order.
+	Fees(order database.Order, quantity int) (float64, float64)
+	// Slippage returns how many price points the fill should be moved
+	// against the order within the given bar.
+	Slippage(bar bars.Bar, order database.Order) float64
+}
+
+type noCosts struct{}
+
+// NoCosts fills every order at its price and never charges fees.
+var NoCosts CostModel = noCosts{}
+
+func (noCosts) Fees(database.Order, int) (float64, float64) {
+	return 0, 0
+}
+
+func (noCosts) Slippage(bars.Bar, database.Order) float64 {
+	return 0
+}
+
+// ScheduleCostModel applies an account's cost settings, falling back from the
+// symbol's own setting to the account default.
+type ScheduleCostModel struct {
+	bySymbol map[uint]database.CostSetting
+}
+
+func NewScheduleCostModel(settings []database.CostSetting) *ScheduleCostModel {
+	m := &ScheduleCostModel{
+		bySymbol: make(map[uint]database.CostSetting),
+	}
+	for _, setting := range settings {
+		m.bySymbol[setting.SymbolID] = setting
+	}
+	return m
+}
+
+// LoadCostModel builds the cost model for an account from its saved settings.
+func LoadCostModel(db *gorm.DB, accountID uint) (CostModel, error) {
+	settings, err := database.GetCostSettingsForAccount(db, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("database.GetCostSettingsForAccount: %w", err)
+	}
+	if len(settings) == 0 {
+		return NoCosts, nil
+	}
+	return NewScheduleCostModel(settings), nil
+}
+
+func (m *ScheduleCostModel) settingFor(symbolID uint) database.CostSetting {
+	if setting, ok := m.bySymbol[symbolID]; ok {
+		return setting
+	}
+	return m.bySymbol[0]
+}
+
+func (m *ScheduleCostModel) Fees(order database.Order, quantity int) (float64, float64) {
+	setting := m.settingFor(order.SymbolID)
+	return setting.CommissionPerContract * float64(quantity), setting.ExchangeFeePerContract * float64(quantity)
+}
+
+func (m *ScheduleCostModel) Slippage(bar bars.Bar, order database.Order) float64 {
+	// Limit orders never fill worse than their price
+	if order.OrderType != "market" && order.OrderType != "stop" && order.OrderType != "trailing-stop" {
+		return 0
+	}
+	setting := m.settingFor(order.SymbolID)
+	var slippage float64
+	switch setting.SlippageModel {
+	case "ticks":
+		slippage = setting.SlippageTicks * contracts.TickSize(order.SymbolID)
+	case "volatility":
+		slippage = setting.SlippageRangeFraction * (bar.High - bar.Low)
+	}
+	// Slip by whole ticks so the fill stays on a price that can trade
+	return contracts.RoundToTick(order.SymbolID, slippage)
+}
+
+// Moves the fill price against the order by the given slippage.
+func applySlippage(direction string, price, slippage float64) float64 {
+	if direction == "buy" {
+		return price + slippage
+	}
+	return price - slippage
+}
@@ -0,0 +1,113 @@
+package simulate
+
+import (
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+// PositionEquity is an open position valued at its symbol's last mark.
+type PositionEquity struct {
+	SymbolID      uint    `json:"symbolID"`
+	Direction     string  `json:"direction"`
+	Quantity      int     `json:"quantity"`
+	Price         float64 `json:"price"`
+	MarkPrice     float64 `json:"markPrice"`
+	UnrealizedPnL float64 `json:"unrealizedPnL"`
+	DayPnL        float64 `json:"dayPnL"`
+}
+
+// AccountEquity is the mark-to-market value of an account. Day P&L is
+// measured from the first mark of the trading day.
+type AccountEquity struct {
+	Cash                float64          `json:"cash"`
+	UnrealizedPnL       float64          `json:"unrealizedPnL"`
+	NetLiquidationValue float64          `json:"netLiquidationValue"`
+	DayPnL              float64          `json:"dayPnL"`
+	Positions           []PositionEquity `json:"positions"`
+}
+
+// UpdateMarks sets each symbol's mark to the close of its last real bar.
+func UpdateMarks(marks map[uint]float64, barsBySymbol map[uint][]bars.Bar) {
+	for symbolID, symbolBars := range barsBySymbol {
+		for i := len(symbolBars) - 1; i >= 0; i-- {
+			// Placeholder bars from the replayer carry no prices
+			if symbolBars[i].Volume >= 0 {
+				marks[symbolID] = symbolBars[i].Close
+				break
+			}
+		}
+	}
+}
+
+// FillMissingMarks looks up the last price of any position's symbol that
+// doesn't have a mark yet.
+func FillMissingMarks(marks map[uint]float64, barData bars.BarData, date time.Time, positions []database.Position) error {
+	var missing []uint
+	for _, position := range positions {
+		if _, ok := marks[position.SymbolID]; !ok {
+			missing = append(missing, position.SymbolID)
+			marks[position.SymbolID] = position.Price
+		}
+	}
+	lastPrices, err := LastPrices(barData, date, missing)
+	if err != nil {
+		return err
+	}
+	for symbolID, price := range lastPrices {
+		marks[symbolID] = price
+	}
+	return nil
+}
+
+// MarkToMarket values the account and its positions at the given marks and
+// keeps the account's net liquidation value up to date. When the account's
+// date has moved into a new trading day, the account and positions start
+// the day from their current value. Returns whether that happened, in which
+// case the positions need saving as well as the account.
+func MarkToMarket(account *database.Account, positions []database.Position, marks map[uint]float64) (AccountEquity, bool) {
+	day := contracts.TradingDay(account.Date)
+	newDay := !day.Equal(account.TradingDay)
+
+	equity := AccountEquity{
+		Cash:      account.RealizedPnL,
+		Positions: make([]PositionEquity, 0, len(positions)),
+	}
+	for i, position := range positions {
+		mark, ok := marks[position.SymbolID]
+		if !ok {
+			mark = position.Price
+		}
+		if newDay {
+			positions[i].DayPrice = mark
+		}
+		dayPrice := positions[i].DayPrice
+		if dayPrice == 0 {
+			dayPrice = position.Price
+		}
+		pointValue := contracts.PointValue(position.SymbolID)
+		value := PositionEquity{
+			SymbolID:      position.SymbolID,
+			Direction:     position.Direction,
+			Quantity:      position.Quantity,
+			Price:         position.Price,
+			MarkPrice:     mark,
+			UnrealizedPnL: calculatePnl(position.Direction, position.Price, mark, position.Quantity) * pointValue,
+			DayPnL:        calculatePnl(position.Direction, dayPrice, mark, position.Quantity) * pointValue,
+		}
+		equity.UnrealizedPnL += value.UnrealizedPnL
+		equity.Positions = append(equity.Positions, value)
+	}
+	equity.NetLiquidationValue = equity.Cash + equity.UnrealizedPnL
+
+	if newDay {
+		account.TradingDay = day
+		account.DayStartValue = equity.NetLiquidationValue
+	}
+	account.NetLiquidationValue = equity.NetLiquidationValue
+	equity.DayPnL = equity.NetLiquidationValue - account.DayStartValue
+
+	return equity, newDay
+}
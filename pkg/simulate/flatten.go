@@ -0,0 +1,115 @@
+package simulate
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+// FlattenOrders returns market orders placed at the given time that close
+// every position. Like any market order they fill at the next bar's open.
+func FlattenOrders(positions []database.Position, t time.Time) []database.Order {
+	net := make(map[uint]int)
+	accountIDs := make(map[uint]uint)
+	symbolIDs := []uint{}
+	for _, position := range positions {
+		if _, ok := net[position.SymbolID]; !ok {
+			symbolIDs = append(symbolIDs, position.SymbolID)
+		}
+		net[position.SymbolID] += signedQuantity(position.Direction, position.Quantity)
+		accountIDs[position.SymbolID] = position.AccountID
+	}
+	sort.Slice(symbolIDs, func(i, j int) bool {
+		return symbolIDs[i] < symbolIDs[j]
+	})
+
+	var orders []database.Order
+	for _, symbolID := range symbolIDs {
+		if net[symbolID] != 0 {
+			orders = append(orders, closingOrder(accountIDs[symbolID], symbolID, net[symbolID], t))
+		}
+	}
+	return orders
+}
+
+// FillAtLastPrices fills market orders straight away at their symbol's last
+// price instead of waiting for the next bar. Other orders, and orders for
+// symbols without a last price, are left working. Returns the orders, the
+// positions afterwards and the cash made, net of fees.
+func FillAtLastPrices(
+	orders []database.Order,
+	positions []database.Position,
+	lastPrices map[uint]float64,
+	cfg Config,
+	t time.Time,
+) ([]database.Order, []database.Position, float64) {
+	cfg = cfg.withDefaults()
+
+	sims := make(map[uint]*symbolSimulation)
+	getSim := func(symbolID uint) *symbolSimulation {
+		if sim, ok := sims[symbolID]; ok {
+			return sim
+		}
+		var symPositions []database.Position
+		for _, position := range positions {
+			if position.SymbolID == symbolID {
+				symPositions = append(symPositions, position)
+			}
+		}
+		sims[symbolID] = newSymbolSimulation(symbolID, nil, nil, symPositions, cfg)
+		return sims[symbolID]
+	}
+	for _, position := range positions {
+		getSim(position.SymbolID)
+	}
+
+	retOrders := make([]database.Order, 0, len(orders))
+	for _, order := range orders {
+		price, ok := lastPrices[order.SymbolID]
+		if !ok || order.OrderType != "market" || !isWorking(order) {
+			retOrders = append(retOrders, order)
+			continue
+		}
+		sim := getSim(order.SymbolID)
+		sim.orders = append(sim.orders, order)
+		j := len(sim.orders) - 1
+		sim.fill(j, order.RemainingQuantity(), contracts.RoundToTick(order.SymbolID, price), 0, t)
+		sim.orders[j].FulfilledAt = &t
+		retOrders = append(retOrders, sim.orders[j])
+	}
+
+	symbolIDs := make([]uint, 0, len(sims))
+	for symbolID := range sims {
+		symbolIDs = append(symbolIDs, symbolID)
+	}
+	sort.Slice(symbolIDs, func(i, j int) bool {
+		return symbolIDs[i] < symbolIDs[j]
+	})
+	retPositions := []database.Position{}
+	var cash float64
+	for _, symbolID := range symbolIDs {
+		retPositions = append(retPositions, sims[symbolID].positions...)
+		cash += sims[symbolID].cash()
+	}
+	return retOrders, retPositions, cash
+}
+
+// Returns a market order that closes a net position of the given size.
+func closingOrder(accountID, symbolID uint, net int, t time.Time) database.Order {
+	order := database.Order{
+		AccountID:   accountID,
+		SymbolID:    symbolID,
+		Direction:   "sell",
+		Quantity:    net,
+		OrderType:   "market",
+		CreatedAt:   &t,
+		ActivatedAt: &t,
+	}
+	if net < 0 {
+		order.Direction = "buy"
+		order.Quantity = -net
+	}
+	return order
+}
@@ -2,6 +2,7 @@ package simulate
 
 import (
 	"sync"
+	"time"
 
 	"github.com/tradingcage/tradingcage-go/pkg/auth"
 	"github.com/tradingcage/tradingcage-go/pkg/bars"
@@ -17,8 +18,38 @@ func IncDate(
 	barsData bars.BarData,
 	accountID uint,
 	inc string,
-) (database.Account, []database.Order, []database.Order, []database.Position, error) {
+) (database.Account, []database.Order, []database.Order, []database.Position, AccountEquity, error) {
+	return advanceAccount(db, authInfo, barsData, accountID, func(account *database.Account) {
+		account.IncDate(inc)
+	})
+}
+
+// AdvanceTo moves the account forward to the given date, simulating its
+// orders over every bar in between. Dates that aren't after the account's
+// are left alone.
+func AdvanceTo(
+	db *gorm.DB,
+	authInfo *auth.AuthContext,
+	barsData bars.BarData,
+	accountID uint,
+	date time.Time,
+) (database.Account, []database.Order, []database.Order, []database.Position, AccountEquity, error) {
+	return advanceAccount(db, authInfo, barsData, accountID, func(account *database.Account) {
+		if date.After(account.Date) {
+			account.Date = date
+		}
+	})
+}
+
+func advanceAccount(
+	db *gorm.DB,
+	authInfo *auth.AuthContext,
+	barsData bars.BarData,
+	accountID uint,
+	advance func(account *database.Account),
+) (database.Account, []database.Order, []database.Order, []database.Position, AccountEquity, error) {
 	var account database.Account
+	var equity AccountEquity
 	var activeOrders []database.Order
 	var fulfilledOrders []database.Order
 	var newPositions []database.Position
@@ -34,15 +65,20 @@ func IncDate(
 		}
 
 		prevDate := account.Date
-		account.IncDate(inc)
+		advance(&account)
 
 		orders, err := database.GetReadyOrders(db, accountID)
 		if err != nil {
 			return err
 		}
+		positions, err := database.GetPositionsForAccount(db, accountID)
+		if err != nil {
+			return err
+		}
 
-		// Bail early if there are no orders
-		if len(orders) == 0 {
+		// Bail early if there are no orders, or positions that could be margin called
+		if len(orders) == 0 && len(positions) == 0 {
+			equity, _ = MarkToMarket(&account, nil, nil)
 			if err = account.Update(db); err != nil {
 				return err
 			}
@@ -61,11 +97,6 @@ func IncDate(
 			return nil
 		}
 
-		positions, err := database.GetPositionsForAccount(db, accountID)
-		if err != nil {
-			return err
-		}
-
 		// Get all the bars for each symbol ID that we care about
 		barsBetween := struct {
 			sync.Mutex
@@ -77,6 +108,9 @@ func IncDate(
 		for _, order := range orders {
 			symbolIDs[order.SymbolID] = struct{}{}
 		}
+		for _, position := range positions {
+			symbolIDs[position.SymbolID] = struct{}{}
+		}
 		var eg errgroup.Group
 		for symbolID := range symbolIDs {
 			symbolID := symbolID
@@ -101,13 +135,19 @@ func IncDate(
 			return err
 		}
 
+		cfg, err := LoadConfig(db, account, barsData)
+		if err != nil {
+			return err
+		}
+
 		// Simulate the bars
-		didExecute, ord, pos, pnl, err := SimulateBars(barsBetween.m, orders, positions)
+		didExecute, ord, pos, pnl, err := SimulateBars(barsBetween.m, orders, positions, cfg)
 		if err != nil {
 			return err
 		}
 		if didExecute {
 			newPositions = pos
+			positions = pos
 			if err = database.UpdateMultipleOrders(db, ord); err != nil {
 				return err
 			}
@@ -119,10 +159,21 @@ func IncDate(
 			if err != nil {
 				return err
 			}
-			if err = database.ReplacePositionsForAccount(db, accountID, pos); err != nil {
+			account.AddFillCash(pnl)
+		}
+
+		// Mark the positions to the last bars
+		marks := make(map[uint]float64)
+		UpdateMarks(marks, barsBetween.m)
+		if err = FillMissingMarks(marks, barsData, account.Date, positions); err != nil {
+			return err
+		}
+		var newDay bool
+		equity, newDay = MarkToMarket(&account, positions, marks)
+		if didExecute || newDay {
+			if err = database.ReplacePositionsForAccount(db, accountID, positions); err != nil {
 				return err
 			}
-			account.RealizedPnL += pnl
 		}
 		if err = account.Update(db); err != nil {
 			return err
@@ -131,5 +182,5 @@ func IncDate(
 		return nil
 	})
 
-	return account, activeOrders, fulfilledOrders, newPositions, err
+	return account, activeOrders, fulfilledOrders, newPositions, equity, err
 }
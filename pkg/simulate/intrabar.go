@@ -0,0 +1,170 @@
+package simulate
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+var (
+	IntrabarPaths = map[string]struct{}{
+		"":            {},
+		"pessimistic": {},
+		"optimistic":  {},
+		"ohlc":        {},
+		"olhc":        {},
+	}
+)
+
+// An IntrabarResolver decides which of several orders in the same OCO bracket
+// would have filled first when a single bar reaches all of them. The bar
+// covers the time after startDate up to and including its own date.
+type IntrabarResolver interface {
+	First(symbolID uint, startDate int64, bar bars.Bar, orders []database.Order) int
+}
+
+// PathResolver resolves ambiguous fills with a fixed assumption about the
+// path price took inside the bar.
+type PathResolver struct {
+	Path string // "pessimistic" (the default), "optimistic", "ohlc" or "olhc"
+}
+
+func (r PathResolver) First(symbolID uint, startDate int64, bar bars.Bar, orders []database.Order) int {
+	switch r.Path {
+	case "ohlc":
+		return firstAlongPath([]float64{bar.Open, bar.High, bar.Low, bar.Close}, orders)
+	case "olhc":
+		return firstAlongPath([]float64{bar.Open, bar.Low, bar.High, bar.Close}, orders)
+	case "optimistic":
+		return bestOrWorstFill(bar, orders, true)
+	default:
+		return bestOrWorstFill(bar, orders, false)
+	}
+}
+
+// DrillDownResolver replays the bar's one second bars to find out which
+// order was actually reached first, and falls back to another resolver
+// when the second data doesn't settle it.
+type DrillDownResolver struct {
+	BarData  bars.BarData
+	Fallback IntrabarResolver
+}
+
+func (r DrillDownResolver) First(symbolID uint, startDate int64, bar bars.Bar, orders []database.Order) int {
+	secondBars, err := r.BarData.GetBarsBetween(bars.GetBarsBetweenRequest{
+		SymbolID:  symbolID,
+		Timeframe: "1s",
+		StartDate: startDate,
+		EndDate:   bar.Date,
+	})
+	if err != nil {
+		fmt.Printf("error drilling down into bar %d for symbol %d: %s\n", bar.Date, symbolID, err)
+		return r.Fallback.First(symbolID, startDate, bar, orders)
+	}
+	prevDate := startDate
+	for _, secondBar := range secondBars {
+		var hit []int
+		for i, order := range orders {
+			if getOrderPrice(secondBar, order) != -1 {
+				hit = append(hit, i)
+			}
+		}
+		if len(hit) == 1 {
+			return hit[0]
+		}
+		if len(hit) > 1 {
+			// Still ambiguous within a single second
+			subset := make([]database.Order, 0, len(hit))
+			for _, i := range hit {
+				subset = append(subset, orders[i])
+			}
+			return hit[r.Fallback.First(symbolID, prevDate, secondBar, subset)]
+		}
+		prevDate = secondBar.Date
+	}
+	return r.Fallback.First(symbolID, startDate, bar, orders)
+}
+
+// NewIntrabarResolver builds the resolver for an account's settings.
+func NewIntrabarResolver(account database.Account, barData bars.BarData) IntrabarResolver {
+	path := PathResolver{Path: account.IntrabarPath}
+	if account.IntrabarDrillDown && barData != nil {
+		return DrillDownResolver{
+			BarData:  barData,
+			Fallback: path,
+		}
+	}
+	return path
+}
+
+// Picks the order whose fill is best (or worst) for the trader. Fills are
+// compared from the point of view of each order's direction, so a higher
+// sell or a lower buy is better.
+func bestOrWorstFill(bar bars.Bar, orders []database.Order, best bool) int {
+	chosen := 0
+	var chosenValue float64
+	for i, order := range orders {
+		value := getOrderPrice(bar, order)
+		if order.Direction == "buy" {
+			value = -value
+		}
+		if i == 0 || (best && value > chosenValue) || (!best && value < chosenValue) {
+			chosen = i
+			chosenValue = value
+		}
+	}
+	return chosen
+}
+
+// Walks the path one leg at a time and picks the order whose price is
+// reached after the shortest distance.
+func firstAlongPath(path []float64, orders []database.Order) int {
+	chosen := 0
+	chosenDistance := math.Inf(1)
+	for i, order := range orders {
+		distance := distanceAlongPath(path, order)
+		if distance < chosenDistance {
+			chosen = i
+			chosenDistance = distance
+		}
+	}
+	return chosen
+}
+
+func distanceAlongPath(path []float64, order database.Order) float64 {
+	if order.OrderType == "market" {
+		return 0
+	}
+	level, fillsAbove := orderTriggerLevel(order)
+	travelled := float64(0)
+	for k := 0; k < len(path)-1; k++ {
+		from, to := path[k], path[k+1]
+		if (fillsAbove && from >= level) || (!fillsAbove && from <= level) {
+			return travelled
+		}
+		if math.Min(from, to) <= level && level <= math.Max(from, to) {
+			return travelled + math.Abs(level-from)
+		}
+		travelled += math.Abs(to - from)
+	}
+	return math.Inf(1)
+}
+
+// Returns the price that has to trade for the order to fill, and whether
+// it fills when price is at or above that level rather than at or below.
+func orderTriggerLevel(order database.Order) (float64, bool) {
+	isBuy := order.Direction == "buy"
+	switch order.OrderType {
+	case "stop", "trailing-stop":
+		return order.Price, isBuy
+	case "stop-limit":
+		if order.TriggeredAt == nil {
+			return order.Price, isBuy
+		}
+		return order.LimitPrice, !isBuy
+	default:
+		return order.Price, !isBuy
+	}
+}
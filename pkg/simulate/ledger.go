@@ -0,0 +1,187 @@
+package simulate
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+// Projection is an account's cash, working orders and positions rebuilt
+// from its ledger.
+type Projection struct {
+	Cash      float64
+	Orders    []database.Order // Latest state of every order, working or not
+	Positions []database.Position
+}
+
+// LedgerDiscrepancy is somewhere the account's stored state doesn't match
+// what its ledger says it should be.
+type LedgerDiscrepancy struct {
+	Field   string `json:"field"`
+	Stored  string `json:"stored"`
+	Rebuilt string `json:"rebuilt"`
+}
+
+// ProjectLedger replays an account's ledger to work out its state. Fills are
+// matched into positions with the lot matching method they filled with, or
+// the given one for fills that didn't record it. To see the
+// state at an earlier date, append a rewind to that date to the events.
+func ProjectLedger(events []database.LedgerEvent, method string) (Projection, error) {
+	// A rewind undoes whatever happened after the date it went back to
+	var active []database.LedgerEvent
+	for _, event := range events {
+		if event.EventType != "account-rewound" {
+			active = append(active, event)
+			continue
+		}
+		kept := active[:0]
+		for _, earlier := range active {
+			if !earlier.SimulatedAt.After(event.SimulatedAt) {
+				kept = append(kept, earlier)
+			}
+		}
+		active = kept
+	}
+
+	var projection Projection
+	orders := make(map[uint]database.Order)
+	positions := make(map[uint][]database.Position)
+	for _, event := range active {
+		payload, err := event.Decode()
+		if err != nil {
+			return Projection{}, fmt.Errorf("ledger event %d: %w", event.ID, err)
+		}
+		if payload.Order != nil && payload.Order.ID != 0 {
+			orders[payload.Order.ID] = *payload.Order
+		}
+		switch event.EventType {
+		case "cash-adjusted":
+			projection.Cash += event.Amount
+		case "order-filled":
+			fill := payload.Fill
+			if fill == nil {
+				return Projection{}, fmt.Errorf("ledger event %d: fill is missing", event.ID)
+			}
+			projection.Cash += fill.Cash
+			positions[fill.SymbolID], _ = executeOrder(
+				fill.SymbolID,
+				database.Order{AccountID: fill.AccountID, Direction: fill.Direction, Quantity: fill.Quantity},
+				positions[fill.SymbolID],
+				fill.Price,
+				fill.FilledAt,
+				FillLotMatching(*fill, method),
+			)
+		}
+	}
+
+	for _, order := range orders {
+		projection.Orders = append(projection.Orders, order)
+	}
+	sort.Slice(projection.Orders, func(i, j int) bool {
+		return projection.Orders[i].ID < projection.Orders[j].ID
+	})
+	projection.Positions = []database.Position{}
+	for _, symbolPositions := range positions {
+		projection.Positions = append(projection.Positions, symbolPositions...)
+	}
+	sort.Slice(projection.Positions, func(i, j int) bool {
+		return projection.Positions[i].SymbolID < projection.Positions[j].SymbolID
+	})
+	return projection, nil
+}
+
+// VerifyProjection compares an account's stored cash, working orders and
+// positions against its projection.
+func VerifyProjection(projection Projection, cash float64, workingOrders []database.Order, positions []database.Position) []LedgerDiscrepancy {
+	discrepancies := []LedgerDiscrepancy{}
+	if math.Abs(projection.Cash-cash) > 1e-6 {
+		discrepancies = append(discrepancies, LedgerDiscrepancy{
+			Field:   "cash",
+			Stored:  fmt.Sprintf("%.2f", cash),
+			Rebuilt: fmt.Sprintf("%.2f", projection.Cash),
+		})
+	}
+
+	rebuiltOrders := make(map[uint]database.Order)
+	for _, order := range projection.Orders {
+		if isWorking(order) {
+			rebuiltOrders[order.ID] = order
+		}
+	}
+	for _, order := range workingOrders {
+		rebuilt, ok := rebuiltOrders[order.ID]
+		delete(rebuiltOrders, order.ID)
+		if !ok {
+			discrepancies = append(discrepancies, LedgerDiscrepancy{
+				Field:   fmt.Sprintf("orders[%d]", order.ID),
+				Stored:  summarizeOrder(order),
+				Rebuilt: "not working",
+			})
+		} else if summarizeOrder(order) != summarizeOrder(rebuilt) {
+			discrepancies = append(discrepancies, LedgerDiscrepancy{
+				Field:   fmt.Sprintf("orders[%d]", order.ID),
+				Stored:  summarizeOrder(order),
+				Rebuilt: summarizeOrder(rebuilt),
+			})
+		}
+	}
+	for id, rebuilt := range rebuiltOrders {
+		discrepancies = append(discrepancies, LedgerDiscrepancy{
+			Field:   fmt.Sprintf("orders[%d]", id),
+			Stored:  "not working",
+			Rebuilt: summarizeOrder(rebuilt),
+		})
+	}
+
+	stored := summarizePositions(positions)
+	rebuilt := summarizePositions(projection.Positions)
+	for symbolID, summary := range stored {
+		if rebuilt[symbolID] != summary {
+			discrepancies = append(discrepancies, LedgerDiscrepancy{
+				Field:   fmt.Sprintf("positions[%d]", symbolID),
+				Stored:  summary,
+				Rebuilt: rebuilt[symbolID],
+			})
+		}
+	}
+	for symbolID, summary := range rebuilt {
+		if _, ok := stored[symbolID]; !ok {
+			discrepancies = append(discrepancies, LedgerDiscrepancy{
+				Field:   fmt.Sprintf("positions[%d]", symbolID),
+				Rebuilt: summary,
+			})
+		}
+	}
+
+	sort.SliceStable(discrepancies, func(i, j int) bool {
+		return discrepancies[i].Field < discrepancies[j].Field
+	})
+	return discrepancies
+}
+
+// The parts of an order the simulation acts on.
+func summarizeOrder(order database.Order) string {
+	return fmt.Sprintf("%s %s %d/%d @ %g limit %g, active %t",
+		order.Direction, order.OrderType, order.FilledQuantity, order.Quantity,
+		order.Price, order.LimitPrice, order.ActivatedAt != nil)
+}
+
+// Sums up the net position in each symbol.
+func summarizePositions(positions []database.Position) map[uint]string {
+	net := make(map[uint]int)
+	cost := make(map[uint]float64)
+	for _, position := range positions {
+		net[position.SymbolID] += signedQuantity(position.Direction, position.Quantity)
+		cost[position.SymbolID] += position.Price * float64(position.Quantity)
+	}
+	summaries := make(map[uint]string)
+	for symbolID, quantity := range net {
+		if quantity == 0 {
+			continue
+		}
+		summaries[symbolID] = fmt.Sprintf("%d @ %.4f", quantity, cost[symbolID]/math.Abs(float64(quantity)))
+	}
+	return summaries
+}
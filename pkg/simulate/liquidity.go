@@ -0,0 +1,84 @@
+package simulate
+
+import (
+	"math"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+var (
+	LiquidityModels = map[string]struct{}{
+		"":        {},
+		"touch":   {},
+		"through": {},
+		"volume":  {},
+	}
+)
+
+// A LiquidityModel decides how many contracts of a limit order that was
+// reached on a bar actually fill. Market and stop orders always fill in full.
+type LiquidityModel interface {
+	FillableQuantity(bar bars.Bar, order database.Order, remaining int) int
+}
+
+// TouchLiquidity fills the whole order as soon as the bar touches its price.
+type TouchLiquidity struct{}
+
+func (TouchLiquidity) FillableQuantity(bar bars.Bar, order database.Order, remaining int) int {
+	return remaining
+}
+
+// ThroughLiquidity only fills when the bar trades beyond the limit price,
+// since touching it means the order might still have been in the queue.
+type ThroughLiquidity struct{}
+
+func (ThroughLiquidity) FillableQuantity(bar bars.Bar, order database.Order, remaining int) int {
+	if tradedThrough(bar, order) {
+		return remaining
+	}
+	return 0
+}
+
+// VolumeLiquidity fills at most a fraction of the bar's volume, leaving the
+// rest of the order working. Bars that trade through the price still cap
+// the fill at the fraction of volume.
+type VolumeLiquidity struct {
+	Fraction float64
+}
+
+func (l VolumeLiquidity) FillableQuantity(bar bars.Bar, order database.Order, remaining int) int {
+	available := int(math.Floor(bar.Volume * l.Fraction))
+	if available < remaining {
+		return available
+	}
+	return remaining
+}
+
+// NewLiquidityModel builds the liquidity model for an account's settings.
+func NewLiquidityModel(account database.Account) LiquidityModel {
+	switch account.LiquidityModel {
+	case "through":
+		return ThroughLiquidity{}
+	case "volume":
+		return VolumeLiquidity{Fraction: account.LiquidityVolumeFraction}
+	default:
+		return TouchLiquidity{}
+	}
+}
+
+// Whether the bar opened beyond or traded strictly past the order's limit.
+func tradedThrough(bar bars.Bar, order database.Order) bool {
+	price := order.Price
+	if order.OrderType == "stop-limit" {
+		price = order.LimitPrice
+	}
+	if order.Direction == "buy" {
+		return bar.Open < price || bar.Low < price
+	}
+	return bar.Open > price || bar.High > price
+}
+
+func isLimitFill(order database.Order) bool {
+	return order.OrderType == "limit" || (order.OrderType == "stop-limit" && order.TriggeredAt != nil)
+}
@@ -0,0 +1,98 @@
+package simulate
+
+import (
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+var (
+	LotMatchings = map[string]struct{}{
+		"":        {},
+		"fifo":    {},
+		"lifo":    {},
+		"average": {},
+	}
+)
+
+// FillLotMatching returns the lot matching method the fill was matched with
+// when it filled. Fills from before it was recorded fall back to the given
+// method.
+func FillLotMatching(fill database.Fill, fallback string) string {
+	if fill.LotMatching == "" {
+		return fallback
+	}
+	return fill.LotMatching
+}
+
+// MatchLots applies a fill, given as a lot, to a symbol's open lots. A fill
+// in the same direction as the lots opens a new lot. Otherwise it closes
+// lots oldest first for "fifo" and newest first for "lifo". "average" closes
+// oldest first too, but at the average price of all the open lots. Whatever
+// is left of the fill opens a lot in the other direction. Returns the open
+// lots afterwards and the parts of lots that were closed.
+func MatchLots(method string, open []database.Lot, fill database.Lot) ([]database.Lot, []database.Lot) {
+	lots := append([]database.Lot{}, open...)
+	if len(lots) == 0 || lots[0].Direction == fill.Direction {
+		return append(lots, fill), nil
+	}
+
+	if method == "average" {
+		average := averagePrice(lots)
+		for i := range lots {
+			lots[i].Price = average
+		}
+	}
+
+	var closed []database.Lot
+	remaining := fill.Quantity
+	for remaining > 0 && len(lots) > 0 {
+		i := 0
+		if method == "lifo" {
+			i = len(lots) - 1
+		}
+		matched := lots[i]
+		if matched.Quantity > remaining {
+			matched.Quantity = remaining
+		}
+		closed = append(closed, matched)
+		remaining -= matched.Quantity
+		lots[i].Quantity -= matched.Quantity
+		if lots[i].Quantity == 0 {
+			lots = append(lots[:i], lots[i+1:]...)
+		}
+	}
+
+	if remaining > 0 {
+		fill.Quantity = remaining
+		lots = append(lots, fill)
+	}
+	return lots, closed
+}
+
+// Returns the cost basis of the lots, weighted by quantity.
+func averagePrice(lots []database.Lot) float64 {
+	var total float64
+	var quantity int
+	for _, lot := range lots {
+		total += lot.Price * float64(lot.Quantity)
+		quantity += lot.Quantity
+	}
+	if quantity == 0 {
+		return 0
+	}
+	return total / float64(quantity)
+}
+
+// Returns the open lots of a position. Positions saved before lots were
+// tracked are treated as a single lot.
+func positionLots(position database.Position) []database.Lot {
+	if len(position.Lots) > 0 {
+		return position.Lots
+	}
+	return []database.Lot{{
+		AccountID: position.AccountID,
+		SymbolID:  position.SymbolID,
+		Direction: position.Direction,
+		Price:     position.Price,
+		Quantity:  position.Quantity,
+	}}
+}
@@ -0,0 +1,329 @@
+package simulate
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+// MarginAccount is the account a simulation checks maintenance margin
+// against. Cash is the account's balance before the simulated bars, which
+// is what Account.RealizedPnL holds.
+type MarginAccount struct {
+	Cash float64
+}
+
+// LastPrices returns the last traded price of each symbol at the given date.
+// Symbols without a recent price are left out.
+func LastPrices(barData bars.BarData, date time.Time, symbolIDs []uint) (map[uint]float64, error) {
+	lastPrices := make(map[uint]float64)
+	for _, symbolID := range symbolIDs {
+		prices, err := barData.GetLastPrices(date.UnixMilli(), symbolID)
+		if err != nil {
+			return nil, fmt.Errorf("barData.GetLastPrices: %w", err)
+		}
+		if price, ok := prices[symbolID]; ok {
+			lastPrices[symbolID] = price
+		}
+	}
+	return lastPrices, nil
+}
+
+// UnrealizedPnL values the positions at the given prices, in dollars.
+// Positions without a price are valued at their entry.
+func UnrealizedPnL(positions []database.Position, lastPrices map[uint]float64) float64 {
+	var pnl float64
+	for _, position := range positions {
+		price, ok := lastPrices[position.SymbolID]
+		if !ok {
+			continue
+		}
+		pnl += calculatePnl(position.Direction, position.Price, price, position.Quantity) * contracts.PointValue(position.SymbolID)
+	}
+	return pnl
+}
+
+// MaintenanceMargin is the margin the positions need to stay open.
+func MaintenanceMargin(positions []database.Position) float64 {
+	var margin float64
+	for _, position := range positions {
+		contract, _ := contracts.Get(position.SymbolID)
+		margin += float64(position.Quantity) * contract.MaintenanceMargin
+	}
+	return margin
+}
+
+// InitialMargin is the margin needed to hold the positions and to fill every
+// working entry order on top of them. Bracket legs only ever close out their
+// entry, so they don't need margin of their own.
+func InitialMargin(positions []database.Position, orders []database.Order) float64 {
+	net := make(map[uint]int)
+	for _, position := range positions {
+		net[position.SymbolID] += signedQuantity(position.Direction, position.Quantity)
+	}
+	buys := make(map[uint]int)
+	sells := make(map[uint]int)
+	for _, order := range orders {
+		if order.EntryOrderID != nil || !isWorking(order) {
+			continue
+		}
+		if order.Direction == "buy" {
+			buys[order.SymbolID] += order.RemainingQuantity()
+		} else {
+			sells[order.SymbolID] += order.RemainingQuantity()
+		}
+	}
+
+	symbolIDs := make(map[uint]struct{})
+	for symbolID := range net {
+		symbolIDs[symbolID] = struct{}{}
+	}
+	for symbolID := range buys {
+		symbolIDs[symbolID] = struct{}{}
+	}
+	for symbolID := range sells {
+		symbolIDs[symbolID] = struct{}{}
+	}
+
+	var margin float64
+	for symbolID := range symbolIDs {
+		contract, _ := contracts.Get(symbolID)
+		long := math.Abs(float64(net[symbolID] + buys[symbolID]))
+		short := math.Abs(float64(net[symbolID] - sells[symbolID]))
+		margin += math.Max(long, short) * contract.InitialMargin
+	}
+	return margin
+}
+
+// CheckBuyingPower makes sure the account can afford the initial margin of
+// its positions and working orders once the new orders are added. Orders
+// that don't add to the margin needed, like ones that close a position, are
+// always allowed.
+func CheckBuyingPower(
+	field string,
+	cash float64,
+	positions []database.Position,
+	workingOrders []database.Order,
+	newOrders []database.Order,
+	lastPrices map[uint]float64,
+) ValidationErrors {
+	var errs ValidationErrors
+	equity := cash + UnrealizedPnL(positions, lastPrices)
+	before := InitialMargin(positions, workingOrders)
+	after := InitialMargin(positions, append(append([]database.Order{}, workingOrders...), newOrders...))
+	if after > before && after > equity {
+		errs.add(field+".quantity", "not enough buying power: needs $%.2f of initial margin but the account is worth $%.2f", after, equity)
+	}
+	return errs
+}
+
+// CheckModifiedBuyingPower makes sure the account can afford a modified
+// order in place of the working order it was before. The working orders may
+// include the original, which is left out.
+func CheckModifiedBuyingPower(
+	field string,
+	cash float64,
+	positions []database.Position,
+	workingOrders []database.Order,
+	modified database.Order,
+	lastPrices map[uint]float64,
+) ValidationErrors {
+	var others []database.Order
+	for _, order := range workingOrders {
+		if order.ID != modified.ID {
+			others = append(others, order)
+		}
+	}
+	return CheckBuyingPower(field, cash, positions, others, []database.Order{modified}, lastPrices)
+}
+
+func signedQuantity(direction string, quantity int) int {
+	if direction == "buy" {
+		return quantity
+	}
+	return -quantity
+}
+
+// Simulates all symbols on one timeline so the account's maintenance margin
+// can be checked after every bar. When unrealized losses at a bar's worst
+// price take the account below maintenance, every position is liquidated and
+// every working order is cancelled.
+func simulateWithMargin(
+	barsBySymbol map[uint][]bars.Bar,
+	orders []database.Order,
+	positions []database.Position,
+	cfg Config,
+) (bool, []database.Order, []database.Position, float64) {
+
+	symbolIDs := make(map[uint]struct{})
+	for symbolID := range barsBySymbol {
+		symbolIDs[symbolID] = struct{}{}
+	}
+	for _, order := range orders {
+		symbolIDs[order.SymbolID] = struct{}{}
+	}
+	for _, position := range positions {
+		symbolIDs[position.SymbolID] = struct{}{}
+	}
+
+	sims := make([]*symbolSimulation, 0, len(symbolIDs))
+	for symbolID := range symbolIDs {
+		var symOrders []database.Order
+		var symPositions []database.Position
+		for _, order := range orders {
+			if order.SymbolID == symbolID {
+				symOrders = append(symOrders, order)
+			}
+		}
+		for _, position := range positions {
+			if position.SymbolID == symbolID {
+				symPositions = append(symPositions, position)
+			}
+		}
+		sims = append(sims, newSymbolSimulation(symbolID, barsBySymbol[symbolID], symOrders, symPositions, cfg))
+	}
+	sort.Slice(sims, func(i, j int) bool {
+		return sims[i].symbolID < sims[j].symbolID
+	})
+
+	liquidated := false
+	for {
+		// Step whichever symbol has the earliest bar next
+		var sim *symbolSimulation
+		for _, candidate := range sims {
+			if !candidate.done() && (sim == nil || candidate.bars[candidate.next].Date < sim.bars[sim.next].Date) {
+				sim = candidate
+			}
+		}
+		if sim == nil {
+			break
+		}
+		bar := sim.bars[sim.next]
+		sim.step()
+		if liquidated || bar.Volume < 0 {
+			continue
+		}
+		if liquidateBelowMaintenance(sims, sim, bar, cfg.Margin.Cash) {
+			liquidated = true
+		}
+	}
+
+	didExecute := false
+	var retOrders []database.Order
+	var retPositions []database.Position
+	var retCash float64
+	for _, sim := range sims {
+		executed, newOrders, newPositions, newCash := sim.result()
+		didExecute = didExecute || executed
+		retOrders = append(retOrders, newOrders...)
+		retPositions = append(retPositions, newPositions...)
+		retCash += newCash
+	}
+	return didExecute, retOrders, retPositions, retCash
+}
+
+// Checks the account's equity at the worst price of the bar that was just
+// simulated, and liquidates everything if it's below maintenance margin.
+// Returns whether the account was liquidated.
+func liquidateBelowMaintenance(sims []*symbolSimulation, current *symbolSimulation, bar bars.Bar, cash float64) bool {
+	var allPositions []database.Position
+	for _, sim := range sims {
+		allPositions = append(allPositions, sim.positions...)
+	}
+	maintenance := MaintenanceMargin(allPositions)
+	if maintenance == 0 {
+		return false
+	}
+
+	// Value the other symbols at their last close and this one at the
+	// worst price for its position
+	equity := cash
+	lastPrices := make(map[uint]float64)
+	for _, sim := range sims {
+		equity += sim.cash()
+		if sim.next > 0 {
+			lastPrices[sim.symbolID] = sim.bars[sim.next-1].Close
+		}
+	}
+	net := 0
+	for _, position := range current.positions {
+		net += signedQuantity(position.Direction, position.Quantity)
+	}
+	worst := bar.Low
+	if net < 0 {
+		worst = bar.High
+	}
+	lastPrices[current.symbolID] = worst
+	equity += UnrealizedPnL(allPositions, lastPrices)
+	if equity >= maintenance {
+		return false
+	}
+
+	// Work out the price at which equity fell to maintenance, unless the
+	// bar opened below it already
+	price := worst
+	if net != 0 {
+		breach := worst + (maintenance-equity)/(float64(net)*contracts.PointValue(current.symbolID))
+		if net > 0 {
+			price = math.Min(breach, bar.Open)
+		} else {
+			price = math.Max(breach, bar.Open)
+		}
+	}
+	lastPrices[current.symbolID] = price
+
+	t := time.Unix(0, bar.Date*int64(time.Millisecond))
+	for _, sim := range sims {
+		sim.liquidate(lastPrices, bar, sim == current, t)
+	}
+	return true
+}
+
+// Cancels every working order and closes the positions with market orders
+// flagged as liquidations.
+func (s *symbolSimulation) liquidate(lastPrices map[uint]float64, bar bars.Bar, isCurrent bool, t time.Time) {
+	for j := range s.orders {
+		if isWorking(s.orders[j]) {
+			s.orders[j].CancelledAt = &t
+			s.update(j)
+		}
+	}
+
+	net := 0
+	var accountID uint
+	for _, position := range s.positions {
+		net += signedQuantity(position.Direction, position.Quantity)
+		accountID = position.AccountID
+	}
+	if net == 0 {
+		return
+	}
+	order := closingOrder(accountID, s.symbolID, net, t)
+	order.Liquidation = true
+
+	price, ok := lastPrices[s.symbolID]
+	if !ok {
+		// Nothing traded yet, so close at the average entry
+		var total float64
+		for _, position := range s.positions {
+			total += position.Price * float64(position.Quantity)
+		}
+		price = total / float64(order.Quantity)
+	}
+	var slippage float64
+	if isCurrent {
+		slippage = s.cfg.Costs.Slippage(bar, order)
+	}
+	price = contracts.RoundToTick(s.symbolID, applySlippage(order.Direction, price, slippage))
+
+	s.orders = append(s.orders, order)
+	j := len(s.orders) - 1
+	s.fill(j, order.Quantity, price, slippage, t)
+	s.orders[j].FulfilledAt = &t
+	s.update(j)
+}
@@ -0,0 +1,71 @@
+package simulate
+
+import (
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+// OrderModification lists the changes to make to a working order. Fields
+// left nil keep their current value.
+type OrderModification struct {
+	OrderType   *string  `json:"orderType"`
+	Price       *float64 `json:"price"`
+	LimitPrice  *float64 `json:"limitPrice"`
+	Quantity    *int     `json:"quantity"`
+	TrailAmount *float64 `json:"trailAmount"`
+	TrailUnit   *string  `json:"trailUnit"`
+}
+
+// ModifyOrder amends a working order in place, keeping its ID and bracket
+// link. The order is only changed if the result is valid.
+func ModifyOrder(order *database.Order, mod OrderModification, snapToTick bool) ValidationErrors {
+	var errs ValidationErrors
+	if order.CancelledAt != nil || order.FulfilledAt != nil {
+		errs.add("orderID", "order %d is no longer working", order.ID)
+		return errs
+	}
+
+	modified := *order
+	if mod.OrderType != nil && *mod.OrderType != order.OrderType {
+		// Trigger and trail state belong to the old type
+		modified.OrderType = *mod.OrderType
+		modified.TriggeredAt = nil
+		modified.HighWaterMark = 0
+	}
+	if mod.Price != nil {
+		modified.Price = *mod.Price
+	}
+	if mod.LimitPrice != nil {
+		modified.LimitPrice = *mod.LimitPrice
+	}
+	if mod.Quantity != nil {
+		modified.Quantity = *mod.Quantity
+	}
+	if mod.TrailAmount != nil {
+		modified.TrailAmount = *mod.TrailAmount
+	}
+	if mod.TrailUnit != nil {
+		modified.TrailUnit = *mod.TrailUnit
+	}
+
+	errs = ValidateOrder("order", &modified, snapToTick)
+	if modified.FilledQuantity > 0 && modified.Quantity <= modified.FilledQuantity {
+		errs.add("order.quantity", "quantity must be more than the %d already filled", modified.FilledQuantity)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// A trailing stop that is already tracking keeps its high-water mark
+	// and moves its stop to the new distance right away
+	if isTrailingStop(modified) && modified.HighWaterMark != 0 {
+		if modified.Direction == "buy" {
+			modified.Price = contracts.RoundToTick(modified.SymbolID, modified.HighWaterMark+trailDistance(modified))
+		} else {
+			modified.Price = contracts.RoundToTick(modified.SymbolID, modified.HighWaterMark-trailDistance(modified))
+		}
+	}
+
+	*order = modified
+	return nil
+}
@@ -0,0 +1,58 @@
+package simulate
+
+import (
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+var (
+	OrderActions = map[string]struct{}{
+		"":        {},
+		"reverse": {},
+	}
+)
+
+// ReversePosition turns the order into a market order for twice the
+// symbol's net position the other way, which closes it and opens the same
+// size in the opposite direction.
+func ReversePosition(field string, order *database.Order, positions []database.Position) ValidationErrors {
+	var errs ValidationErrors
+	net := 0
+	for _, position := range positions {
+		if position.SymbolID == order.SymbolID {
+			net += signedQuantity(position.Direction, position.Quantity)
+		}
+	}
+	if net == 0 {
+		errs.add(field+".action", "there is no position in symbol %d to reverse", order.SymbolID)
+		return errs
+	}
+	order.OrderType = "market"
+	order.Direction = "sell"
+	order.Quantity = 2 * net
+	if net < 0 {
+		order.Direction = "buy"
+		order.Quantity = -2 * net
+	}
+	return errs
+}
+
+// Cancels the working bracket legs that protected a position the order just
+// reversed. They're on the same side as the order, so they would otherwise
+// add to the new position. Returns the indexes of the orders that changed.
+func cancelReversedBrackets(orders []database.Order, j int, t time.Time) []int {
+	var changed []int
+	for j2 := range orders {
+		if j2 == j ||
+			orders[j2].EntryOrderID == nil ||
+			orders[j2].ActivatedAt == nil ||
+			orders[j2].Direction != orders[j].Direction ||
+			!isWorking(orders[j2]) {
+			continue
+		}
+		orders[j2].CancelledAt = &t
+		changed = append(changed, j2)
+	}
+	return changed
+}
@@ -0,0 +1,110 @@
+package simulate
+
+import (
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/auth"
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"gorm.io/gorm"
+)
+
+// ValidateRewind checks that an account at the given date can go back to
+// the target date: it has to be earlier, but not before the account's
+// ledger starts.
+func ValidateRewind(field string, events []database.LedgerEvent, accountDate, date time.Time) ValidationErrors {
+	var errs ValidationErrors
+	if !date.Before(accountDate) {
+		errs.add(field, "must be before the account's date %s", accountDate.Format(time.RFC3339))
+	} else if len(events) > 0 && date.Before(events[0].SimulatedAt) {
+		errs.add(field, "must not be before the account started on %s", events[0].SimulatedAt.Format(time.RFC3339))
+	}
+	return errs
+}
+
+// RewindAccount takes the account back to an earlier simulated date. The
+// orders and fills after that date are archived under a new rewind, and the
+// account's cash, orders and positions are rebuilt from its ledger as they
+// were at the date. Returns ValidationErrors if the date isn't valid.
+func RewindAccount(
+	db *gorm.DB,
+	authInfo *auth.AuthContext,
+	barsData bars.BarData,
+	accountID uint,
+	date time.Time,
+) (database.Account, []database.Position, AccountEquity, error) {
+	var account database.Account
+	var positions []database.Position
+	var equity AccountEquity
+	err := database.Transaction(db, func(db *gorm.DB) error {
+		var err error
+		account, err = database.GetAccountByID(db, accountID)
+		if err != nil {
+			return err
+		}
+		if account.UserID != authInfo.UserID {
+			return auth.ErrNotAuthorized
+		}
+		if err = database.EnsureLedger(db, accountID); err != nil {
+			return err
+		}
+		events, err := database.GetLedgerForAccount(db, accountID)
+		if err != nil {
+			return err
+		}
+		if errs := ValidateRewind("date", events, account.Date, date); len(errs) > 0 {
+			return errs
+		}
+
+		rewind := database.Rewind{
+			AccountID:           accountID,
+			FromDate:            account.Date,
+			ToDate:              date,
+			RealizedPnL:         account.RealizedPnL,
+			NetLiquidationValue: account.NetLiquidationValue,
+		}
+		if err = rewind.Create(db); err != nil {
+			return err
+		}
+		if err = rewind.Archive(db); err != nil {
+			return err
+		}
+		if err = database.RecordRewind(db, rewind); err != nil {
+			return err
+		}
+
+		events, err = database.GetLedgerForAccount(db, accountID)
+		if err != nil {
+			return err
+		}
+		projection, err := ProjectLedger(events, account.LotMatching)
+		if err != nil {
+			return err
+		}
+		for _, order := range projection.Orders {
+			if err = order.Update(db); err != nil {
+				return err
+			}
+		}
+
+		positions = projection.Positions
+		symbolIDs := make([]uint, 0, len(positions))
+		for _, position := range positions {
+			symbolIDs = append(symbolIDs, position.SymbolID)
+		}
+		marks, err := LastPrices(barsData, date, symbolIDs)
+		if err != nil {
+			return err
+		}
+		account.Date = date
+		account.RealizedPnL = projection.Cash
+		// The day's starting value is taken again at the new date
+		account.TradingDay = time.Time{}
+		equity, _ = MarkToMarket(&account, positions, marks)
+		if err = database.ReplacePositionsForAccount(db, accountID, positions); err != nil {
+			return err
+		}
+		return account.Update(db)
+	})
+	return account, positions, equity, err
+}
@@ -1,45 +1,67 @@
 package simulate
 
 import (
-	"fmt"
+	"math"
 	"sync"
 	"time"
 
 	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
 	"github.com/tradingcage/tradingcage-go/pkg/database"
 
 	"golang.org/x/sync/errgroup"
+	"gorm.io/gorm"
 )
 
-var (
-	TickerMultiplier = map[uint]float64{
-		1:  50,
-		2:  20,
-		3:  5,
-		14: 100000,
-		15: 62500,
-		16: 1000,
-		18: 125000,
-		19: 50,
-		20: 100000,
-		21: 12500000,
-		23: 10000,
-		25: 100000,
-		26: 100000,
-		17: 25,
-		22: 100,
-		24: 250,
+// Config controls how SimulateBars fills orders. Nil fields fall back to
+// no costs, the default intrabar path, filling limit orders on touch and
+// not checking margin. Lots are matched FIFO unless LotMatching says otherwise.
+type Config struct {
+	Costs       CostModel
+	Intrabar    IntrabarResolver
+	Liquidity   LiquidityModel
+	Margin      *MarginAccount
+	LotMatching string
+}
+
+// LoadConfig builds the simulation config for an account from its saved settings.
+func LoadConfig(db *gorm.DB, account database.Account, barData bars.BarData) (Config, error) {
+	costs, err := LoadCostModel(db, account.ID)
+	if err != nil {
+		return Config{}, err
 	}
-)
+	return Config{
+		Costs:       costs,
+		Intrabar:    NewIntrabarResolver(account, barData),
+		Liquidity:   NewLiquidityModel(account),
+		Margin:      &MarginAccount{Cash: account.RealizedPnL},
+		LotMatching: account.LotMatching,
+	}, nil
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.Costs == nil {
+		cfg.Costs = NoCosts
+	}
+	if cfg.Intrabar == nil {
+		cfg.Intrabar = PathResolver{}
+	}
+	if cfg.Liquidity == nil {
+		cfg.Liquidity = TouchLiquidity{}
+	}
+	return cfg
+}
 
 // Given a set of bars, existing active orders, and current positions,
 // simulate the active orders against the bars and update the positions.
-// Returns a list of orders that were fulfilled and an updated list of
-// positions to replace the prior one.
+// Returns whether anything changed, the orders that were filled or otherwise
+// updated, and an updated list of positions to replace the prior one. The returned cash is net of the
+// fees charged by the cost model.
 func SimulateBars(
 	barsBySymbol map[uint][]bars.Bar,
 	orders []database.Order,
 	positions []database.Position,
+	cfg Config,
 ) (
 	bool,
 	[]database.Order,
@@ -48,6 +70,17 @@ func SimulateBars(
 	error,
 ) {
 
+	cfg = cfg.withDefaults()
+
+	if cfg.Margin != nil {
+		didExecute, retOrders, retPositions, retCash := simulateWithMargin(barsBySymbol, orders, positions, cfg)
+		return didExecute, retOrders, retPositions, retCash, nil
+	}
+
+	// Without margin the symbols can't affect each other, so each is simulated
+	// on its own. Accounts always have margin checked, so this is only for
+	// callers simulating orders outside of one, like tests.
+
 	// Keep track of the symbols for active positions so we replace them correctly
 	symbolsWithPositions := make(map[uint][]database.Position)
 	for _, pos := range positions {
@@ -93,6 +126,7 @@ func SimulateBars(
 				bars,
 				symOrders,
 				symPositions,
+				cfg,
 			)
 			if err != nil {
 				return err
@@ -130,6 +164,7 @@ func simulateBars(
 	bars []bars.Bar,
 	orders []database.Order,
 	positions []database.Position,
+	cfg Config,
 ) (
 	bool,
 	[]database.Order,
@@ -137,89 +172,380 @@ func simulateBars(
 	float64,
 	error,
 ) {
+	sim := newSymbolSimulation(symbolID, bars, orders, positions, cfg)
+	for !sim.done() {
+		sim.step()
+	}
+	didExecute, ordersToUpdate, positions, cash := sim.result()
+	return didExecute, ordersToUpdate, positions, cash, nil
+}
 
-	ordersToUpdate := []database.Order{}
+// symbolSimulation steps one symbol's orders and positions through its bars.
+type symbolSimulation struct {
+	symbolID             uint
+	bars                 []bars.Bar
+	next                 int // Index of the next bar to simulate
+	orders               []database.Order
+	positions            []database.Position
+	cfg                  Config
+	didExecute           bool
+	totalPnl             float64
+	totalFees            float64
+	orderIndexesToUpdate map[int]struct{}
+}
 
-	if len(bars) == 0 {
-		return false, ordersToUpdate, positions, 0, nil
+func newSymbolSimulation(
+	symbolID uint,
+	bars []bars.Bar,
+	orders []database.Order,
+	positions []database.Position,
+	cfg Config,
+) *symbolSimulation {
+	return &symbolSimulation{
+		symbolID:             symbolID,
+		bars:                 bars,
+		orders:               orders,
+		positions:            positions,
+		cfg:                  cfg,
+		orderIndexesToUpdate: make(map[int]struct{}),
 	}
+}
 
-	// For each bar, go through the remaining limit and stop orders,
-	// check if they are applicable, and if so, execute them
-	didExecute := false
-	totalPnl := float64(0)
-	var pnl float64
-	orderIndexesToUpdate := make(map[int]struct{})
-
-	for _, bar := range bars {
-		for j, order := range orders {
-			if orders[j].ActivatedAt == nil ||
-				orders[j].CancelledAt != nil ||
-				orders[j].FulfilledAt != nil {
-				continue
+func (s *symbolSimulation) done() bool {
+	return s.next >= len(s.bars)
+}
+
+func (s *symbolSimulation) update(indexes ...int) {
+	for _, j := range indexes {
+		s.orderIndexesToUpdate[j] = struct{}{}
+	}
+}
+
+// Goes through the remaining orders for the next bar, checks if they are
+// applicable, and if so, executes them.
+func (s *symbolSimulation) step() {
+	i := s.next
+	s.next++
+	bar := s.bars[i]
+	symbolID := s.symbolID
+	orders := s.orders
+	cfg := s.cfg
+
+	// Placeholder bars from the replayer carry no prices
+	if bar.Volume < 0 {
+		return
+	}
+	startDate := bar.Date - time.Minute.Milliseconds()
+	if i > 0 {
+		startDate = s.bars[i-1].Date
+	}
+	s.update(expireOrders(bar, orders)...)
+	s.update(seedTrailingStops(bar, orders)...)
+	sequence := fillSequence(symbolID, startDate, bar, orders, cfg.Intrabar)
+	for k := 0; k < len(sequence); k++ {
+		j := sequence[k]
+		order := orders[j]
+		if orders[j].ActivatedAt == nil ||
+			orders[j].CancelledAt != nil ||
+			orders[j].FulfilledAt != nil {
+			continue
+		}
+		if order.OrderType == "stop-limit" &&
+			order.TriggeredAt == nil &&
+			isStopTriggered(bar, order.Direction, order.Price) {
+			// The stop price was hit, so from now on this behaves like a limit order
+			t := time.Unix(0, bar.Date*int64(time.Millisecond))
+			orders[j].TriggeredAt = &t
+			s.update(j)
+		}
+		price := getOrderPrice(bar, order)
+		if price == -1 {
+			continue
+		}
+		quantity := order.RemainingQuantity()
+		if isLimitFill(order) {
+			quantity = cfg.Liquidity.FillableQuantity(bar, order, quantity)
+		}
+		if quantity <= 0 {
+			continue
+		}
+		s.update(j)
+		t := time.Unix(0, bar.Date*int64(time.Millisecond))
+		slippage := cfg.Costs.Slippage(bar, order)
+		price = contracts.RoundToTick(symbolID, applySlippage(order.Direction, price, slippage))
+		s.fill(j, quantity, price, slippage, t)
+
+		// The rest of the order is still working, so leave its bracket alone
+		if orders[j].RemainingQuantity() > 0 {
+			continue
+		}
+		orders[j].FulfilledAt = &t
+
+		// Check if this is an entry order that will activate other pending orders
+		if order.EntryOrderID == nil {
+			var activated []int
+			for j2, _ := range orders {
+				if orders[j2].EntryOrderID != nil &&
+					*orders[j2].EntryOrderID == order.ID &&
+					orders[j2].ActivatedAt == nil {
+					// Activate the order and make sure it gets updated
+					orders[j2].ActivatedAt = &t
+					s.update(j2)
+					activated = append(activated, j2)
+				}
 			}
-			if price := getOrderPrice(bar, order); price != -1 {
-				orderIndexesToUpdate[j] = struct{}{}
-				t := time.Unix(0, bar.Date*int64(time.Millisecond))
-				orders[j].FulfilledAt = &t
-				orders[j].FulfilledPrice = price
-				positions, pnl = executeOrder(symbolID, order, positions, price)
-
-				// Check if this is an entry order that will activate other pending orders
-				if order.EntryOrderID == nil {
-					for j2, _ := range orders {
-						if orders[j2].EntryOrderID != nil &&
-							*orders[j2].EntryOrderID == order.ID &&
-							orders[j2].ActivatedAt == nil {
-							// Activate the order and make sure it gets updated
-							orders[j2].ActivatedAt = &t
-							orderIndexesToUpdate[j2] = struct{}{}
-							fmt.Printf("activating order %d\n", orders[j2].ID)
-						}
-					}
-				} else {
-					// Check if this is part of an active OCO bracket that will cancel other orders
-					for j2, _ := range orders {
-						if (orders[j2].ID == *order.EntryOrderID ||
-							(orders[j2].EntryOrderID != nil && *orders[j2].EntryOrderID == *order.EntryOrderID)) &&
-							orders[j2].ID != order.ID &&
-							orders[j2].CancelledAt == nil &&
-							orders[j2].ActivatedAt != nil &&
-							orders[j2].FulfilledAt == nil {
-							fmt.Printf("cancelling order %d\n", orders[j2].ID)
-							orders[j2].CancelledAt = &t
-							orderIndexesToUpdate[j2] = struct{}{}
-						}
-					}
+			if len(activated) > 0 {
+				// The bracket can be hit on the same bar as its entry, so the
+				// orders left to check are put back in sequence
+				sequence = resequence(sequence[:k+1], append(activated, sequence[k+1:]...),
+					fillSequence(symbolID, startDate, bar, orders, cfg.Intrabar))
+			}
+		} else {
+			// Check if this is part of an active OCO bracket that will cancel other orders
+			for j2, _ := range orders {
+				if (orders[j2].ID == *order.EntryOrderID ||
+					(orders[j2].EntryOrderID != nil && *orders[j2].EntryOrderID == *order.EntryOrderID)) &&
+					orders[j2].ID != order.ID &&
+					orders[j2].CancelledAt == nil &&
+					orders[j2].ActivatedAt != nil &&
+					orders[j2].FulfilledAt == nil {
+					orders[j2].CancelledAt = &t
+					s.update(j2)
 				}
+			}
+		}
+	}
+	s.update(cancelImmediateOrders(bar, orders)...)
+	s.update(trailStops(bar, orders)...)
+}
 
-				totalPnl += pnl
-				didExecute = true
+// Fills part or all of an order at the given price, charging fees and
+// updating positions. A fill that goes through the position is recorded as
+// a closing leg and an opening leg.
+func (s *symbolSimulation) fill(j int, quantity int, price, slippage float64, t time.Time) {
+	order := s.orders[j]
+	closing := 0
+	for _, position := range s.positions {
+		if position.Direction != order.Direction {
+			closing += position.Quantity
+		}
+	}
+	if closing > quantity {
+		closing = quantity
+	}
+	if closing > 0 {
+		s.fillLeg(j, "close", closing, price, slippage, t)
+	}
+	if quantity > closing {
+		s.fillLeg(j, "open", quantity-closing, price, slippage, t)
+		if closing > 0 {
+			s.update(cancelReversedBrackets(s.orders, j, t)...)
+		}
+	}
+}
+
+func (s *symbolSimulation) fillLeg(j int, leg string, quantity int, price, slippage float64, t time.Time) {
+	order := s.orders[j]
+	commission, exchangeFees := s.cfg.Costs.Fees(order, quantity)
+	fillOrder := order
+	fillOrder.Quantity = quantity
+	var pnl float64
+	s.positions, pnl = executeOrder(s.symbolID, fillOrder, s.positions, price, t, s.cfg.LotMatching)
+	recordFill(&s.orders[j], database.Fill{
+		AccountID:    order.AccountID,
+		SymbolID:     s.symbolID,
+		Direction:    order.Direction,
+		Leg:          leg,
+		Price:        price,
+		Quantity:     quantity,
+		Slippage:     slippage,
+		Commission:   commission,
+		ExchangeFees: exchangeFees,
+		Cash:         pnl*contracts.PointValue(s.symbolID) - commission - exchangeFees,
+		Liquidation:  order.Liquidation,
+		LotMatching:  s.cfg.LotMatching,
+		FilledAt:     t,
+	})
+	s.totalFees += commission + exchangeFees
+	s.totalPnl += pnl
+	s.didExecute = true
+}
+
+// Returns the cash made so far, net of fees.
+func (s *symbolSimulation) cash() float64 {
+	return s.totalPnl*contracts.PointValue(s.symbolID) - s.totalFees
+}
+
+// Returns whether anything changed, the orders that changed, the positions
+// and the cash made.
+func (s *symbolSimulation) result() (bool, []database.Order, []database.Position, float64) {
+	ordersToUpdate := []database.Order{}
+	for i := range s.orderIndexesToUpdate {
+		ordersToUpdate = append(ordersToUpdate, s.orders[i])
+	}
+
+	// Orders can change without executing, like a stop-limit triggering,
+	// and those changes need to be saved too
+	didExecute := s.didExecute || len(ordersToUpdate) > 0
+
+	return didExecute, ordersToUpdate, s.positions, s.cash()
+}
+
+// Adds a fill to the order, keeping its filled quantity, average fill
+// price and costs up to date.
+func recordFill(order *database.Order, fill database.Fill) {
+	filled := float64(order.FilledQuantity)
+	total := filled + float64(fill.Quantity)
+	order.FulfilledPrice = (order.FulfilledPrice*filled + fill.Price*float64(fill.Quantity)) / total
+	order.Slippage = (order.Slippage*filled + fill.Slippage*float64(fill.Quantity)) / total
+	order.Commission += fill.Commission
+	order.ExchangeFees += fill.ExchangeFees
+	order.FilledQuantity += fill.Quantity
+	order.PendingFills = append(order.PendingFills, fill)
+}
+
+// Returns the order in which to check orders against a bar. When several
+// orders in the same OCO bracket could all fill on the bar, the one the
+// resolver says was reached first is checked before the others so that the
+// rest get cancelled.
+func fillSequence(
+	symbolID uint,
+	startDate int64,
+	bar bars.Bar,
+	orders []database.Order,
+	resolver IntrabarResolver,
+) []int {
+	brackets := make(map[uint][]int)
+	for j, order := range orders {
+		if order.ActivatedAt == nil ||
+			order.CancelledAt != nil ||
+			order.FulfilledAt != nil ||
+			getOrderPrice(bar, order) == -1 {
+			continue
+		}
+		bracketID := order.ID
+		if order.EntryOrderID != nil {
+			bracketID = *order.EntryOrderID
+		}
+		brackets[bracketID] = append(brackets[bracketID], j)
+	}
+
+	deferred := make(map[int]struct{})
+	for _, indexes := range brackets {
+		if len(indexes) < 2 {
+			continue
+		}
+		candidates := make([]database.Order, 0, len(indexes))
+		for _, j := range indexes {
+			candidates = append(candidates, orders[j])
+		}
+		first := indexes[resolver.First(symbolID, startDate, bar, candidates)]
+		for _, j := range indexes {
+			if j != first {
+				deferred[j] = struct{}{}
 			}
 		}
 	}
 
-	for i, _ := range orderIndexesToUpdate {
-		fmt.Printf("updating order %d\n", orders[i].ID)
-		ordersToUpdate = append(ordersToUpdate, orders[i])
+	sequence := make([]int, 0, len(orders))
+	for j := range orders {
+		if _, ok := deferred[j]; !ok {
+			sequence = append(sequence, j)
+		}
+	}
+	for j := range orders {
+		if _, ok := deferred[j]; ok {
+			sequence = append(sequence, j)
+		}
 	}
+	return sequence
+}
 
-	return didExecute, ordersToUpdate, positions, totalPnl * TickerMultiplier[symbolID], nil
+// Appends the pending orders to checked, in the order they come in sequence.
+func resequence(checked, pending, sequence []int) []int {
+	isPending := make(map[int]struct{}, len(pending))
+	for _, j := range pending {
+		isPending[j] = struct{}{}
+	}
+	resequenced := append([]int{}, checked...)
+	for _, j := range sequence {
+		if _, ok := isPending[j]; ok {
+			resequenced = append(resequenced, j)
+		}
+	}
+	return resequenced
 }
 
+// Returns the price at which the order would be filled within the given bar,
+// or -1 if the order would not be filled. Orders are filled at their price
+// unless the bar opened through it, in which case they are filled at the open.
 func getOrderPrice(bar bars.Bar, order database.Order) float64 {
 	if order.FulfilledAt != nil {
 		return -1
 	}
-	if order.OrderType == "market" {
+	switch order.OrderType {
+	case "market":
 		return bar.Open
-	}
-	if bar.Low <= order.Price && order.Price <= bar.High {
-		return order.Price
+	case "limit":
+		return getLimitPrice(bar, order.Direction, order.Price)
+	case "stop", "trailing-stop":
+		// Trailing stops have no price until they've started tracking
+		if order.Price == 0 || !isStopTriggered(bar, order.Direction, order.Price) {
+			return -1
+		}
+		if order.Direction == "buy" {
+			return math.Max(order.Price, bar.Open)
+		}
+		return math.Min(order.Price, bar.Open)
+	case "stop-limit":
+		if order.TriggeredAt != nil {
+			return getLimitPrice(bar, order.Direction, order.LimitPrice)
+		}
+		if !isStopTriggered(bar, order.Direction, order.Price) {
+			return -1
+		}
+		// The stop triggered on this bar: fill at the trigger price if it is
+		// within the limit, otherwise only if the bar came back to the limit
+		if order.Direction == "buy" {
+			triggerPrice := math.Max(order.Price, bar.Open)
+			if triggerPrice <= order.LimitPrice {
+				return triggerPrice
+			}
+		} else {
+			triggerPrice := math.Min(order.Price, bar.Open)
+			if triggerPrice >= order.LimitPrice {
+				return triggerPrice
+			}
+		}
+		return getLimitPrice(bar, order.Direction, order.LimitPrice)
 	}
 	return -1
 }
 
+// A buy limit fills when the bar trades at or below its price, a sell limit
+// when it trades at or above. A bar that opens beyond the limit fills at the open.
+func getLimitPrice(bar bars.Bar, direction string, price float64) float64 {
+	if direction == "buy" {
+		if bar.Low > price {
+			return -1
+		}
+		return math.Min(price, bar.Open)
+	}
+	if bar.High < price {
+		return -1
+	}
+	return math.Max(price, bar.Open)
+}
+
+// A buy stop triggers when the bar trades at or above its price, a sell stop
+// when it trades at or below.
+func isStopTriggered(bar bars.Bar, direction string, price float64) bool {
+	if direction == "buy" {
+		return bar.High >= price
+	}
+	return bar.Low <= price
+}
+
 func calculatePnl(
 	direction string,
 	entryPrice,
@@ -232,59 +558,68 @@ func calculatePnl(
 	return (entryPrice - exitPrice) * float64(quantity)
 }
 
+// Applies a fill to the symbol's net position, matching it against the
+// position's lots with the given method. Returns the positions afterwards,
+// which is at most one per symbol, and the points realized.
 func executeOrder(
 	symbolID uint,
 	order database.Order,
 	positions []database.Position,
 	price float64,
+	t time.Time,
+	method string,
 ) ([]database.Position, float64) {
-	if len(positions) == 0 || order.Direction == positions[0].Direction {
-		positions = append(positions, database.Position{
-			SymbolID:  symbolID,
-			AccountID: order.AccountID,
-			Direction: order.Direction,
-			Price:     price,
-			Quantity:  order.Quantity,
-		})
-		return positions, 0
-	}
-
-	quantityRemaining := order.Quantity
-	newPositions := []database.Position{}
-	pnl := float64(0)
+	// Positions saved before netting can still be split over several rows
+	var lots []database.Lot
+	var dayTotal float64
 	for _, position := range positions {
-		if quantityRemaining == 0 {
-			newPositions = append(newPositions, position)
-			continue
-		}
-		if position.Quantity > quantityRemaining {
-			pnl += calculatePnl(position.Direction, position.Price, price, quantityRemaining)
-			newPositions = append(newPositions, database.Position{
-				SymbolID:  symbolID,
-				AccountID: position.AccountID,
-				Direction: position.Direction,
-				Price:     price,
-				Quantity:  position.Quantity - quantityRemaining,
-			})
-			quantityRemaining = 0
-		} else if position.Quantity == quantityRemaining {
-			pnl += calculatePnl(position.Direction, position.Price, price, quantityRemaining)
-			quantityRemaining = 0
-		} else { // position.Quantity < quantityRemaining
-			pnl += calculatePnl(position.Direction, position.Price, price, position.Quantity)
-			quantityRemaining -= position.Quantity
+		lots = append(lots, positionLots(position)...)
+		dayPrice := position.DayPrice
+		if dayPrice == 0 {
+			dayPrice = position.Price
 		}
+		dayTotal += dayPrice * float64(position.Quantity)
+	}
+	quantity := 0
+	for _, lot := range lots {
+		quantity += lot.Quantity
 	}
 
-	if quantityRemaining > 0 {
-		newPositions = append(newPositions, database.Position{
-			SymbolID:  symbolID,
-			AccountID: order.AccountID,
-			Direction: order.Direction,
-			Price:     price,
-			Quantity:  quantityRemaining,
-		})
+	lots, closed := MatchLots(method, lots, database.Lot{
+		AccountID: order.AccountID,
+		SymbolID:  symbolID,
+		Direction: order.Direction,
+		Price:     price,
+		Quantity:  order.Quantity,
+		OpenedAt:  t,
+	})
+	pnl := float64(0)
+	for _, lot := range closed {
+		pnl += calculatePnl(lot.Direction, lot.Price, price, lot.Quantity)
+	}
+	if len(lots) == 0 {
+		return []database.Position{}, pnl
 	}
 
-	return newPositions, pnl
+	position := database.Position{
+		SymbolID:  symbolID,
+		AccountID: order.AccountID,
+		Direction: lots[0].Direction,
+		Price:     averagePrice(lots),
+		Lots:      lots,
+	}
+	for _, lot := range lots {
+		position.Quantity += lot.Quantity
+	}
+	// Day P&L of the contracts held since the start of the day is measured
+	// from their mark then, and of ones added since from their entry
+	if quantity > 0 && position.Direction == positions[0].Direction {
+		if order.Direction == position.Direction {
+			dayTotal += price * float64(order.Quantity)
+			position.DayPrice = dayTotal / float64(position.Quantity)
+		} else {
+			position.DayPrice = dayTotal / float64(quantity)
+		}
+	}
+	return []database.Position{position}, pnl
 }
@@ -0,0 +1,101 @@
+package simulate
+
+import (
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+var (
+	TimeInForces = map[string]struct{}{
+		"":    {},
+		"day": {},
+		"gtc": {},
+		"gtd": {},
+		"ioc": {},
+	}
+)
+
+// SetExpiry works out when an order placed at the given simulated time stops
+// working. DAY orders expire at the symbol's next session close and GTD
+// orders must already carry an expiry after now.
+func SetExpiry(field string, order *database.Order, now time.Time) ValidationErrors {
+	var errs ValidationErrors
+	switch order.TimeInForce {
+	case "day":
+		close, ok := contracts.NextSessionClose(order.SymbolID, now)
+		if !ok {
+			errs.add(field+".timeInForce", "symbol %d has no session to expire at", order.SymbolID)
+			return errs
+		}
+		order.ExpiresAt = &close
+	case "gtd":
+		if order.ExpiresAt == nil || !order.ExpiresAt.After(now) {
+			errs.add(field+".expiresAt", "expiry must be after %s", now.Format(time.RFC3339))
+		}
+	default:
+		order.ExpiresAt = nil
+	}
+	return errs
+}
+
+func isWorking(order database.Order) bool {
+	return order.CancelledAt == nil && order.FulfilledAt == nil
+}
+
+// Cancels the order at the given time along with any bracket legs still
+// waiting on it to fill. Returns the indexes of the orders that changed.
+func cancelWithPendingLegs(orders []database.Order, j int, t time.Time) []int {
+	orders[j].CancelledAt = &t
+	changed := []int{j}
+	if orders[j].EntryOrderID != nil {
+		return changed
+	}
+	for j2 := range orders {
+		if orders[j2].EntryOrderID != nil &&
+			*orders[j2].EntryOrderID == orders[j].ID &&
+			orders[j2].ActivatedAt == nil &&
+			isWorking(orders[j2]) {
+			orders[j2].CancelledAt = &t
+			changed = append(changed, j2)
+		}
+	}
+	return changed
+}
+
+// Cancels DAY and GTD orders whose expiry passed before the end of the bar,
+// so they can't fill on it. They're cancelled as of their expiry rather than
+// the bar, so the result doesn't depend on which bars happened to be
+// simulated. Returns the indexes of the orders that changed.
+func expireOrders(bar bars.Bar, orders []database.Order) []int {
+	var changed []int
+	for j := range orders {
+		if orders[j].ExpiresAt == nil ||
+			!isWorking(orders[j]) ||
+			orders[j].ExpiresAt.UnixMilli() >= bar.Date {
+			continue
+		}
+		changed = append(changed, cancelWithPendingLegs(orders, j, *orders[j].ExpiresAt)...)
+	}
+	return changed
+}
+
+// Cancels whatever is left of IOC orders once they've had a bar to fill on.
+// Bracket legs activated during the bar get the next bar.
+// Returns the indexes of the orders that changed.
+func cancelImmediateOrders(bar bars.Bar, orders []database.Order) []int {
+	t := time.Unix(0, bar.Date*int64(time.Millisecond))
+	var changed []int
+	for j := range orders {
+		if orders[j].TimeInForce != "ioc" ||
+			orders[j].ActivatedAt == nil ||
+			!orders[j].ActivatedAt.Before(t) ||
+			!isWorking(orders[j]) {
+			continue
+		}
+		changed = append(changed, cancelWithPendingLegs(orders, j, t)...)
+	}
+	return changed
+}
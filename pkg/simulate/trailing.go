@@ -0,0 +1,108 @@
+package simulate
+
+import (
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+var (
+	TrailUnits = map[string]struct{}{
+		"points":  {},
+		"ticks":   {},
+		"percent": {},
+	}
+)
+
+func isTrailingStop(order database.Order) bool {
+	return order.OrderType == "trailing-stop"
+}
+
+// Returns how far in price points the stop should sit from the high-water mark.
+func trailDistance(order database.Order) float64 {
+	switch order.TrailUnit {
+	case "ticks":
+		return order.TrailAmount * contracts.TickSize(order.SymbolID)
+	case "percent":
+		return order.HighWaterMark * order.TrailAmount / 100
+	default:
+		return order.TrailAmount
+	}
+}
+
+// Moves a trailing stop's high-water mark to the given price if it is more
+// favorable, and pulls the stop along behind it. The stop never moves back.
+// Returns whether the order changed.
+func ratchetTrailingStop(order *database.Order, price float64) bool {
+	isBuy := order.Direction == "buy"
+	if order.HighWaterMark != 0 &&
+		((isBuy && price >= order.HighWaterMark) || (!isBuy && price <= order.HighWaterMark)) {
+		return false
+	}
+	order.HighWaterMark = price
+
+	var stop float64
+	if isBuy {
+		// A buy stop protects a short, so it trails above the lowest low
+		stop = contracts.RoundToTick(order.SymbolID, price+trailDistance(*order))
+		if order.Price != 0 && stop >= order.Price {
+			return true
+		}
+	} else {
+		stop = contracts.RoundToTick(order.SymbolID, price-trailDistance(*order))
+		if order.Price != 0 && stop <= order.Price {
+			return true
+		}
+	}
+	order.Price = stop
+	return true
+}
+
+// Starts tracking trailing stops that haven't seen a bar yet from the bar's
+// open, so they have a stop price before the bar is checked for fills.
+// Returns the indexes of the orders that changed.
+func seedTrailingStops(bar bars.Bar, orders []database.Order) []int {
+	var changed []int
+	for j := range orders {
+		if !isTrailingStop(orders[j]) ||
+			orders[j].HighWaterMark != 0 ||
+			orders[j].ActivatedAt == nil ||
+			orders[j].CancelledAt != nil ||
+			orders[j].FulfilledAt != nil {
+			continue
+		}
+		if ratchetTrailingStop(&orders[j], bar.Open) {
+			changed = append(changed, j)
+		}
+	}
+	return changed
+}
+
+// Ratchets the trailing stops still working after a bar to the bar's
+// extreme. The new stop only applies from the next bar on, since there's
+// no telling whether price reached the extreme before or after it came
+// back to the stop. Stops activated during the bar, like bracket legs
+// whose entry just filled, start from the close instead.
+// Returns the indexes of the orders that changed.
+func trailStops(bar bars.Bar, orders []database.Order) []int {
+	var changed []int
+	for j := range orders {
+		if !isTrailingStop(orders[j]) ||
+			orders[j].ActivatedAt == nil ||
+			orders[j].CancelledAt != nil ||
+			orders[j].FulfilledAt != nil {
+			continue
+		}
+		extreme := bar.High
+		if orders[j].Direction == "buy" {
+			extreme = bar.Low
+		}
+		if orders[j].HighWaterMark == 0 {
+			extreme = bar.Close
+		}
+		if ratchetTrailingStop(&orders[j], extreme) {
+			changed = append(changed, j)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,120 @@
+package simulate
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/tradingcage/tradingcage-go/pkg/contracts"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+var (
+	OrderTypes = map[string]struct{}{
+		"market":        {},
+		"limit":         {},
+		"stop":          {},
+		"stop-limit":    {},
+		"trailing-stop": {},
+	}
+
+	Directions = map[string]struct{}{
+		"buy":  {},
+		"sell": {},
+	}
+)
+
+// ValidationError describes a single problem with a field of a request.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, 0, len(v))
+	for _, e := range v {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.Field, e.Message))
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (v *ValidationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, ValidationError{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// ValidateOrder checks that an order can be placed on its symbol. Prices
+// that aren't on a valid tick are rejected, or snapped to the nearest tick
+// in place when snapToTick is set. Field names in the returned errors are
+// prefixed with the given field.
+func ValidateOrder(field string, order *database.Order, snapToTick bool) ValidationErrors {
+	var errs ValidationErrors
+
+	if !contracts.IsTradeable(order.SymbolID) {
+		errs.add(field+".symbolID", "symbol %d is not tradeable", order.SymbolID)
+	}
+	if _, ok := OrderTypes[order.OrderType]; !ok {
+		errs.add(field+".orderType", "unknown order type %q", order.OrderType)
+	}
+	if _, ok := Directions[order.Direction]; !ok {
+		errs.add(field+".direction", "unknown direction %q", order.Direction)
+	}
+	if _, ok := TimeInForces[order.TimeInForce]; !ok {
+		errs.add(field+".timeInForce", "unknown time in force %q", order.TimeInForce)
+	}
+	if order.Quantity <= 0 {
+		errs.add(field+".quantity", "quantity must be greater than 0")
+	}
+
+	switch order.OrderType {
+	case "market":
+	case "trailing-stop":
+		// The stop price follows the market, so it's set by the simulation
+		order.Price = 0
+		if _, ok := TrailUnits[order.TrailUnit]; !ok {
+			errs.add(field+".trailUnit", "unknown trail unit %q", order.TrailUnit)
+		}
+		if order.TrailAmount <= 0 {
+			errs.add(field+".trailAmount", "trail amount must be greater than 0")
+		} else if order.TrailUnit == "ticks" && order.TrailAmount != math.Trunc(order.TrailAmount) {
+			errs.add(field+".trailAmount", "trail amount must be a whole number of ticks")
+		} else if order.TrailUnit == "points" {
+			validatePrice(&errs, field+".trailAmount", order.SymbolID, &order.TrailAmount, snapToTick)
+		}
+	default:
+		validatePrice(&errs, field+".price", order.SymbolID, &order.Price, snapToTick)
+	}
+	if order.OrderType == "stop-limit" {
+		validatePrice(&errs, field+".limitPrice", order.SymbolID, &order.LimitPrice, snapToTick)
+		// The limit has to leave room to fill once the stop triggers
+		if order.Price > 0 && order.LimitPrice > 0 {
+			if order.Direction == "buy" && order.LimitPrice < order.Price {
+				errs.add(field+".limitPrice", "limit price of a buy stop-limit can't be below its stop price %v", order.Price)
+			} else if order.Direction == "sell" && order.LimitPrice > order.Price {
+				errs.add(field+".limitPrice", "limit price of a sell stop-limit can't be above its stop price %v", order.Price)
+			}
+		}
+	}
+
+	return errs
+}
+
+func validatePrice(errs *ValidationErrors, field string, symbolID uint, price *float64, snapToTick bool) {
+	if *price <= 0 {
+		errs.add(field, "price must be greater than 0")
+		return
+	}
+	if contracts.IsOnTick(symbolID, *price) {
+		*price = contracts.RoundToTick(symbolID, *price)
+		return
+	}
+	if snapToTick {
+		*price = contracts.RoundToTick(symbolID, *price)
+		return
+	}
+	errs.add(field, "price %v is not a multiple of the tick size %v", *price, contracts.TickSize(symbolID))
+}
@@ -0,0 +1,59 @@
+package simulatetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/auth"
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func TestAdvanceTo(t *testing.T) {
+	db, err := SetupInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to set up database: %v", err)
+	}
+	if err := populateTestData(db); err != nil {
+		t.Fatalf("Failed to populate test data: %v", err)
+	}
+	start := time.Date(2023, 11, 6, 9, 30, 0, 0, time.UTC)
+	account := database.Account{Name: "Seek Account", UserID: 1, Date: start, RealizedPnL: 50000}
+	if err := account.Create(db); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+
+	barData := NewInMemoryBarData()
+	barData.AddBars(1, []bars.Bar{
+		{Date: start.Add(time.Minute).UnixMilli(), Open: 4500, High: 4501, Low: 4499, Close: 4500, Volume: 100},
+		{Date: start.Add(3 * time.Hour).UnixMilli(), Open: 4520, High: 4521, Low: 4519, Close: 4520, Volume: 100},
+	})
+	authInfo := &auth.AuthContext{UserID: 1}
+	placeLedgerTestOrder(t, db, account, "buy")
+
+	// Seeking hours ahead still fills the order on the first bar skipped
+	to := start.Add(4 * time.Hour)
+	account, _, fulfilled, positions, equity, err := simulate.AdvanceTo(db, authInfo, barData, account.ID, to)
+	if err != nil {
+		t.Fatalf("AdvanceTo returned unexpected error: %v", err)
+	}
+	if !account.Date.Equal(to) {
+		t.Errorf("Expected the account to move to %v, got %v", to, account.Date)
+	}
+	if len(fulfilled) != 1 || fulfilled[0].FulfilledPrice != 4500 {
+		t.Errorf("Expected the buy to fill at 4500, got %+v", fulfilled)
+	}
+	if len(positions) != 1 || equity.UnrealizedPnL != 1000 {
+		t.Errorf("Expected a long marked at 4520, got %+v with %v unrealized", positions, equity.UnrealizedPnL)
+	}
+
+	// Going backwards is left to rewinds
+	account, _, _, _, _, err = simulate.AdvanceTo(db, authInfo, barData, account.ID, start)
+	if err != nil {
+		t.Fatalf("AdvanceTo returned unexpected error: %v", err)
+	}
+	if !account.Date.Equal(to) {
+		t.Errorf("Expected the account to stay at %v, got %v", to, account.Date)
+	}
+}
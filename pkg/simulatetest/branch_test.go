@@ -0,0 +1,135 @@
+package simulatetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/analytics"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+)
+
+func TestCloneAccount(t *testing.T) {
+	db, err := SetupInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to set up database: %v", err)
+	}
+	if err := populateTestData(db); err != nil {
+		t.Fatalf("Failed to populate test data: %v", err)
+	}
+	date := time.Date(2023, 11, 3, 10, 0, 0, 0, time.UTC)
+	parent := database.Account{Name: "Parent Account", UserID: 1, Date: date, RealizedPnL: 50000, LotMatching: "lifo"}
+	if err := parent.Create(db); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+
+	// A filled entry with its stop and target still working
+	filledAt := date.Add(-time.Hour)
+	entry := database.Order{
+		AccountID: parent.ID, SymbolID: 1, Direction: "buy", Quantity: 1, FilledQuantity: 1, OrderType: "market",
+		FulfilledPrice: 4500, CreatedAt: &filledAt, ActivatedAt: &filledAt, FulfilledAt: &filledAt,
+	}
+	if err := entry.Create(db); err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+	for _, order := range []database.Order{
+		{OrderType: "stop", Price: 4490},
+		{OrderType: "limit", Price: 4520},
+	} {
+		order.AccountID = parent.ID
+		order.SymbolID = 1
+		order.Direction = "sell"
+		order.Quantity = 1
+		order.CreatedAt = &filledAt
+		order.ActivatedAt = &filledAt
+		order.EntryOrderID = &entry.ID
+		if err := order.Create(db); err != nil {
+			t.Fatalf("Failed to create order: %v", err)
+		}
+	}
+	// A round trip closed before the branch stays in the parent's history
+	for _, fill := range []database.Fill{
+		{Direction: "buy", Leg: "open", Price: 4480, FilledAt: filledAt.Add(-time.Hour)},
+		{Direction: "sell", Leg: "close", Price: 4485, FilledAt: filledAt.Add(-time.Minute)},
+		{OrderID: entry.ID, Direction: "buy", Leg: "open", Price: 4500, FilledAt: filledAt},
+	} {
+		fill.AccountID = parent.ID
+		fill.SymbolID = 1
+		fill.Quantity = 1
+		if err := db.Create(&fill).Error; err != nil {
+			t.Fatalf("Failed to create fill: %v", err)
+		}
+	}
+	position := database.Position{SymbolID: 1, Direction: "buy", Price: 4500, Quantity: 1, Lots: []database.Lot{
+		{Direction: "buy", Price: 4500, Quantity: 1, OpenedAt: filledAt},
+	}}
+	if err := database.ReplacePositionsForAccount(db, parent.ID, []database.Position{position}); err != nil {
+		t.Fatalf("Failed to create position: %v", err)
+	}
+	costSettings := []database.CostSetting{
+		{CommissionPerContract: 2.5, SlippageModel: "ticks", SlippageTicks: 1},
+		{SymbolID: 1, CommissionPerContract: 1.25, ExchangeFeePerContract: 1.38, SlippageModel: "none"},
+	}
+	if err := database.ReplaceCostSettingsForAccount(db, parent.ID, costSettings); err != nil {
+		t.Fatalf("Failed to create cost settings: %v", err)
+	}
+
+	clone, err := database.CloneAccount(db, parent.ID, "")
+	if err != nil {
+		t.Fatalf("CloneAccount returned unexpected error: %v", err)
+	}
+	if clone.ID == parent.ID || clone.Name != "Parent Account (branch)" || clone.RealizedPnL != 50000 || clone.LotMatching != "lifo" {
+		t.Errorf("Expected a copy of the account, got %+v", clone)
+	}
+	if clone.ParentAccountID == nil || *clone.ParentAccountID != parent.ID || clone.BranchedAt == nil || !clone.BranchedAt.Equal(date) {
+		t.Errorf("Expected the branch point to be recorded, got %v and %v", clone.ParentAccountID, clone.BranchedAt)
+	}
+
+	cloneSettings, _ := database.GetCostSettingsForAccount(db, clone.ID)
+	if len(cloneSettings) != 2 || cloneSettings[0].CommissionPerContract != 2.5 || cloneSettings[0].SlippageTicks != 1 ||
+		cloneSettings[1].SymbolID != 1 || cloneSettings[1].ExchangeFeePerContract != 1.38 {
+		t.Errorf("Expected the cost settings to be copied, got %+v", cloneSettings)
+	}
+	if parentSettings, _ := database.GetCostSettingsForAccount(db, parent.ID); len(parentSettings) != 2 {
+		t.Errorf("Expected the parent to keep its cost settings, got %+v", parentSettings)
+	}
+
+	fulfilled, _ := database.GetAllFulfilledOrders(db, clone.ID)
+	if len(fulfilled) != 1 || fulfilled[0].ID == entry.ID {
+		t.Fatalf("Expected the entry to be copied, got %+v", fulfilled)
+	}
+	orders, _ := database.GetReadyOrders(db, clone.ID)
+	if len(orders) != 2 {
+		t.Fatalf("Expected the working orders to be copied, got %+v", orders)
+	}
+	for _, order := range orders {
+		if order.EntryOrderID == nil || *order.EntryOrderID != fulfilled[0].ID {
+			t.Errorf("Expected the linked order to point at the copied entry, got %+v", order)
+		}
+	}
+	fills, _ := database.GetFillsForAccount(db, clone.ID)
+	if len(fills) != 1 || fills[0].OrderID != fulfilled[0].ID || fills[0].Price != 4500 {
+		t.Errorf("Expected only the open lot's fill to be copied onto the copied entry, got %+v", fills)
+	}
+	if trades, _ := analytics.GetTrades(db, clone); len(trades) != 0 {
+		t.Errorf("Expected the parent's trades to stay with it, got %+v", trades)
+	}
+	if trades, _ := analytics.GetTrades(db, parent); len(trades) != 1 {
+		t.Errorf("Expected the parent to keep its trade, got %+v", trades)
+	}
+	positions, _ := database.GetPositionsForAccount(db, clone.ID)
+	if len(positions) != 1 || len(positions[0].Lots) != 1 || positions[0].Price != 4500 {
+		t.Errorf("Expected the position and its lot to be copied, got %+v", positions)
+	}
+	if discrepancies := verifyLedger(t, db, clone.ID); len(discrepancies) != 0 {
+		t.Errorf("Expected the branch's ledger to match it, got %+v", discrepancies)
+	}
+
+	branches, _ := database.GetBranchesOfAccount(db, parent.ID)
+	if len(branches) != 1 || branches[0].ID != clone.ID {
+		t.Errorf("Expected the clone to be a branch of the parent, got %+v", branches)
+	}
+	parentOrders, _ := database.GetReadyOrders(db, parent.ID)
+	if len(parentOrders) != 2 {
+		t.Errorf("Expected the parent's orders to be left alone, got %+v", parentOrders)
+	}
+}
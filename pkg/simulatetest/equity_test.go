@@ -0,0 +1,84 @@
+package simulatetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func TestMarkToMarket(t *testing.T) {
+	account := database.Account{
+		RealizedPnL: 1000,
+		Date:        time.Date(2024, 3, 5, 15, 0, 0, 0, time.UTC),
+	}
+	positions := testLongPosition()
+
+	equity, newDay := simulate.MarkToMarket(&account, positions, map[uint]float64{1: 4510})
+	if !newDay {
+		t.Fatalf("Expected the first mark to start a trading day")
+	}
+	if equity.UnrealizedPnL != 500 || equity.NetLiquidationValue != 1500 {
+		t.Errorf("Expected 500 unrealized and 1500 net liquidation value, got %+v", equity)
+	}
+	if equity.DayPnL != 0 || account.DayStartValue != 1500 || positions[0].DayPrice != 4510 {
+		t.Errorf("Expected the day to start at the current value, got %+v and %+v", account, positions[0])
+	}
+
+	// Later the same day the day P&L is measured from the first mark
+	account.Date = account.Date.Add(2 * time.Hour)
+	equity, newDay = simulate.MarkToMarket(&account, positions, map[uint]float64{1: 4505})
+	if newDay {
+		t.Errorf("Expected the same trading day")
+	}
+	if equity.DayPnL != -250 || equity.Positions[0].DayPnL != -250 || equity.UnrealizedPnL != 250 {
+		t.Errorf("Expected a 250 loss on the day, got %+v", equity)
+	}
+	if account.NetLiquidationValue != 1250 {
+		t.Errorf("Expected the account to keep its net liquidation value, got %v", account.NetLiquidationValue)
+	}
+
+	// The session reopening in the evening starts the next trading day
+	account.Date = time.Date(2024, 3, 5, 23, 0, 0, 0, time.UTC)
+	equity, newDay = simulate.MarkToMarket(&account, positions, map[uint]float64{1: 4505})
+	if !newDay || equity.DayPnL != 0 || positions[0].DayPrice != 4505 {
+		t.Errorf("Expected a new trading day, got %+v", equity)
+	}
+}
+
+func TestUpdateSimulated_KeepsOtherChanges(t *testing.T) {
+	db, err := SetupInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to set up database: %v", err)
+	}
+	account := database.Account{Name: "Replay", UserID: 1, Date: time.Date(2024, 3, 5, 15, 0, 0, 0, time.UTC), RealizedPnL: 1000, LotMatching: "fifo"}
+	if err := account.Create(db); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+
+	// A replay's copy of the account goes stale while a handler renames it
+	simulated := account
+	renamed := account
+	renamed.Name = "Renamed"
+	renamed.LotMatching = "lifo"
+	if err := renamed.Update(db); err != nil {
+		t.Fatalf("Failed to update account: %v", err)
+	}
+	simulated.Date = simulated.Date.Add(time.Minute)
+	simulate.MarkToMarket(&simulated, nil, nil)
+	if err := simulated.UpdateSimulated(db); err != nil {
+		t.Fatalf("UpdateSimulated returned unexpected error: %v", err)
+	}
+
+	saved, err := database.GetAccountByID(db, account.ID)
+	if err != nil {
+		t.Fatalf("Failed to get account: %v", err)
+	}
+	if saved.Name != "Renamed" || saved.LotMatching != "lifo" {
+		t.Errorf("Expected the handler's changes to be kept, got %+v", saved)
+	}
+	if !saved.Date.Equal(simulated.Date) || saved.NetLiquidationValue != 1000 || !saved.TradingDay.Equal(simulated.TradingDay) {
+		t.Errorf("Expected the simulated date and marks to be saved, got %+v", saved)
+	}
+}
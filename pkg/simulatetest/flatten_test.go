@@ -0,0 +1,48 @@
+package simulatetest
+
+import (
+	"testing"
+
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func TestFlattenOrders(t *testing.T) {
+	positions := append(testLongPosition(), database.Position{
+		AccountID: 1, SymbolID: 2, Direction: "sell", Price: 15000, Quantity: 3,
+	})
+
+	orders := simulate.FlattenOrders(positions, testActivatedAt)
+	if len(orders) != 2 {
+		t.Fatalf("Expected an order per position, got %+v", orders)
+	}
+	if orders[0].SymbolID != 1 || orders[0].Direction != "sell" || orders[0].Quantity != 1 || orders[0].OrderType != "market" {
+		t.Errorf("Expected a market sell for 1 of symbol 1, got %+v", orders[0])
+	}
+	if orders[1].SymbolID != 2 || orders[1].Direction != "buy" || orders[1].Quantity != 3 || orders[1].ActivatedAt == nil {
+		t.Errorf("Expected an active market buy for 3 of symbol 2, got %+v", orders[1])
+	}
+}
+
+func TestFillAtLastPrices(t *testing.T) {
+	positions := testLongPosition()
+	orders := simulate.FlattenOrders(positions, testActivatedAt)
+
+	orders, positions, cash := simulate.FillAtLastPrices(orders, positions, map[uint]float64{1: 4510}, simulate.Config{}, testActivatedAt)
+	if len(positions) != 0 {
+		t.Errorf("Expected the position to be closed, got %+v", positions)
+	}
+	if orders[0].FulfilledAt == nil || orders[0].FulfilledPrice != 4510 || len(orders[0].PendingFills) != 1 {
+		t.Errorf("Expected the order to fill at the last price, got %+v", orders[0])
+	}
+	if cash != 500 {
+		t.Errorf("Expected to make 500, got %v", cash)
+	}
+
+	// Without a last price there's nothing to fill at
+	orders = simulate.FlattenOrders(testLongPosition(), testActivatedAt)
+	orders, positions, _ = simulate.FillAtLastPrices(orders, testLongPosition(), nil, simulate.Config{}, testActivatedAt)
+	if orders[0].FulfilledAt != nil || len(positions) != 1 {
+		t.Errorf("Expected the order to be left working, got %+v", orders[0])
+	}
+}
@@ -13,7 +13,9 @@ func TestIncDate_SimpleBuySell(t *testing.T) {
     t.Fatalf("Failed to set up database: %v", err)
   }
   // Assume you have a function to populate test users, accounts, and orders in your test DB
-  populateTestData(db)
+  if err := populateTestData(db); err != nil {
+    t.Fatalf("Failed to populate test data: %v", err)
+  }
 
   barData := NewInMemoryBarData()
   // Load your bar data for the test
@@ -22,7 +24,7 @@ func TestIncDate_SimpleBuySell(t *testing.T) {
   accountID := uint(1) // Assuming you have a test account with this ID
   inc := "1d"          // Example increment
 
-  account, activeOrders, _, _, err := simulate.IncDate(db, authInfo, barData, accountID, inc)
+  account, activeOrders, _, _, _, err := simulate.IncDate(db, authInfo, barData, accountID, inc)
   if err != nil {
     t.Errorf("IncDate returned unexpected error: %v", err)
   }
@@ -32,5 +34,9 @@ func TestIncDate_SimpleBuySell(t *testing.T) {
     t.Errorf("Expected account ID to be %d, got %d", accountID, account.ID)
   }
 
+  if len(activeOrders) != 0 {
+    t.Errorf("Expected no active orders, got %d", len(activeOrders))
+  }
+
   // Additional assertions for activeOrders, filledOrders, and positions, depending on your scenario.
 }
@@ -0,0 +1,98 @@
+package simulatetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/auth"
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+	"gorm.io/gorm"
+)
+
+func placeLedgerTestOrder(t *testing.T, db *gorm.DB, account database.Account, direction string) {
+	order := database.Order{
+		AccountID:   account.ID,
+		SymbolID:    1,
+		Direction:   direction,
+		Quantity:    1,
+		OrderType:   "market",
+		CreatedAt:   &account.Date,
+		ActivatedAt: &account.Date,
+	}
+	if err := order.Create(db); err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+	if err := database.RecordOrder(db, "order-placed", order, account.Date); err != nil {
+		t.Fatalf("Failed to record order: %v", err)
+	}
+}
+
+func verifyLedger(t *testing.T, db *gorm.DB, accountID uint) []simulate.LedgerDiscrepancy {
+	account, err := database.GetAccountByID(db, accountID)
+	if err != nil {
+		t.Fatalf("Failed to get account: %v", err)
+	}
+	events, err := database.GetLedgerForAccount(db, accountID)
+	if err != nil {
+		t.Fatalf("Failed to get ledger: %v", err)
+	}
+	projection, err := simulate.ProjectLedger(events, account.LotMatching)
+	if err != nil {
+		t.Fatalf("ProjectLedger returned unexpected error: %v", err)
+	}
+	orders, _ := database.GetReadyOrders(db, accountID)
+	positions, _ := database.GetPositionsForAccount(db, accountID)
+	return simulate.VerifyProjection(projection, account.RealizedPnL, orders, positions)
+}
+
+func TestLedger_RebuildsAccount(t *testing.T) {
+	db, err := SetupInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to set up database: %v", err)
+	}
+	if err := populateTestData(db); err != nil {
+		t.Fatalf("Failed to populate test data: %v", err)
+	}
+	start := time.Date(2023, 11, 1, 9, 30, 0, 0, time.UTC)
+	account := database.Account{Name: "Ledger Account", UserID: 1, Date: start, RealizedPnL: 50000}
+	if err := account.Create(db); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+
+	barData := NewInMemoryBarData()
+	barData.AddBars(1, []bars.Bar{
+		{Date: start.Add(time.Minute).UnixMilli(), Open: 4500, High: 4501, Low: 4499, Close: 4500, Volume: 100},
+		{Date: start.Add(6 * time.Minute).UnixMilli(), Open: 4510, High: 4511, Low: 4509, Close: 4510, Volume: 100},
+	})
+	authInfo := &auth.AuthContext{UserID: 1}
+
+	placeLedgerTestOrder(t, db, account, "buy")
+	account, _, _, _, _, err = simulate.IncDate(db, authInfo, barData, account.ID, "5m")
+	if err != nil {
+		t.Fatalf("IncDate returned unexpected error: %v", err)
+	}
+	placeLedgerTestOrder(t, db, account, "sell")
+	account, _, _, positions, _, err := simulate.IncDate(db, authInfo, barData, account.ID, "5m")
+	if err != nil {
+		t.Fatalf("IncDate returned unexpected error: %v", err)
+	}
+	if len(positions) != 0 || account.RealizedPnL != 50500 {
+		t.Fatalf("Expected a flat account with 50500, got %v and %+v", account.RealizedPnL, positions)
+	}
+
+	if discrepancies := verifyLedger(t, db, account.ID); len(discrepancies) != 0 {
+		t.Errorf("Expected the ledger to match the account, got %+v", discrepancies)
+	}
+
+	// Changing the account without going through the ledger shows up
+	account.RealizedPnL = 60000
+	if err := account.Update(db); err != nil {
+		t.Fatalf("Failed to update account: %v", err)
+	}
+	discrepancies := verifyLedger(t, db, account.ID)
+	if len(discrepancies) != 1 || discrepancies[0].Field != "cash" || discrepancies[0].Rebuilt != "50500.00" {
+		t.Errorf("Expected a cash discrepancy, got %+v", discrepancies)
+	}
+}
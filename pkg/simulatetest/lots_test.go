@@ -0,0 +1,123 @@
+package simulatetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/analytics"
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func TestSimulateBars_LotMatching(t *testing.T) {
+	tests := []struct {
+		method        string
+		expectedCash  float64
+		expectedPrice float64
+	}{
+		{"fifo", 1500, 4520},
+		{"lifo", 500, 4500},
+		{"average", 1000, 4510},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			positions := []database.Position{{
+				AccountID: 1, SymbolID: 1, Direction: "buy", Price: 4510, Quantity: 2,
+				Lots: []database.Lot{
+					{AccountID: 1, SymbolID: 1, Direction: "buy", Price: 4500, Quantity: 1},
+					{AccountID: 1, SymbolID: 1, Direction: "buy", Price: 4520, Quantity: 1},
+				},
+			}}
+
+			_, _, positions, cash, err := simulate.SimulateBars(
+				map[uint][]bars.Bar{1: {testBar(0, 4530, 4531, 4529, 4530)}},
+				[]database.Order{testOrder(1, "market", "sell", 0)},
+				positions,
+				simulate.Config{LotMatching: tt.method},
+			)
+			if err != nil {
+				t.Fatalf("SimulateBars returned unexpected error: %v", err)
+			}
+			if cash != tt.expectedCash {
+				t.Errorf("Expected cash %v, got %v", tt.expectedCash, cash)
+			}
+			if len(positions) != 1 || positions[0].Quantity != 1 || positions[0].Price != tt.expectedPrice {
+				t.Errorf("Expected one contract left at %v, got %+v", tt.expectedPrice, positions)
+			}
+		})
+	}
+}
+
+func TestSimulateBars_NetsPositions(t *testing.T) {
+	buy := testOrder(1, "market", "buy", 0)
+	buy.Quantity = 3
+
+	_, _, positions, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(0, 4520, 4521, 4519, 4520)}},
+		[]database.Order{buy},
+		testLongPosition(),
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if len(positions) != 1 {
+		t.Fatalf("Expected one net position, got %+v", positions)
+	}
+	if positions[0].Quantity != 4 || positions[0].Price != 4515 || len(positions[0].Lots) != 2 {
+		t.Errorf("Expected 4 contracts at an average of 4515 in two lots, got %+v", positions[0])
+	}
+}
+
+func TestMatchLots_Flip(t *testing.T) {
+	open := []database.Lot{{Direction: "buy", Price: 4500, Quantity: 2}}
+
+	lots, closed := simulate.MatchLots("fifo", open, database.Lot{Direction: "sell", Price: 4510, Quantity: 3})
+	if len(closed) != 1 || closed[0].Quantity != 2 || closed[0].Price != 4500 {
+		t.Errorf("Expected the long lot to be closed, got %+v", closed)
+	}
+	if len(lots) != 1 || lots[0].Direction != "sell" || lots[0].Quantity != 1 || lots[0].Price != 4510 {
+		t.Errorf("Expected a short lot of 1 at 4510, got %+v", lots)
+	}
+	if open[0].Quantity != 2 {
+		t.Errorf("Expected the open lots to be left alone, got %+v", open)
+	}
+}
+
+func TestGetTrades_KeepsFillLotMatching(t *testing.T) {
+	db, err := SetupInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to set up database: %v", err)
+	}
+	if err := populateTestData(db); err != nil {
+		t.Fatalf("Failed to populate test data: %v", err)
+	}
+	// The account has been switched to FIFO since its fills were matched LIFO
+	account := database.Account{Name: "Lot Matching Account", UserID: 1, Date: testActivatedAt, LotMatching: "fifo"}
+	if err := account.Create(db); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+	for i, fill := range []database.Fill{
+		{Direction: "buy", Price: 4500},
+		{Direction: "buy", Price: 4520},
+		{Direction: "sell", Price: 4530},
+	} {
+		fill.AccountID = account.ID
+		fill.SymbolID = 1
+		fill.Quantity = 1
+		fill.LotMatching = "lifo"
+		fill.FilledAt = testActivatedAt.Add(time.Duration(i+1) * time.Minute)
+		if err := db.Create(&fill).Error; err != nil {
+			t.Fatalf("Failed to create fill: %v", err)
+		}
+	}
+
+	trades, err := analytics.GetTrades(db, account)
+	if err != nil {
+		t.Fatalf("GetTrades returned unexpected error: %v", err)
+	}
+	if len(trades) != 1 || trades[0].EntryPrice != 4520 {
+		t.Errorf("Expected the sell matched LIFO against 4520, got %+v", trades)
+	}
+}
@@ -0,0 +1,116 @@
+package simulatetest
+
+import (
+	"testing"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func testLongPosition() []database.Position {
+	return []database.Position{
+		{AccountID: 1, SymbolID: 1, Direction: "buy", Price: 4500, Quantity: 1},
+	}
+}
+
+func TestSimulateBars_MarginCallLiquidates(t *testing.T) {
+	stop := testOrder(1, "stop", "sell", 4470)
+
+	// ES needs 11500 of maintenance margin, so 12000 of cash is used up
+	// after a 10 point loss
+	didExecute, orders, positions, cash, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(0, 4498, 4499, 4480, 4485)}},
+		[]database.Order{stop},
+		testLongPosition(),
+		simulate.Config{Margin: &simulate.MarginAccount{Cash: 12000}},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if !didExecute || len(positions) != 0 {
+		t.Fatalf("Expected the position to be liquidated, got %+v", positions)
+	}
+	var liquidation *database.Order
+	for i, order := range orders {
+		if order.Liquidation {
+			liquidation = &orders[i]
+		} else if order.ID == 1 && order.CancelledAt == nil {
+			t.Errorf("Expected the working stop to be cancelled")
+		}
+	}
+	if liquidation == nil {
+		t.Fatalf("Expected a liquidation order, got %+v", orders)
+	}
+	if liquidation.ID != 0 || liquidation.Direction != "sell" || liquidation.FulfilledAt == nil {
+		t.Errorf("Expected a new filled sell order, got %+v", liquidation)
+	}
+	if liquidation.FulfilledPrice != 4490 || len(liquidation.PendingFills) != 1 || !liquidation.PendingFills[0].Liquidation {
+		t.Errorf("Expected a liquidation fill at 4490, got %+v", liquidation)
+	}
+	if cash != -500 {
+		t.Errorf("Expected to lose 500, got %v", cash)
+	}
+}
+
+func TestSimulateBars_StopBeforeMarginCall(t *testing.T) {
+	stop := testOrder(1, "stop", "sell", 4495)
+
+	_, orders, positions, cash, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(0, 4498, 4499, 4480, 4485)}},
+		[]database.Order{stop},
+		testLongPosition(),
+		simulate.Config{Margin: &simulate.MarginAccount{Cash: 12000}},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if len(positions) != 0 || len(orders) != 1 || orders[0].FulfilledAt == nil {
+		t.Fatalf("Expected the stop to close the position, got %+v", orders)
+	}
+	if cash != -250 {
+		t.Errorf("Expected to lose 250, got %v", cash)
+	}
+}
+
+func TestCheckBuyingPower(t *testing.T) {
+	entry := testOrder(1, "limit", "buy", 4490)
+	if errs := simulate.CheckBuyingPower("entryOrder", 10000, nil, nil, []database.Order{entry}, nil); len(errs) != 1 {
+		t.Errorf("Expected 10000 not to cover the initial margin of one ES, got %v", errs)
+	}
+	if errs := simulate.CheckBuyingPower("entryOrder", 15000, nil, nil, []database.Order{entry}, nil); len(errs) != 0 {
+		t.Errorf("Expected 15000 to cover one ES, got %v", errs)
+	}
+
+	// Closing a position never needs more margin, however little cash is left
+	exit := testOrder(2, "market", "sell", 0)
+	lastPrices := map[uint]float64{1: 4400}
+	if errs := simulate.CheckBuyingPower("entryOrder", 5000, testLongPosition(), nil, []database.Order{exit}, lastPrices); len(errs) != 0 {
+		t.Errorf("Expected closing the position to be allowed, got %v", errs)
+	}
+}
+
+func TestCheckModifiedBuyingPower(t *testing.T) {
+	entry := testOrder(1, "limit", "buy", 4490)
+	workingOrders := []database.Order{entry}
+
+	// Moving the price keeps the same margin, which isn't counted twice
+	price := 4480.0
+	moved := entry
+	if errs := simulate.ModifyOrder(&moved, simulate.OrderModification{Price: &price}, false); len(errs) != 0 {
+		t.Fatalf("ModifyOrder: %v", errs)
+	}
+	if errs := simulate.CheckModifiedBuyingPower("order", 15000, nil, workingOrders, moved, nil); len(errs) != 0 {
+		t.Errorf("Expected 15000 to still cover one ES, got %v", errs)
+	}
+
+	// Raising the quantity past the initial margin is rejected like a new order
+	quantity := 3
+	raised := entry
+	if errs := simulate.ModifyOrder(&raised, simulate.OrderModification{Quantity: &quantity}, false); len(errs) != 0 {
+		t.Fatalf("ModifyOrder: %v", errs)
+	}
+	if errs := simulate.CheckModifiedBuyingPower("order", 15000, nil, workingOrders, raised, nil); len(errs) != 1 || errs[0].Field != "order.quantity" {
+		t.Errorf("Expected 15000 not to cover three ES, got %v", errs)
+	}
+}
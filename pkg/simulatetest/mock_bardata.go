@@ -21,7 +21,34 @@ func (m *InMemoryBarData) AddBars(symbolID uint, barsData []bars.Bar) {
 	m.Bars[symbolID] = barsData
 }
 
+// GetBars returns all the bars for the requested symbolID.
+func (m *InMemoryBarData) GetBars(req bars.GetBarsRequest) ([]bars.Bar, error) {
+	return m.Bars[req.SymbolID], nil
+}
+
 // GetBarsBetween fetches bars between given dates for a specific symbolID.
 func (m *InMemoryBarData) GetBarsBetween(req bars.GetBarsBetweenRequest) ([]bars.Bar, error) {
-	return m.Bars[req.SymbolID], nil
+	var ret []bars.Bar
+	for _, bar := range m.Bars[req.SymbolID] {
+		if bar.Date > req.StartDate && bar.Date <= req.EndDate {
+			ret = append(ret, bar)
+		}
+	}
+	return ret, nil
+}
+
+// GetLastPrices returns the close of the last bar at or before enddate.
+func (m *InMemoryBarData) GetLastPrices(enddate int64, symbolID uint) (map[uint]float64, error) {
+	lastPrices := make(map[uint]float64)
+	for _, bar := range m.Bars[symbolID] {
+		if bar.Date <= enddate {
+			lastPrices[symbolID] = bar.Close
+		}
+	}
+	return lastPrices, nil
+}
+
+// GetSymbolDateRanges is not needed by the tests.
+func (m *InMemoryBarData) GetSymbolDateRanges() ([]bars.SymbolDateRange, error) {
+	return nil, nil
 }
@@ -1,6 +1,8 @@
 package simulatetest
 
 import (
+	"time"
+
 	"github.com/tradingcage/tradingcage-go/pkg/database"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -14,7 +16,7 @@ func SetupInMemoryDB() (*gorm.DB, error) {
 	}
 
 	// Migrate the schema
-	if err := db.AutoMigrate(&database.User{}, &database.Account{}, &database.Order{}, &database.Position{}); err != nil {
+	if err := db.AutoMigrate(&database.User{}, &database.Account{}, &database.Order{}, &database.Position{}, &database.CostSetting{}, &database.Fill{}, &database.OrderEvent{}, &database.Lot{}, &database.LedgerEvent{}, &database.Rewind{}); err != nil {
 		return nil, err
 	}
 
@@ -22,3 +24,19 @@ func SetupInMemoryDB() (*gorm.DB, error) {
 
 	return db, nil
 }
+
+// populateTestData inserts a test user with a single account that has no
+// orders or positions.
+func populateTestData(db *gorm.DB) error {
+	user := database.User{Username: "test@example.com"}
+	if err := db.FirstOrCreate(&user, database.User{Username: user.Username}).Error; err != nil {
+		return err
+	}
+	account := database.Account{
+		Name:        "Test Account",
+		UserID:      user.ID,
+		Date:        time.Date(2023, 11, 1, 9, 30, 0, 0, time.UTC),
+		RealizedPnL: 10000,
+	}
+	return db.FirstOrCreate(&account, database.Account{Name: account.Name}).Error
+}
@@ -0,0 +1,71 @@
+package simulatetest
+
+import (
+	"testing"
+
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func TestModifyOrder_KeepsBracketLink(t *testing.T) {
+	orders, _ := testBracket()
+	stop := orders[1]
+	price := 4492.0
+	quantity := 2
+	if errs := simulate.ModifyOrder(&stop, simulate.OrderModification{Price: &price, Quantity: &quantity}, false); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	if stop.ID != 3 || stop.EntryOrderID == nil || *stop.EntryOrderID != 1 {
+		t.Errorf("Expected the order to keep its ID and bracket link, got %+v", stop)
+	}
+	if stop.Price != 4492 || stop.Quantity != 2 {
+		t.Errorf("Expected price 4492 and quantity 2, got %v and %v", stop.Price, stop.Quantity)
+	}
+}
+
+func TestModifyOrder_Invalid(t *testing.T) {
+	order := testOrder(1, "limit", "buy", 4499)
+	order.Quantity = 5
+	order.FilledQuantity = 3
+	quantity := 3
+	price := 4499.1
+	errs := simulate.ModifyOrder(&order, simulate.OrderModification{Price: &price, Quantity: &quantity}, false)
+	fields := make(map[string]bool)
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	if !fields["order.price"] || !fields["order.quantity"] {
+		t.Errorf("Expected price and quantity errors, got %v", errs)
+	}
+	if order.Price != 4499 || order.Quantity != 5 {
+		t.Errorf("Expected the order to be left alone, got %+v", order)
+	}
+
+	order.FulfilledAt = &testActivatedAt
+	quantity = 6
+	if errs := simulate.ModifyOrder(&order, simulate.OrderModification{Quantity: &quantity}, false); len(errs) != 1 {
+		t.Errorf("Expected filled orders to be rejected, got %v", errs)
+	}
+}
+
+func TestModifyOrder_TrailingStop(t *testing.T) {
+	order := testOrder(1, "trailing-stop", "sell", 4502)
+	order.TrailAmount = 2
+	order.TrailUnit = "points"
+	order.HighWaterMark = 4504
+	trail := 4.0
+	if errs := simulate.ModifyOrder(&order, simulate.OrderModification{TrailAmount: &trail}, false); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	if order.Price != 4500 || order.HighWaterMark != 4504 {
+		t.Errorf("Expected the stop to move to 4500 under the same mark, got %v under %v", order.Price, order.HighWaterMark)
+	}
+
+	orderType := "stop"
+	price := 4495.0
+	if errs := simulate.ModifyOrder(&order, simulate.OrderModification{OrderType: &orderType, Price: &price}, false); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	if order.OrderType != "stop" || order.Price != 4495 || order.HighWaterMark != 0 {
+		t.Errorf("Expected a plain stop at 4495, got %+v", order)
+	}
+}
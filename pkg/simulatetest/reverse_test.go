@@ -0,0 +1,61 @@
+package simulatetest
+
+import (
+	"testing"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func TestSimulateBars_Reversal(t *testing.T) {
+	legs, positions := testBracket()
+	positions[0].Quantity = 2
+	sell := testOrder(4, "market", "sell", 0)
+	sell.Quantity = 5
+
+	_, orders, positions, cash, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(0, 4505, 4506, 4504, 4505)}},
+		append(legs, sell),
+		positions,
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if cash != 500 {
+		t.Errorf("Expected to realize 500 closing the long, got %v", cash)
+	}
+	if len(positions) != 1 || positions[0].Direction != "sell" || positions[0].Quantity != 3 {
+		t.Errorf("Expected a short position of 3, got %+v", positions)
+	}
+	for _, order := range orders {
+		switch order.ID {
+		case 2, 3:
+			if order.CancelledAt == nil {
+				t.Errorf("Expected the old position's bracket leg %d to be cancelled", order.ID)
+			}
+		case 4:
+			if len(order.PendingFills) != 2 ||
+				order.PendingFills[0].Leg != "close" || order.PendingFills[0].Quantity != 2 ||
+				order.PendingFills[1].Leg != "open" || order.PendingFills[1].Quantity != 3 {
+				t.Errorf("Expected a closing leg of 2 and an opening leg of 3, got %+v", order.PendingFills)
+			}
+		}
+	}
+}
+
+func TestReversePosition(t *testing.T) {
+	order := database.Order{SymbolID: 1, OrderType: "limit"}
+	if errs := simulate.ReversePosition("entryOrder", &order, testLongPosition()); len(errs) > 0 {
+		t.Fatalf("ReversePosition returned unexpected errors: %v", errs)
+	}
+	if order.OrderType != "market" || order.Direction != "sell" || order.Quantity != 2 {
+		t.Errorf("Expected a market sell for 2, got %+v", order)
+	}
+
+	order = database.Order{SymbolID: 2}
+	if errs := simulate.ReversePosition("entryOrder", &order, testLongPosition()); len(errs) != 1 {
+		t.Errorf("Expected an error reversing a symbol with no position, got %v", errs)
+	}
+}
@@ -0,0 +1,137 @@
+package simulatetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/auth"
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func TestRewindAccount(t *testing.T) {
+	db, err := SetupInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to set up database: %v", err)
+	}
+	if err := populateTestData(db); err != nil {
+		t.Fatalf("Failed to populate test data: %v", err)
+	}
+	start := time.Date(2023, 11, 2, 9, 30, 0, 0, time.UTC)
+	account := database.Account{Name: "Rewind Account", UserID: 1, Date: start, RealizedPnL: 50000}
+	if err := account.Create(db); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+
+	barData := NewInMemoryBarData()
+	barData.AddBars(1, []bars.Bar{
+		{Date: start.Add(time.Minute).UnixMilli(), Open: 4500, High: 4501, Low: 4499, Close: 4500, Volume: 100},
+		{Date: start.Add(6 * time.Minute).UnixMilli(), Open: 4510, High: 4511, Low: 4509, Close: 4510, Volume: 100},
+	})
+	authInfo := &auth.AuthContext{UserID: 1}
+
+	placeLedgerTestOrder(t, db, account, "buy")
+	account, _, _, _, _, err = simulate.IncDate(db, authInfo, barData, account.ID, "5m")
+	if err != nil {
+		t.Fatalf("IncDate returned unexpected error: %v", err)
+	}
+	placeLedgerTestOrder(t, db, account, "sell")
+	account, _, _, _, _, err = simulate.IncDate(db, authInfo, barData, account.ID, "5m")
+	if err != nil {
+		t.Fatalf("IncDate returned unexpected error: %v", err)
+	}
+
+	// Going forward isn't a rewind
+	_, _, _, err = simulate.RewindAccount(db, authInfo, barData, account.ID, account.Date.Add(time.Minute))
+	var validationErrors simulate.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		t.Fatalf("Expected validation errors, got %v", err)
+	}
+
+	// Back to between the buy filling and the sell being placed
+	to := start.Add(3 * time.Minute)
+	account, positions, equity, err := simulate.RewindAccount(db, authInfo, barData, account.ID, to)
+	if err != nil {
+		t.Fatalf("RewindAccount returned unexpected error: %v", err)
+	}
+	if !account.Date.Equal(to) || account.RealizedPnL != 50000 {
+		t.Errorf("Expected the account back at %v with 50000, got %v with %v", to, account.Date, account.RealizedPnL)
+	}
+	if len(positions) != 1 || positions[0].Direction != "buy" || positions[0].Price != 4500 {
+		t.Errorf("Expected the long position to be back, got %+v", positions)
+	}
+	if equity.NetLiquidationValue != 50000 {
+		t.Errorf("Expected a net liquidation value of 50000, got %v", equity.NetLiquidationValue)
+	}
+
+	orders, _ := database.GetReadyOrders(db, account.ID)
+	fills, _ := database.GetFillsForAccount(db, account.ID)
+	if len(orders) != 0 || len(fills) != 1 || fills[0].Direction != "buy" {
+		t.Errorf("Expected the sell to be archived, got orders %+v and fills %+v", orders, fills)
+	}
+	if discrepancies := verifyLedger(t, db, account.ID); len(discrepancies) != 0 {
+		t.Errorf("Expected the ledger to match the rewound account, got %+v", discrepancies)
+	}
+
+	rewinds, _ := database.GetRewindsForAccount(db, account.ID)
+	if len(rewinds) != 1 || rewinds[0].RealizedPnL != 50500 || !rewinds[0].FromDate.Equal(start.Add(10*time.Minute)) {
+		t.Fatalf("Expected the rewound attempt to be kept, got %+v", rewinds)
+	}
+	rewound, _ := database.GetRewoundFills(db, rewinds[0].ID)
+	if len(rewound) != 1 || rewound[0].Direction != "sell" || rewound[0].Price != 4510 {
+		t.Errorf("Expected the sell fill to be archived under the rewind, got %+v", rewound)
+	}
+}
+
+func TestRewindAccount_WithinStep(t *testing.T) {
+	db, err := SetupInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to set up database: %v", err)
+	}
+	if err := populateTestData(db); err != nil {
+		t.Fatalf("Failed to populate test data: %v", err)
+	}
+	start := time.Date(2023, 11, 2, 9, 30, 0, 0, time.UTC)
+	account := database.Account{Name: "Rewind Account", UserID: 1, Date: start, RealizedPnL: 50000}
+	if err := account.Create(db); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+
+	barData := NewInMemoryBarData()
+	barData.AddBars(1, []bars.Bar{
+		{Date: start.Add(time.Minute).UnixMilli(), Open: 4500, High: 4501, Low: 4499, Close: 4500, Volume: 100},
+		{Date: start.Add(6 * time.Minute).UnixMilli(), Open: 4510, High: 4511, Low: 4509, Close: 4510, Volume: 100},
+	})
+	authInfo := &auth.AuthContext{UserID: 1}
+
+	placeLedgerTestOrder(t, db, account, "buy")
+	account, _, _, _, _, err = simulate.IncDate(db, authInfo, barData, account.ID, "5m")
+	if err != nil {
+		t.Fatalf("IncDate returned unexpected error: %v", err)
+	}
+	placeLedgerTestOrder(t, db, account, "sell")
+	account, _, _, _, _, err = simulate.IncDate(db, authInfo, barData, account.ID, "5m")
+	if err != nil {
+		t.Fatalf("IncDate returned unexpected error: %v", err)
+	}
+
+	// Back to after the sell filled at 09:36, but before the step it filled
+	// in ended at 09:40, so the round trip's profit is kept
+	to := start.Add(8 * time.Minute)
+	account, positions, _, err := simulate.RewindAccount(db, authInfo, barData, account.ID, to)
+	if err != nil {
+		t.Fatalf("RewindAccount returned unexpected error: %v", err)
+	}
+	if account.RealizedPnL != 50500 || len(positions) != 0 {
+		t.Errorf("Expected 50500 with no positions, got %v with %+v", account.RealizedPnL, positions)
+	}
+	fills, _ := database.GetFillsForAccount(db, account.ID)
+	if len(fills) != 2 {
+		t.Errorf("Expected both fills to be kept, got %+v", fills)
+	}
+	if discrepancies := verifyLedger(t, db, account.ID); len(discrepancies) != 0 {
+		t.Errorf("Expected the ledger to match the rewound account, got %+v", discrepancies)
+	}
+}
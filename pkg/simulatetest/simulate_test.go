@@ -0,0 +1,553 @@
+package simulatetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/auth"
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+var testActivatedAt = time.Date(2023, 11, 1, 9, 30, 0, 0, time.UTC)
+
+func testOrder(id uint, orderType string, direction string, price float64) database.Order {
+	return database.Order{
+		ID:          id,
+		AccountID:   1,
+		SymbolID:    1,
+		Direction:   direction,
+		Price:       price,
+		Quantity:    1,
+		OrderType:   orderType,
+		ActivatedAt: &testActivatedAt,
+	}
+}
+
+func testBar(minute int64, open, high, low, close float64) bars.Bar {
+	return bars.Bar{
+		Date:   testActivatedAt.UnixMilli() + (minute+1)*time.Minute.Milliseconds(),
+		Open:   open,
+		High:   high,
+		Low:    low,
+		Close:  close,
+		Volume: 100,
+	}
+}
+
+func TestSimulateBars_OrderTypes(t *testing.T) {
+	tests := []struct {
+		name       string
+		order      database.Order
+		bar        bars.Bar
+		wantFilled bool
+		wantPrice  float64
+	}{
+		{
+			name:       "market fills at open",
+			order:      testOrder(1, "market", "buy", 0),
+			bar:        testBar(0, 4500, 4502, 4498, 4501),
+			wantFilled: true,
+			wantPrice:  4500,
+		},
+		{
+			name:       "buy limit fills at limit",
+			order:      testOrder(1, "limit", "buy", 4499),
+			bar:        testBar(0, 4500, 4502, 4498, 4501),
+			wantFilled: true,
+			wantPrice:  4499,
+		},
+		{
+			name:       "buy limit gapped through fills at open",
+			order:      testOrder(1, "limit", "buy", 4505),
+			bar:        testBar(0, 4500, 4502, 4498, 4501),
+			wantFilled: true,
+			wantPrice:  4500,
+		},
+		{
+			name:       "sell limit not touched",
+			order:      testOrder(1, "limit", "sell", 4503),
+			bar:        testBar(0, 4500, 4502, 4498, 4501),
+			wantFilled: false,
+		},
+		{
+			name:       "buy stop fills at stop",
+			order:      testOrder(1, "stop", "buy", 4501),
+			bar:        testBar(0, 4500, 4502, 4498, 4501),
+			wantFilled: true,
+			wantPrice:  4501,
+		},
+		{
+			name:       "buy stop below the bar is not a limit",
+			order:      testOrder(1, "stop", "buy", 4497),
+			bar:        testBar(0, 4500, 4502, 4498, 4501),
+			wantFilled: true,
+			wantPrice:  4500,
+		},
+		{
+			name:       "sell stop gapped through fills at open",
+			order:      testOrder(1, "stop", "sell", 4495),
+			bar:        testBar(0, 4490, 4492, 4488, 4491),
+			wantFilled: true,
+			wantPrice:  4490,
+		},
+		{
+			name:       "sell stop not touched",
+			order:      testOrder(1, "stop", "sell", 4495),
+			bar:        testBar(0, 4500, 4502, 4498, 4501),
+			wantFilled: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			didExecute, orders, _, _, err := simulate.SimulateBars(
+				map[uint][]bars.Bar{1: {tt.bar}},
+				[]database.Order{tt.order},
+				nil,
+				simulate.Config{},
+			)
+			if err != nil {
+				t.Fatalf("SimulateBars returned unexpected error: %v", err)
+			}
+			if didExecute != tt.wantFilled {
+				t.Fatalf("Expected didExecute to be %v, got %v", tt.wantFilled, didExecute)
+			}
+			if !tt.wantFilled {
+				return
+			}
+			if len(orders) != 1 {
+				t.Fatalf("Expected 1 updated order, got %d", len(orders))
+			}
+			if orders[0].FulfilledPrice != tt.wantPrice {
+				t.Errorf("Expected fill price %v, got %v", tt.wantPrice, orders[0].FulfilledPrice)
+			}
+		})
+	}
+}
+
+func TestSimulateBars_StopLimitTriggersWithoutFill(t *testing.T) {
+	order := testOrder(1, "stop-limit", "buy", 4501)
+	order.LimitPrice = 4502
+
+	// The bar gaps above the limit and never comes back down to it
+	didExecute, orders, _, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(0, 4504, 4506, 4503, 4505)}},
+		[]database.Order{order},
+		nil,
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if !didExecute {
+		t.Fatalf("Expected the trigger to be reported so it gets saved")
+	}
+	if len(orders) != 1 || orders[0].FulfilledAt != nil {
+		t.Fatalf("Expected stop-limit not to fill, got %+v", orders)
+	}
+	if orders[0].TriggeredAt == nil {
+		t.Fatalf("Expected stop-limit to be triggered, got %+v", orders)
+	}
+
+	// Once triggered it rests as a limit order at the limit price
+	didExecute, orders, _, _, err = simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(1, 4504, 4504, 4500, 4501)}},
+		orders,
+		nil,
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if !didExecute {
+		t.Fatalf("Expected triggered stop-limit to fill")
+	}
+	if orders[0].FulfilledPrice != 4502 {
+		t.Errorf("Expected fill price 4502, got %v", orders[0].FulfilledPrice)
+	}
+}
+
+func TestAdvanceTo_SavesStopLimitTrigger(t *testing.T) {
+	db, err := SetupInMemoryDB()
+	if err != nil {
+		t.Fatalf("Failed to set up database: %v", err)
+	}
+	if err := populateTestData(db); err != nil {
+		t.Fatalf("Failed to populate test data: %v", err)
+	}
+	account := database.Account{Name: "Stop-Limit Account", UserID: 1, Date: testActivatedAt, RealizedPnL: 50000}
+	if err := account.Create(db); err != nil {
+		t.Fatalf("Failed to create account: %v", err)
+	}
+	order := testOrder(0, "stop-limit", "buy", 4501)
+	order.AccountID = account.ID
+	order.LimitPrice = 4502
+	if err := order.Create(db); err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+
+	// The bar gaps above the limit, triggering the order without filling it
+	barData := NewInMemoryBarData()
+	barData.AddBars(1, []bars.Bar{testBar(0, 4504, 4506, 4503, 4505)})
+	authInfo := &auth.AuthContext{UserID: 1}
+	if _, _, _, _, _, err := simulate.AdvanceTo(db, authInfo, barData, account.ID, testActivatedAt.Add(2*time.Minute)); err != nil {
+		t.Fatalf("AdvanceTo returned unexpected error: %v", err)
+	}
+	saved, err := database.GetOrderByID(db, order.ID)
+	if err != nil {
+		t.Fatalf("Failed to get order: %v", err)
+	}
+	if saved.TriggeredAt == nil || saved.FulfilledAt != nil {
+		t.Errorf("Expected the trigger to be saved without a fill, got %+v", saved)
+	}
+}
+
+func TestSimulateBars_StopLimitFillsAtTrigger(t *testing.T) {
+	order := testOrder(1, "stop-limit", "sell", 4499)
+	order.LimitPrice = 4498
+
+	didExecute, orders, _, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(0, 4500, 4502, 4497, 4498)}},
+		[]database.Order{order},
+		nil,
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if !didExecute {
+		t.Fatalf("Expected stop-limit to fill")
+	}
+	if orders[0].FulfilledPrice != 4499 {
+		t.Errorf("Expected fill price 4499, got %v", orders[0].FulfilledPrice)
+	}
+}
+
+func TestSimulateBars_Costs(t *testing.T) {
+	costs := simulate.NewScheduleCostModel([]database.CostSetting{
+		{SymbolID: 0, CommissionPerContract: 2, ExchangeFeePerContract: 1.5},
+		{SymbolID: 1, CommissionPerContract: 1, ExchangeFeePerContract: 1, SlippageModel: "ticks", SlippageTicks: 1},
+	})
+	entry := testOrder(1, "market", "buy", 0)
+	exit := testOrder(2, "limit", "sell", 4510)
+
+	didExecute, orders, positions, cash, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(0, 4500, 4502, 4498, 4501), testBar(1, 4505, 4512, 4504, 4511)}},
+		[]database.Order{entry, exit},
+		nil,
+		simulate.Config{Costs: costs},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if !didExecute {
+		t.Fatalf("Expected orders to execute")
+	}
+	if len(positions) != 0 {
+		t.Errorf("Expected to be flat, got %d positions", len(positions))
+	}
+	for _, order := range orders {
+		switch order.ID {
+		case 1:
+			if order.FulfilledPrice != 4500.25 || order.Slippage != 0.25 {
+				t.Errorf("Expected market order to slip one tick, got %v (%v)", order.FulfilledPrice, order.Slippage)
+			}
+		case 2:
+			if order.FulfilledPrice != 4510 || order.Slippage != 0 {
+				t.Errorf("Expected limit order not to slip, got %v (%v)", order.FulfilledPrice, order.Slippage)
+			}
+		}
+		if order.Commission != 1 || order.ExchangeFees != 1 {
+			t.Errorf("Expected symbol fees on order %d, got %v and %v", order.ID, order.Commission, order.ExchangeFees)
+		}
+	}
+	// 9.75 points on ES less 4 dollars of fees
+	if want := 9.75*50 - 4; cash != want {
+		t.Errorf("Expected cash %v, got %v", want, cash)
+	}
+}
+
+func testBracket() ([]database.Order, []database.Position) {
+	entryID := uint(1)
+	target := testOrder(2, "limit", "sell", 4510)
+	target.EntryOrderID = &entryID
+	stop := testOrder(3, "stop", "sell", 4490)
+	stop.EntryOrderID = &entryID
+	positions := []database.Position{
+		{AccountID: 1, SymbolID: 1, Direction: "buy", Price: 4500, Quantity: 1},
+	}
+	return []database.Order{target, stop}, positions
+}
+
+func filledOrderID(t *testing.T, orders []database.Order) uint {
+	var filled []uint
+	for _, order := range orders {
+		if order.FulfilledAt != nil {
+			filled = append(filled, order.ID)
+		}
+	}
+	if len(filled) != 1 {
+		t.Fatalf("Expected exactly one bracket leg to fill, got %v", filled)
+	}
+	return filled[0]
+}
+
+func TestSimulateBars_IntrabarPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want uint
+	}{
+		{path: "", want: 3},
+		{path: "pessimistic", want: 3},
+		{path: "optimistic", want: 2},
+		{path: "ohlc", want: 2},
+		{path: "olhc", want: 3},
+	}
+	for _, tt := range tests {
+		orders, positions := testBracket()
+		_, updated, _, _, err := simulate.SimulateBars(
+			map[uint][]bars.Bar{1: {testBar(0, 4500, 4512, 4488, 4505)}},
+			orders,
+			positions,
+			simulate.Config{Intrabar: simulate.PathResolver{Path: tt.path}},
+		)
+		if err != nil {
+			t.Fatalf("SimulateBars returned unexpected error: %v", err)
+		}
+		if got := filledOrderID(t, updated); got != tt.want {
+			t.Errorf("path %q: expected order %d to fill, got %d", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestSimulateBars_IntrabarPathOnEntryBar(t *testing.T) {
+	tests := []struct {
+		path string
+		want uint
+	}{
+		{path: "pessimistic", want: 3},
+		{path: "optimistic", want: 2},
+	}
+	for _, tt := range tests {
+		// The entry fills, and the same bar reaches both its target and stop.
+		// The target comes first, so checking in order would always fill it.
+		entry := testOrder(1, "market", "buy", 0)
+		orders, _ := testBracket()
+		for i := range orders {
+			orders[i].ActivatedAt = nil
+		}
+		orders = append([]database.Order{entry}, orders...)
+		_, updated, positions, _, err := simulate.SimulateBars(
+			map[uint][]bars.Bar{1: {testBar(0, 4500, 4512, 4488, 4505)}},
+			orders,
+			nil,
+			simulate.Config{Intrabar: simulate.PathResolver{Path: tt.path}},
+		)
+		if err != nil {
+			t.Fatalf("SimulateBars returned unexpected error: %v", err)
+		}
+		var legs []database.Order
+		for _, order := range updated {
+			if order.ID != entry.ID {
+				legs = append(legs, order)
+			}
+		}
+		if got := filledOrderID(t, legs); got != tt.want {
+			t.Errorf("path %q: expected order %d to fill, got %d", tt.path, tt.want, got)
+		}
+		if len(positions) != 0 {
+			t.Errorf("path %q: expected the position to be closed, got %+v", tt.path, positions)
+		}
+	}
+}
+
+func TestSimulateBars_IntrabarDrillDown(t *testing.T) {
+	bar := testBar(0, 4500, 4512, 4488, 4505)
+	barData := NewInMemoryBarData()
+	start := bar.Date - time.Minute.Milliseconds()
+	barData.AddBars(1, []bars.Bar{
+		{Date: start + 1000, Open: 4500, High: 4511, Low: 4500, Close: 4511, Volume: 10},
+		{Date: start + 2000, Open: 4511, High: 4511, Low: 4488, Close: 4490, Volume: 10},
+	})
+
+	orders, positions := testBracket()
+	_, updated, _, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {bar}},
+		orders,
+		positions,
+		simulate.Config{Intrabar: simulate.DrillDownResolver{
+			BarData:  barData,
+			Fallback: simulate.PathResolver{Path: "pessimistic"},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if got := filledOrderID(t, updated); got != 2 {
+		t.Errorf("Expected the target to fill first, got order %d", got)
+	}
+}
+
+func TestSimulateBars_VolumePartialFill(t *testing.T) {
+	order := testOrder(1, "limit", "buy", 4499)
+	order.Quantity = 5
+	liquidity := simulate.Config{Liquidity: simulate.VolumeLiquidity{Fraction: 0.1}}
+
+	first := testBar(0, 4500, 4502, 4498, 4501)
+	first.Volume = 30
+	didExecute, orders, positions, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {first}},
+		[]database.Order{order},
+		nil,
+		liquidity,
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if !didExecute {
+		t.Fatalf("Expected part of the order to fill")
+	}
+	if orders[0].FilledQuantity != 3 || orders[0].FulfilledAt != nil {
+		t.Fatalf("Expected 3 of 5 filled and the rest working, got %d filled", orders[0].FilledQuantity)
+	}
+	if len(positions) != 1 || positions[0].Quantity != 3 {
+		t.Fatalf("Expected a position of 3, got %+v", positions)
+	}
+	if len(orders[0].PendingFills) != 1 {
+		t.Fatalf("Expected one fill, got %d", len(orders[0].PendingFills))
+	}
+
+	// The rest fills on the next bar at a better price
+	second := testBar(1, 4499, 4500, 4497, 4498)
+	second.Volume = 30
+	orders[0].PendingFills = nil
+	_, orders, positions, _, err = simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {second}},
+		orders,
+		positions,
+		liquidity,
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if orders[0].FilledQuantity != 5 || orders[0].FulfilledAt == nil {
+		t.Fatalf("Expected the order to be filled, got %d filled", orders[0].FilledQuantity)
+	}
+	held := 0
+	for _, position := range positions {
+		held += position.Quantity
+	}
+	if held != 5 {
+		t.Fatalf("Expected to hold 5 contracts, got %+v", positions)
+	}
+	if orders[0].FulfilledPrice != 4499 {
+		t.Errorf("Expected average fill price 4499, got %v", orders[0].FulfilledPrice)
+	}
+}
+
+func TestSimulateBars_ThroughLiquidity(t *testing.T) {
+	order := testOrder(1, "limit", "buy", 4498)
+	didExecute, _, _, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(0, 4500, 4502, 4498, 4501)}},
+		[]database.Order{order},
+		nil,
+		simulate.Config{Liquidity: simulate.ThroughLiquidity{}},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if didExecute {
+		t.Errorf("Expected a touch of the limit price not to fill")
+	}
+}
+
+func TestSimulateBars_TrailingStopRatchets(t *testing.T) {
+	order := testOrder(1, "trailing-stop", "sell", 0)
+	order.TrailAmount = 2
+	order.TrailUnit = "points"
+	positions := []database.Position{
+		{AccountID: 1, SymbolID: 1, Direction: "buy", Price: 4500, Quantity: 1},
+	}
+
+	// The stop starts 2 points under the open and follows the high up
+	didExecute, orders, _, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(0, 4500, 4504, 4499, 4503)}},
+		[]database.Order{order},
+		positions,
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if !didExecute || len(orders) != 1 {
+		t.Fatalf("Expected the trailing stop to be updated, got %+v", orders)
+	}
+	if orders[0].FulfilledAt != nil {
+		t.Fatalf("Expected the trailing stop not to fill")
+	}
+	if orders[0].HighWaterMark != 4504 || orders[0].Price != 4502 {
+		t.Fatalf("Expected stop 4502 under a high of 4504, got %v under %v", orders[0].Price, orders[0].HighWaterMark)
+	}
+
+	// A lower high leaves the stop where it is, and the pullback fills it
+	_, orders, positions, cash, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {testBar(1, 4503, 4503.5, 4501, 4501.5)}},
+		orders,
+		positions,
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if orders[0].FulfilledAt == nil || orders[0].FulfilledPrice != 4502 {
+		t.Fatalf("Expected the trailing stop to fill at 4502, got %+v", orders[0])
+	}
+	if len(positions) != 0 || cash != 2*50 {
+		t.Errorf("Expected to be flat with 100 of profit, got %+v and %v", positions, cash)
+	}
+}
+
+func TestSimulateBars_TrailingStopBracketLeg(t *testing.T) {
+	entry := testOrder(1, "market", "buy", 0)
+	entryID := entry.ID
+	target := testOrder(2, "limit", "sell", 4520)
+	target.EntryOrderID = &entryID
+	target.ActivatedAt = nil
+	trail := testOrder(3, "trailing-stop", "sell", 0)
+	trail.TrailAmount = 4
+	trail.TrailUnit = "ticks"
+	trail.EntryOrderID = &entryID
+	trail.ActivatedAt = nil
+
+	_, orders, positions, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {
+			testBar(0, 4500, 4503, 4499, 4502),
+			testBar(1, 4502, 4506, 4501.5, 4505),
+			testBar(2, 4505, 4505.25, 4504, 4504),
+		}},
+		[]database.Order{entry, target, trail},
+		nil,
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if len(positions) != 0 {
+		t.Errorf("Expected to be flat, got %+v", positions)
+	}
+	for _, order := range orders {
+		switch order.ID {
+		case 2:
+			if order.CancelledAt == nil {
+				t.Errorf("Expected the target to be cancelled")
+			}
+		case 3:
+			// Started a point under the entry bar's close, then trailed the 4506 high
+			if order.FulfilledAt == nil || order.FulfilledPrice != 4505 {
+				t.Errorf("Expected the trailing stop to fill at 4505, got %+v", order)
+			}
+		}
+	}
+}
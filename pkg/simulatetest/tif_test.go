@@ -0,0 +1,86 @@
+package simulatetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tradingcage/tradingcage-go/pkg/bars"
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func TestSimulateBars_ExpiredOrderDoesNotFill(t *testing.T) {
+	entry := testOrder(1, "limit", "buy", 4490)
+	entry.TimeInForce = "gtd"
+	expiresAt := testActivatedAt.Add(2 * time.Minute)
+	entry.ExpiresAt = &expiresAt
+	entryID := entry.ID
+	stop := testOrder(2, "stop", "sell", 4480)
+	stop.EntryOrderID = &entryID
+	stop.ActivatedAt = nil
+
+	didExecute, orders, positions, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {
+			testBar(0, 4500, 4502, 4498, 4501),
+			testBar(1, 4501, 4502, 4495, 4496),
+			testBar(2, 4496, 4497, 4489, 4490),
+		}},
+		[]database.Order{entry, stop},
+		nil,
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if !didExecute || len(positions) != 0 {
+		t.Fatalf("Expected the order to expire without filling, got %+v", positions)
+	}
+	for _, order := range orders {
+		if order.FulfilledAt != nil || order.CancelledAt == nil || !order.CancelledAt.Equal(expiresAt) {
+			t.Errorf("Expected order %d to be cancelled at its expiry, got %+v", order.ID, order)
+		}
+	}
+}
+
+func TestSimulateBars_ImmediateOrCancel(t *testing.T) {
+	order := testOrder(1, "limit", "buy", 4490)
+	order.TimeInForce = "ioc"
+
+	_, orders, _, _, err := simulate.SimulateBars(
+		map[uint][]bars.Bar{1: {
+			testBar(0, 4500, 4502, 4498, 4501),
+			testBar(1, 4501, 4502, 4489, 4496),
+		}},
+		[]database.Order{order},
+		nil,
+		simulate.Config{},
+	)
+	if err != nil {
+		t.Fatalf("SimulateBars returned unexpected error: %v", err)
+	}
+	if len(orders) != 1 || orders[0].FulfilledAt != nil || orders[0].CancelledAt == nil {
+		t.Fatalf("Expected the order to be cancelled after the first bar, got %+v", orders)
+	}
+	if orders[0].CancelledAt.UnixMilli() != testBar(0, 0, 0, 0, 0).Date {
+		t.Errorf("Expected the order to be cancelled at the end of the first bar, got %v", orders[0].CancelledAt)
+	}
+}
+
+func TestSetExpiry(t *testing.T) {
+	order := testOrder(1, "limit", "buy", 4490)
+	order.TimeInForce = "day"
+	if errs := simulate.SetExpiry("entryOrder", &order, testActivatedAt); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	chicago, _ := time.LoadLocation("America/Chicago")
+	if want := time.Date(2023, 11, 1, 15, 15, 0, 0, chicago); !order.ExpiresAt.Equal(want) {
+		t.Errorf("Expected DAY order to expire at %v, got %v", want, order.ExpiresAt)
+	}
+
+	order.TimeInForce = "gtd"
+	past := testActivatedAt.Add(-time.Hour)
+	order.ExpiresAt = &past
+	if errs := simulate.SetExpiry("entryOrder", &order, testActivatedAt); len(errs) != 1 {
+		t.Errorf("Expected an error for a GTD expiry in the past, got %v", errs)
+	}
+}
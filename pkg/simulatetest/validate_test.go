@@ -0,0 +1,95 @@
+package simulatetest
+
+import (
+	"testing"
+
+	"github.com/tradingcage/tradingcage-go/pkg/database"
+	"github.com/tradingcage/tradingcage-go/pkg/simulate"
+)
+
+func TestValidateOrder_OffTick(t *testing.T) {
+	order := testOrder(1, "limit", "buy", 4501.13)
+	errs := simulate.ValidateOrder("entryOrder", &order, false)
+	if len(errs) != 1 || errs[0].Field != "entryOrder.price" {
+		t.Fatalf("Expected a single price error, got %v", errs)
+	}
+
+	errs = simulate.ValidateOrder("entryOrder", &order, true)
+	if len(errs) != 0 {
+		t.Fatalf("Expected no errors when snapping, got %v", errs)
+	}
+	if order.Price != 4501.25 {
+		t.Errorf("Expected price to snap to 4501.25, got %v", order.Price)
+	}
+}
+
+func TestValidateOrder_Invalid(t *testing.T) {
+	order := database.Order{
+		SymbolID:   24,
+		OrderType:  "trailing",
+		Direction:  "long",
+		Quantity:   0,
+		Price:      -1,
+		LimitPrice: 0,
+	}
+	errs := simulate.ValidateOrder("entryOrder", &order, false)
+	fields := make(map[string]bool)
+	for _, e := range errs {
+		fields[e.Field] = true
+	}
+	for _, field := range []string{"entryOrder.symbolID", "entryOrder.orderType", "entryOrder.direction", "entryOrder.quantity", "entryOrder.price"} {
+		if !fields[field] {
+			t.Errorf("Expected an error for %s, got %v", field, errs)
+		}
+	}
+}
+
+func TestValidateOrder_MarketIgnoresPrice(t *testing.T) {
+	order := testOrder(1, "market", "sell", 0)
+	if errs := simulate.ValidateOrder("entryOrder", &order, false); len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+}
+
+func TestValidateOrder_TrailingStop(t *testing.T) {
+	order := testOrder(1, "trailing-stop", "sell", 4490)
+	order.TrailAmount = 2.5
+	order.TrailUnit = "ticks"
+	errs := simulate.ValidateOrder("linkedOrders[0]", &order, false)
+	if len(errs) != 1 || errs[0].Field != "linkedOrders[0].trailAmount" {
+		t.Fatalf("Expected a single trailAmount error, got %v", errs)
+	}
+
+	order.TrailAmount = 8
+	if errs := simulate.ValidateOrder("linkedOrders[0]", &order, false); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	if order.Price != 0 {
+		t.Errorf("Expected the stop price to be left to the simulation, got %v", order.Price)
+	}
+}
+
+func TestValidateOrder_StopLimitPrices(t *testing.T) {
+	tests := []struct {
+		direction  string
+		limitPrice float64
+		wantErr    bool
+	}{
+		{"buy", 4502, false},
+		{"buy", 4501, false},
+		{"buy", 4500, true},
+		{"sell", 4500, false},
+		{"sell", 4502, true},
+	}
+	for _, tt := range tests {
+		order := testOrder(1, "stop-limit", tt.direction, 4501)
+		order.LimitPrice = tt.limitPrice
+		errs := simulate.ValidateOrder("entryOrder", &order, false)
+		if tt.wantErr && (len(errs) != 1 || errs[0].Field != "entryOrder.limitPrice") {
+			t.Errorf("%s limit %v: expected a single limitPrice error, got %v", tt.direction, tt.limitPrice, errs)
+		}
+		if !tt.wantErr && len(errs) != 0 {
+			t.Errorf("%s limit %v: expected no errors, got %v", tt.direction, tt.limitPrice, errs)
+		}
+	}
+}